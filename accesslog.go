@@ -0,0 +1,304 @@
+package socks5
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+)
+
+// DefaultAccessLogTemplate is the line format of the "text" access log
+const DefaultAccessLogTemplate = `{{.Start.Format "2006-01-02T15:04:05.000Z07:00"}} conn={{.ID}} client={{.ClientAddr}} user={{or .Identity "-"}} ` +
+	`request={{.Requested}} resolved={{or .Resolved "-"}} upstream={{or .Upstream "-"}} ` +
+	`up={{.Upload}} down={{.Download}} duration={{.Duration.Milliseconds}}ms reply={{.Reply}} reason={{.Reason}}`
+
+// AccessLogConfig configures the access log: one line per finished connection
+type AccessLogConfig struct {
+	File        string        // 输出文件，为空或 "-" 时写到标准输出
+	Format      string        // json（默认）、text，或 text/template 模板，字段见 ConnStats
+	MaxSize     int64         // 文件超过该大小时轮转，0 表示不按大小轮转
+	RotateEvery time.Duration // 按时间轮转的间隔，0 表示不按时间轮转
+	MaxBackups  int           // 保留的轮转文件数，0 表示全部保留
+	BufferSize  int           // 异步写入队列长度，默认 4096；队列满时丢弃记录
+}
+
+// WithAccessLog writes an access log
+func WithAccessLog(cfg AccessLogConfig) Option {
+	return func(s *Server) {
+		s.accessLogConfig = &cfg
+	}
+}
+
+// ReopenAccessLog reopens the access log file, for use after it was moved
+// away by logrotate
+func (s *Server) ReopenAccessLog() error {
+	if s.accessLog == nil {
+		return nil
+	}
+	return s.accessLog.out.reopen()
+}
+
+// accessLog formats and writes records in its own goroutine, so that slow
+// disks do not hold up the connections
+type accessLog struct {
+	tmpl    *template.Template // nil for JSON lines
+	out     *rotatingFile
+	records chan ConnStats
+	dropped atomic.Uint64
+	mu      sync.RWMutex
+	closed  bool
+	logger  *slog.Logger
+	done    chan struct{}
+}
+
+func newAccessLog(cfg AccessLogConfig, logger *slog.Logger) (*accessLog, error) {
+	a := &accessLog{logger: logger, done: make(chan struct{})}
+	switch cfg.Format {
+	case "", "json":
+	case "text":
+		a.tmpl = template.Must(template.New("access").Parse(DefaultAccessLogTemplate))
+	default:
+		tmpl, err := template.New("access").Parse(cfg.Format)
+		if err != nil {
+			return nil, fmt.Errorf("invalid access log template: %v", err)
+		}
+		a.tmpl = tmpl
+	}
+	out, err := openRotatingFile(cfg)
+	if err != nil {
+		return nil, err
+	}
+	a.out = out
+	size := cfg.BufferSize
+	if size <= 0 {
+		size = 4096
+	}
+	a.records = make(chan ConnStats, size)
+	go a.run()
+	return a, nil
+}
+
+// log queues a record, dropping it when the queue is full
+func (a *accessLog) log(stats ConnStats) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.closed {
+		a.dropped.Add(1)
+		return
+	}
+	select {
+	case a.records <- stats:
+	default:
+		a.dropped.Add(1)
+	}
+}
+
+func (a *accessLog) run() {
+	defer close(a.done)
+	var buf bytes.Buffer
+	for stats := range a.records {
+		buf.Reset()
+		if err := a.format(&buf, stats); err != nil {
+			a.logger.Error("Failed to format access log record", "err", err)
+			continue
+		}
+		if _, err := a.out.Write(buf.Bytes()); err != nil {
+			a.logger.Error("Failed to write access log", "err", err)
+		}
+	}
+}
+
+// close writes the queued records and closes the file
+func (a *accessLog) close() error {
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return nil
+	}
+	a.closed = true
+	close(a.records)
+	a.mu.Unlock()
+	<-a.done
+	return a.out.close()
+}
+
+func (a *accessLog) format(w *bytes.Buffer, stats ConnStats) error {
+	if a.tmpl != nil {
+		if err := a.tmpl.Execute(w, stats); err != nil {
+			return err
+		}
+		w.WriteByte('\n')
+		return nil
+	}
+	var client string
+	if stats.ClientAddr != nil {
+		client = stats.ClientAddr.String()
+	}
+	// Encode appends the newline
+	return json.NewEncoder(w).Encode(struct {
+		Start      time.Time   `json:"start"`
+		DurationMs int64       `json:"duration_ms"`
+		ID         uint64      `json:"conn"`
+		Client     string      `json:"client,omitempty"`
+		Listener   string      `json:"listener"`
+		User       string      `json:"user,omitempty"`
+		Request    string      `json:"request,omitempty"`
+		Target     string      `json:"target,omitempty"`
+		Resolved   string      `json:"resolved,omitempty"`
+		Upstream   string      `json:"upstream,omitempty"`
+		Upload     int64       `json:"upload"`
+		Download   int64       `json:"download"`
+		Reply      int         `json:"reply"`
+		Reason     CloseReason `json:"reason"`
+	}{
+		Start:      stats.Start,
+		DurationMs: stats.Duration.Milliseconds(),
+		ID:         stats.ID,
+		Client:     client,
+		Listener:   stats.Listener,
+		User:       stats.Identity,
+		Request:    stats.Requested,
+		Target:     stats.Target,
+		Resolved:   stats.Resolved,
+		Upstream:   stats.Upstream,
+		Upload:     stats.Upload,
+		Download:   stats.Download,
+		Reply:      stats.Reply,
+		Reason:     stats.Reason,
+	})
+}
+
+// rotateTimeLayout is the timestamp suffix of rotated files
+const rotateTimeLayout = "20060102-150405.000"
+
+// rotatingFile is a log file rotated by size and age. Rotated files get a
+// timestamp suffix.
+type rotatingFile struct {
+	cfg AccessLogConfig
+
+	mu      sync.Mutex
+	f       *os.File
+	size    int64
+	opened  time.Time
+	console bool
+}
+
+func openRotatingFile(cfg AccessLogConfig) (*rotatingFile, error) {
+	r := &rotatingFile{cfg: cfg}
+	if cfg.File == "" || cfg.File == "-" {
+		r.f = os.Stdout
+		r.console = true
+		return r, nil
+	}
+	return r, r.open()
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.cfg.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f = f
+	r.size = info.Size()
+	r.opened = time.Now()
+	return nil
+}
+
+func (r *rotatingFile) Write(b []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.console && r.f != nil && r.size > 0 {
+		if (r.cfg.MaxSize > 0 && r.size+int64(len(b)) > r.cfg.MaxSize) ||
+			(r.cfg.RotateEvery > 0 && time.Since(r.opened) >= r.cfg.RotateEvery) {
+			if err := r.rotate(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if r.f == nil {
+		// A failed rotation or reopen, try again
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(b)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate moves the current file aside and starts a new one
+func (r *rotatingFile) rotate() error {
+	r.f.Close()
+	r.f = nil
+	backup := r.cfg.File + "." + time.Now().Format(rotateTimeLayout)
+	if err := os.Rename(r.cfg.File, backup); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	r.prune()
+	return r.open()
+}
+
+// prune removes the oldest rotated files beyond MaxBackups. Only names
+// with our timestamp suffix count, files of logrotate and others stay.
+func (r *rotatingFile) prune() {
+	if r.cfg.MaxBackups <= 0 {
+		return
+	}
+	entries, _ := os.ReadDir(filepath.Dir(r.cfg.File))
+	prefix := filepath.Base(r.cfg.File) + "."
+	var backups []string
+	for _, e := range entries {
+		suffix, ok := strings.CutPrefix(e.Name(), prefix)
+		if !ok || e.IsDir() {
+			continue
+		}
+		if _, err := time.Parse(rotateTimeLayout, suffix); err == nil {
+			backups = append(backups, filepath.Join(filepath.Dir(r.cfg.File), e.Name()))
+		}
+	}
+	if len(backups) <= r.cfg.MaxBackups {
+		return
+	}
+	// The timestamp suffix sorts by age
+	sort.Strings(backups)
+	for _, name := range backups[:len(backups)-r.cfg.MaxBackups] {
+		_ = os.Remove(name)
+	}
+}
+
+func (r *rotatingFile) reopen() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.console {
+		return nil
+	}
+	if r.f != nil {
+		r.f.Close()
+		r.f = nil
+	}
+	return r.open()
+}
+
+func (r *rotatingFile) close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.console || r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
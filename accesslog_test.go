@@ -0,0 +1,167 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readLines returns the lines of a log file
+func readLines(t *testing.T, name string) []string {
+	t.Helper()
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+// waitLines waits until the log file has n lines
+func waitLines(t *testing.T, name string, n int) []string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if data, _ := os.ReadFile(name); bytes.Count(data, []byte("\n")) >= n {
+			return readLines(t, name)
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s does not have %d lines", name, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAccessLogRotation(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "access.log")
+	// Files of logrotate and others are not ours to prune
+	foreign := []string{file + ".1", file + ".2.gz", file + ".old", filepath.Join(dir, "other.log.20240101-000000.000")}
+	for _, name := range foreign {
+		if err := os.WriteFile(name, []byte("keep\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r, err := openRotatingFile(AccessLogConfig{File: file, MaxSize: 100, MaxBackups: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := append(bytes.Repeat([]byte("x"), 59), '\n')
+	for i := 0; i < 6; i++ {
+		if _, err := r.Write(line); err != nil {
+			t.Fatal(err)
+		}
+		// Rotated files are named by the millisecond
+		time.Sleep(2 * time.Millisecond)
+	}
+	if err := r.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each file holds one line, the two newest rotated ones are kept
+	if lines := readLines(t, file); len(lines) != 1 {
+		t.Errorf("%d lines in the current file, want 1", len(lines))
+	}
+	var backups []string
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		if suffix, ok := strings.CutPrefix(e.Name(), "access.log."); ok {
+			if _, err := time.Parse(rotateTimeLayout, suffix); err == nil {
+				backups = append(backups, e.Name())
+			}
+		}
+	}
+	if len(backups) != 2 {
+		t.Errorf("rotated files %q, want 2", backups)
+	}
+	for _, name := range foreign {
+		if _, err := os.Stat(name); err != nil {
+			t.Errorf("pruned %s: %v", filepath.Base(name), err)
+		}
+	}
+}
+
+func TestAccessLogRotateEvery(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "access.log")
+	r, err := openRotatingFile(AccessLogConfig{File: file, RotateEvery: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.close()
+	_, _ = r.Write([]byte("first\n"))
+	_, _ = r.Write([]byte("second\n"))
+	time.Sleep(60 * time.Millisecond)
+	_, _ = r.Write([]byte("third\n"))
+	if lines := readLines(t, file); len(lines) != 1 || lines[0] != "third" {
+		t.Errorf("current file %q, want the third line only", lines)
+	}
+	backups, _ := filepath.Glob(file + ".*")
+	if len(backups) != 1 {
+		t.Fatalf("rotated files %q, want 1", backups)
+	}
+	if lines := readLines(t, backups[0]); len(lines) != 2 {
+		t.Errorf("rotated file %q, want the first two lines", lines)
+	}
+}
+
+func TestAccessLogReopen(t *testing.T) {
+	echo := startEcho(t)
+	file := filepath.Join(t.TempDir(), "access.log")
+	s, addr := startServer(t, ListenerConfig{Profile: &Profile{Username: "user", Password: "secret"}},
+		WithAccessLog(AccessLogConfig{File: file}))
+	connect := func() {
+		t.Helper()
+		conn, err := userDialer(addr).Dial("tcp", echo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		echoThrough(t, conn, "hello")
+		conn.Close()
+	}
+
+	connect()
+	lines := waitLines(t, file, 1)
+	var record struct {
+		User     string      `json:"user"`
+		Request  string      `json:"request"`
+		Upload   int64       `json:"upload"`
+		Download int64       `json:"download"`
+		Reply    int         `json:"reply"`
+		Reason   CloseReason `json:"reason"`
+	}
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record.User != "user" || record.Request != echo || record.Upload != 5 || record.Download != 5 ||
+		record.Reply != 0 || record.Reason != CloseClientClosed {
+		t.Errorf("record = %+v", record)
+	}
+
+	// logrotate moves the file away; records go to the moved file until
+	// the log is reopened
+	moved := file + ".1"
+	if err := os.Rename(file, moved); err != nil {
+		t.Fatal(err)
+	}
+	connect()
+	waitLines(t, moved, 2)
+	if err := s.ReopenAccessLog(); err != nil {
+		t.Fatal(err)
+	}
+	connect()
+	waitLines(t, file, 1)
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if lines := readLines(t, moved); len(lines) != 2 {
+		t.Errorf("%d lines in the moved file, want 2", len(lines))
+	}
+	if lines := readLines(t, file); len(lines) != 1 {
+		t.Errorf("%d lines in the reopened file, want 1", len(lines))
+	}
+}
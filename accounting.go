@@ -0,0 +1,427 @@
+package socks5
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errQuotaExceeded = errors.New("traffic quota exceeded")
+
+// Quota limits the traffic of a user, upload and download combined; 0 means unlimited
+type Quota struct {
+	Daily   int64 `json:"daily"`
+	Monthly int64 `json:"monthly"`
+}
+
+// AccountingConfig enables per-user traffic accounting
+type AccountingConfig struct {
+	File          string           // 持久化文件，为空时不持久化
+	FlushInterval time.Duration    // 持久化间隔，默认 1 分钟
+	Quota         Quota            // 默认配额
+	UserQuotas    map[string]Quota // 单独设置的用户配额
+}
+
+// Usage is the traffic of one user. The key is the user identity, or the
+// client IP for unauthenticated connections.
+type Usage struct {
+	Upload     int64  `json:"upload"`   // 累计上行字节数
+	Download   int64  `json:"download"` // 累计下行字节数
+	Day        string `json:"day"`      // DayBytes 所属日期
+	DayBytes   int64  `json:"day_bytes"`
+	Month      string `json:"month"` // MonthBytes 所属月份
+	MonthBytes int64  `json:"month_bytes"`
+}
+
+// rollover resets the daily and monthly counters when the period changed
+func (u *Usage) rollover(now time.Time) {
+	if day := now.Format("2006-01-02"); u.Day != day {
+		u.Day, u.DayBytes = day, 0
+	}
+	if month := now.Format("2006-01"); u.Month != month {
+		u.Month, u.MonthBytes = month, 0
+	}
+}
+
+// WithAccounting counts the traffic of every user and enforces quotas
+func WithAccounting(cfg AccountingConfig) Option {
+	return func(s *Server) {
+		if cfg.FlushInterval <= 0 {
+			cfg.FlushInterval = time.Minute
+		}
+		s.accounting = &accounting{cfg: cfg, usage: make(map[string]*Usage)}
+	}
+}
+
+// Usage returns the traffic of every user
+func (s *Server) Usage() map[string]Usage {
+	if s.accounting == nil {
+		return nil
+	}
+	a := s.accounting
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	usage := make(map[string]Usage, len(a.usage))
+	for key, u := range a.usage {
+		u.rollover(now)
+		usage[key] = *u
+	}
+	return usage
+}
+
+// SetQuota changes the quota of a user, an empty key changes the default
+func (s *Server) SetQuota(key string, q Quota) {
+	if s.accounting == nil {
+		return
+	}
+	a := s.accounting
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if key == "" {
+		a.cfg.Quota = q
+		return
+	}
+	if a.cfg.UserQuotas == nil {
+		a.cfg.UserQuotas = make(map[string]Quota)
+	}
+	a.cfg.UserQuotas[key] = q
+}
+
+// ResetUsage clears the daily and monthly counters of a user
+func (s *Server) ResetUsage(key string) {
+	if s.accounting == nil {
+		return
+	}
+	a := s.accounting
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if u := a.usage[key]; u != nil {
+		u.DayBytes, u.MonthBytes = 0, 0
+		a.dirty = true
+	}
+}
+
+type accounting struct {
+	mu      sync.Mutex
+	cfg     AccountingConfig
+	usage   map[string]*Usage
+	saved   map[string]Usage // 文件中的计数，交接时据此计算增量
+	dirty   bool
+	flushMu sync.Mutex // 保证同一时间只有一次写文件
+
+	handedOver bool     // 新进程已接管文件，此后只在关闭时写出增量
+	merged     []string // 已合并、写入文件后删除的交接文件
+}
+
+// accountEntry is the accounting handle of one connection, nil when
+// accounting is disabled
+type accountEntry struct {
+	a   *accounting
+	key string
+}
+
+func (a *accounting) open(key string) *accountEntry {
+	if a == nil {
+		return nil
+	}
+	return &accountEntry{a: a, key: key}
+}
+
+func (a *accounting) quota(key string) Quota {
+	if q, ok := a.cfg.UserQuotas[key]; ok {
+		return q
+	}
+	return a.cfg.Quota
+}
+
+// exceeded reports whether the user has used up a quota
+func (e *accountEntry) exceeded() bool {
+	if e == nil {
+		return false
+	}
+	a := e.a
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	u := a.usage[e.key]
+	if u == nil {
+		return false
+	}
+	u.rollover(time.Now())
+	return quotaExceeded(u, a.quota(e.key))
+}
+
+// add records n bytes and reports whether the user is now over quota
+func (e *accountEntry) add(n int, upload bool) bool {
+	if e == nil {
+		return false
+	}
+	a := e.a
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	u := a.usage[e.key]
+	if u == nil {
+		u = &Usage{}
+		a.usage[e.key] = u
+	}
+	u.rollover(time.Now())
+	if upload {
+		u.Upload += int64(n)
+	} else {
+		u.Download += int64(n)
+	}
+	u.DayBytes += int64(n)
+	u.MonthBytes += int64(n)
+	a.dirty = true
+	return quotaExceeded(u, a.quota(e.key))
+}
+
+func quotaExceeded(u *Usage, q Quota) bool {
+	return (q.Daily > 0 && u.DayBytes >= q.Daily) || (q.Monthly > 0 && u.MonthBytes >= q.Monthly)
+}
+
+// load reads the persisted counters and those left by a previous process
+func (a *accounting) load() error {
+	if a.cfg.File == "" {
+		return nil
+	}
+	a.flushMu.Lock()
+	defer a.flushMu.Unlock()
+	data, err := os.ReadFile(a.cfg.File)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	var usage map[string]*Usage
+	if err == nil {
+		if err := json.Unmarshal(data, &usage); err != nil {
+			return err
+		}
+	}
+	// The file may hold null
+	if usage == nil {
+		usage = make(map[string]*Usage)
+	}
+	a.mu.Lock()
+	a.usage = usage
+	a.saved = snapshotUsage(usage)
+	a.mu.Unlock()
+	a.mergeHandovers()
+	return nil
+}
+
+// flush writes the counters to disk if they changed, together with the
+// counts handed over by previous processes. After a handover it does
+// nothing, the new process owns the file.
+func (a *accounting) flush() error {
+	if a.cfg.File == "" {
+		return nil
+	}
+	a.flushMu.Lock()
+	defer a.flushMu.Unlock()
+	a.mergeHandovers()
+	a.mu.Lock()
+	if !a.dirty || a.handedOver {
+		a.mu.Unlock()
+		return nil
+	}
+	now := time.Now()
+	for _, u := range a.usage {
+		u.rollover(now)
+	}
+	data, err := json.MarshalIndent(a.usage, "", "  ")
+	saved := snapshotUsage(a.usage)
+	a.dirty = false
+	a.mu.Unlock()
+	if err == nil {
+		err = writeFileAtomic(a.cfg.File, data)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err != nil {
+		a.dirty = true
+		return err
+	}
+	a.saved = saved
+	// The handed over counts are in the file now
+	for _, name := range a.merged {
+		_ = os.Remove(name)
+	}
+	a.merged = nil
+	return nil
+}
+
+// handOver stops writing the file, a new process is loading it
+func (a *accounting) handOver() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.handedOver = true
+}
+
+// resume takes the file back when the new process failed
+func (a *accounting) resume() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.handedOver = false
+	a.dirty = true
+}
+
+// close saves the counters on shutdown. After a handover only the traffic
+// counted since the file was last written is saved, to a handover file that
+// the new process adds to its counters.
+func (a *accounting) close() error {
+	if a.cfg.File == "" {
+		return nil
+	}
+	a.mu.Lock()
+	if !a.handedOver {
+		a.mu.Unlock()
+		return a.flush()
+	}
+	now := time.Now()
+	delta := make(map[string]Usage)
+	for key, u := range a.usage {
+		u.rollover(now)
+		if d, ok := usageDelta(*u, a.saved[key]); ok {
+			delta[key] = d
+		}
+	}
+	a.mu.Unlock()
+	if len(delta) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(delta)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(handoverFile(a.cfg.File, os.Getpid()), data)
+}
+
+// handoverFile is where process pid leaves its counts for its successor
+func handoverFile(file string, pid int) string {
+	return file + ".handover-" + strconv.Itoa(pid)
+}
+
+// mergeHandovers adds the counts left by previous processes. The files are
+// removed once the merged counters are written.
+func (a *accounting) mergeHandovers() {
+	names, _ := filepath.Glob(a.cfg.File + ".handover-*")
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	for _, name := range names {
+		// Skip the temporary files of a handover being written
+		pid := strings.TrimPrefix(name, a.cfg.File+".handover-")
+		if _, err := strconv.Atoi(pid); err != nil || contains(a.merged, name) {
+			continue
+		}
+		data, err := os.ReadFile(name)
+		if err != nil {
+			continue
+		}
+		var delta map[string]Usage
+		if err := json.Unmarshal(data, &delta); err != nil {
+			continue
+		}
+		for key, d := range delta {
+			u := a.usage[key]
+			if u == nil {
+				u = &Usage{}
+				a.usage[key] = u
+			}
+			u.rollover(now)
+			u.Upload += d.Upload
+			u.Download += d.Download
+			if d.Day == u.Day {
+				u.DayBytes += d.DayBytes
+			}
+			if d.Month == u.Month {
+				u.MonthBytes += d.MonthBytes
+			}
+		}
+		a.merged = append(a.merged, name)
+		a.dirty = true
+	}
+}
+
+// usageDelta returns what u counted beyond saved, the usage last written
+func usageDelta(u, saved Usage) (Usage, bool) {
+	d := Usage{
+		Upload:   u.Upload - saved.Upload,
+		Download: u.Download - saved.Download,
+		Day:      u.Day,
+		DayBytes: u.DayBytes,
+		Month:    u.Month,
+	}
+	d.MonthBytes = u.MonthBytes
+	if saved.Day == u.Day {
+		d.DayBytes -= saved.DayBytes
+	}
+	if saved.Month == u.Month {
+		d.MonthBytes -= saved.MonthBytes
+	}
+	// ResetUsage lowers the counters, that is not traffic
+	d.DayBytes, d.MonthBytes = max(d.DayBytes, 0), max(d.MonthBytes, 0)
+	return d, d.Upload > 0 || d.Download > 0
+}
+
+func snapshotUsage(usage map[string]*Usage) map[string]Usage {
+	snapshot := make(map[string]Usage, len(usage))
+	for key, u := range usage {
+		snapshot[key] = *u
+	}
+	return snapshot
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// writeFileAtomic replaces name with data, so that readers never see a
+// partly written file
+func writeFileAtomic(name string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), name)
+	}
+	return err
+}
+
+// run persists the counters periodically until done is closed
+func (a *accounting) run(done <-chan struct{}, logger *slog.Logger) {
+	ticker := time.NewTicker(a.cfg.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			if err := a.flush(); err != nil {
+				logger.Error("Failed to save traffic accounting", "err", err)
+			}
+			return
+		case <-ticker.C:
+			if err := a.flush(); err != nil {
+				logger.Error("Failed to save traffic accounting", "err", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dcsunny/socks5/wire"
+)
+
+func userDialer(addr string) *Dialer {
+	return &Dialer{ProxyAddr: addr, Username: "user", Password: "secret"}
+}
+
+func TestQuota(t *testing.T) {
+	echo := startEcho(t)
+	hook, closed := closeHook()
+	s, addr := startServer(t, ListenerConfig{Profile: &Profile{Username: "user", Password: "secret"}}, hook,
+		WithAccounting(AccountingConfig{Quota: Quota{Daily: 1 << 20}}))
+
+	conn, err := userDialer(addr).Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoThrough(t, conn, "hello")
+	conn.Close()
+	nextClose(t, closed)
+	if u := s.Usage()["user"]; u.Upload != 5 || u.Download != 5 || u.DayBytes != 10 || u.MonthBytes != 10 {
+		t.Errorf("usage = %+v, want 5 bytes each way", u)
+	}
+
+	// Running over the quota ends the tunnel; spliced tunnels count and
+	// check it every spliceChunk bytes
+	conn, err = userDialer(addr).Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_, _ = conn.Write(bytes.Repeat([]byte("x"), 3*spliceChunk))
+	}()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	// Unread upload data may turn the close into a reset
+	if _, err := io.Copy(io.Discard, conn); errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("tunnel over quota still open")
+	}
+	conn.Close()
+	if stats := nextClose(t, closed); stats.Reason != CloseQuotaExceeded {
+		t.Errorf("reason = %s, want %s", stats.Reason, CloseQuotaExceeded)
+	}
+
+	// and refuses new requests
+	if _, err := userDialer(addr).Dial("tcp", echo); replyCode(err) != int(wire.RepRulesetDenied) {
+		t.Fatalf("err = %v, want a ruleset denied reply", err)
+	}
+	if stats := nextClose(t, closed); stats.Reason != CloseQuotaExceeded {
+		t.Errorf("reason = %s, want %s", stats.Reason, CloseQuotaExceeded)
+	}
+
+	// until the user gets more, or the counters are reset
+	s.SetQuota("user", Quota{Daily: 1 << 30})
+	conn, err = userDialer(addr).Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoThrough(t, conn, "hello")
+	conn.Close()
+	s.SetQuota("user", Quota{Daily: 1})
+	s.ResetUsage("user")
+	if u := s.Usage()["user"]; u.DayBytes != 0 || u.MonthBytes != 0 || u.Upload == 0 {
+		t.Errorf("usage after reset = %+v, want the totals only", u)
+	}
+}
+
+func TestAccountingPersistence(t *testing.T) {
+	echo := startEcho(t)
+	file := filepath.Join(t.TempDir(), "usage.json")
+	cfg := ListenerConfig{Profile: &Profile{Username: "user", Password: "secret"}}
+
+	s, addr := startServer(t, cfg, WithAccounting(AccountingConfig{File: file}))
+	conn, err := userDialer(addr).Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoThrough(t, conn, "hello")
+	conn.Close()
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := s.Usage()["user"]
+
+	// A restart continues from the saved counters, quotas included
+	s, addr = startServer(t, cfg, WithAccounting(AccountingConfig{File: file, Quota: Quota{Daily: 10}}))
+	if got := s.Usage()["user"]; got != want || got.Upload != 5 {
+		t.Fatalf("usage after restart = %+v, want %+v", got, want)
+	}
+	if _, err := userDialer(addr).Dial("tcp", echo); replyCode(err) != int(wire.RepRulesetDenied) {
+		t.Fatalf("err = %v, want a ruleset denied reply", err)
+	}
+}
+
+func TestAccountingNullFile(t *testing.T) {
+	echo := startEcho(t)
+	file := filepath.Join(t.TempDir(), "usage.json")
+	if err := os.WriteFile(file, []byte("null"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s, addr := startServer(t, ListenerConfig{}, WithAccounting(AccountingConfig{File: file}))
+	conn, err := (&Dialer{ProxyAddr: addr}).Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoThrough(t, conn, "hello")
+	conn.Close()
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if u := s.Usage()["127.0.0.1"]; u.Upload != 5 {
+		t.Errorf("usage = %+v, want 5 bytes uploaded", u)
+	}
+}
+
+func TestAccountingHandover(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "usage.json")
+	newAccounting := func() *accounting {
+		a := &accounting{cfg: AccountingConfig{File: file}, usage: make(map[string]*Usage)}
+		if err := a.load(); err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+	saved := func() map[string]Usage {
+		t.Helper()
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var usage map[string]Usage
+		if err := json.Unmarshal(data, &usage); err != nil {
+			t.Fatal(err)
+		}
+		return usage
+	}
+
+	old := newAccounting()
+	old.open("alice").add(100, true)
+	if err := old.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The new process loads the file, the old one keeps counting its
+	// draining connections without writing it
+	old.handOver()
+	child := newAccounting()
+	old.open("alice").add(50, false)
+	old.open("bob").add(7, true)
+	child.open("alice").add(10, true)
+	if err := child.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := old.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if u := saved()["alice"]; u.Upload != 110 || u.Download != 0 {
+		t.Fatalf("saved %+v, want the new process's counters", u)
+	}
+
+	// On exit the old process leaves what the file is missing
+	if err := old.close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := child.flush(); err != nil {
+		t.Fatal(err)
+	}
+	usage := saved()
+	if u := usage["alice"]; u.Upload != 110 || u.Download != 50 || u.DayBytes != 160 || u.MonthBytes != 160 {
+		t.Errorf("alice = %+v, want 110 up, 50 down", u)
+	}
+	if u := usage["bob"]; u.Upload != 7 || u.DayBytes != 7 {
+		t.Errorf("bob = %+v, want 7 up", u)
+	}
+	if names, _ := filepath.Glob(file + ".handover-*"); len(names) != 0 {
+		t.Errorf("handover files left: %v", names)
+	}
+
+	// Merged once only
+	if u := newAccounting().usage["alice"]; u.Upload != 110 || u.Download != 50 {
+		t.Errorf("alice after restart = %+v", u)
+	}
+}
@@ -0,0 +1,113 @@
+package socks5
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ParseCIDRs parses a list of CIDRs; bare IPs are treated as single hosts
+func ParseCIDRs(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, item := range list {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address: %s", item)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr: %s", item)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// containsIP reports whether ip falls into one of nets
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// addrIP extracts the IP of a net.Addr, nil for unix sockets
+func addrIP(addr net.Addr) net.IP {
+	if addr == nil {
+		return nil
+	}
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// matchHost reports whether host matches one of the patterns. A pattern is
+// an exact host name, "*.example.com" for any subdomain, a CIDR or an IP.
+func matchHost(patterns []string, host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	ip := net.ParseIP(host)
+	for _, p := range patterns {
+		p = strings.ToLower(strings.TrimSpace(p))
+		switch {
+		case p == "":
+		case p == "*":
+			return true
+		case strings.Contains(p, "/"):
+			if _, n, err := net.ParseCIDR(p); err == nil && ip != nil && n.Contains(ip) {
+				return true
+			}
+		case strings.HasPrefix(p, "*."):
+			if strings.HasSuffix(host, p[1:]) {
+				return true
+			}
+		default:
+			if host == p || (ip != nil && ip.Equal(net.ParseIP(p))) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sourceAllowed checks the client address against the profile ACL
+func (p *Profile) sourceAllowed(addr net.Addr) bool {
+	if len(p.AllowSources) == 0 {
+		return true
+	}
+	ip := addrIP(addr)
+	if ip == nil {
+		// Unix socket clients are local
+		return addr == nil || addr.Network() == "unix"
+	}
+	return containsIP(p.AllowSources, ip)
+}
+
+// destinationAllowed checks the requested host against the profile ACL
+func (p *Profile) destinationAllowed(host string) bool {
+	if matchHost(p.DenyDestinations, host) {
+		return false
+	}
+	return len(p.AllowDestinations) == 0 || matchHost(p.AllowDestinations, host)
+}
@@ -0,0 +1,347 @@
+package socks5
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SessionInfo describes a connection being served
+type SessionInfo struct {
+	ID         uint64    `json:"id"`
+	Listener   string    `json:"listener"`
+	ClientAddr string    `json:"client,omitempty"`
+	Identity   string    `json:"user,omitempty"`
+	Requested  string    `json:"request,omitempty"`  // 客户端请求的目标
+	Target     string    `json:"target,omitempty"`   // 实际连接的目标
+	Resolved   string    `json:"resolved,omitempty"` // 直连时目标的 IP
+	Upstream   string    `json:"upstream,omitempty"` // direct 或代理地址，连接目标后才有
+	Upload     int64     `json:"upload"`
+	Download   int64     `json:"download"`
+	Start      time.Time `json:"start"`
+}
+
+// Matches reports whether the session is of user and to dest. An empty
+// argument matches any; dest without a port matches any port of the host.
+func (si SessionInfo) Matches(user, dest string) bool {
+	if user != "" && si.Identity != user {
+		return false
+	}
+	if dest == "" {
+		return true
+	}
+	for _, target := range []string{si.Requested, si.Target} {
+		if target == dest {
+			return true
+		}
+		if host, _, err := net.SplitHostPort(target); err == nil && host == strings.Trim(dest, "[]") {
+			return true
+		}
+	}
+	return false
+}
+
+func (sess *session) info() SessionInfo {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	var client string
+	if addr := sess.clientAddr(); addr != nil {
+		client = addr.String()
+	}
+	return SessionInfo{
+		ID:         sess.id,
+		Listener:   sess.listenerName(),
+		ClientAddr: client,
+		Identity:   sess.identity,
+		Requested:  sess.request,
+		Target:     sess.target,
+		Resolved:   sess.resolved,
+		Upstream:   sess.upstream,
+		Upload:     sess.upload.Load(),
+		Download:   sess.download.Load(),
+		Start:      sess.start,
+	}
+}
+
+// Sessions returns the connections being served, oldest first
+func (s *Server) Sessions() []SessionInfo {
+	s.mu.Lock()
+	sessions := make([]*session, 0, len(s.sessions))
+	for _, sess := range s.sessions {
+		sessions = append(sessions, sess)
+	}
+	s.mu.Unlock()
+	infos := make([]SessionInfo, 0, len(sessions))
+	for _, sess := range sessions {
+		infos = append(infos, sess.info())
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+// CloseSession closes the connection with the given ID. It reports false
+// when there is no such connection.
+func (s *Server) CloseSession(id uint64) bool {
+	s.mu.Lock()
+	sess := s.sessions[id]
+	s.mu.Unlock()
+	if sess == nil {
+		return false
+	}
+	// sess.log belongs to the connection's goroutine
+	s.logger.Info("Closing connection on request", "conn", id)
+	sess.kill()
+	return true
+}
+
+// CloseSessions closes the connections match returns true for and returns
+// how many were closed
+func (s *Server) CloseSessions(match func(SessionInfo) bool) int {
+	n := 0
+	for _, info := range s.Sessions() {
+		if match(info) && s.CloseSession(info.ID) {
+			n++
+		}
+	}
+	return n
+}
+
+// AdminConfig configures the admin API
+type AdminConfig struct {
+	Token  string       // 请求需带 Authorization: Bearer <Token>，为空时不校验，只应用于 unix socket
+	Reload func() error // POST /reload 时调用，为空时该接口返回 501
+	// POST /upgrade 时调用，返回新进程的 pid，为空时该接口返回 501
+	Upgrade func() (int, error)
+	// /events 每个客户端缓冲的事件数，客户端跟不上时丢弃，默认 256
+	EventBuffer int
+}
+
+// AdminHandler returns the admin HTTP/JSON API:
+//
+//	GET    /sessions?user=&dest=        list connections
+//	DELETE /sessions/{id}               close a connection
+//	POST   /sessions/close?user=&dest=  close the matching connections
+//	POST   /reload                      reload configuration and credentials
+//	POST   /upgrade                     hand the listeners to a new process
+//	GET    /proxy                       system and downstream proxy in use
+//	GET    /stats                       aggregate counters
+//	GET    /events?type=                Server-Sent Events of Subscribe
+//
+// It is not bound to any address; serve it on loopback or a unix socket.
+func (s *Server) AdminHandler(cfg AdminConfig) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /sessions", func(w http.ResponseWriter, r *http.Request) {
+		user, dest := r.URL.Query().Get("user"), r.URL.Query().Get("dest")
+		sessions := []SessionInfo{}
+		for _, info := range s.Sessions() {
+			if info.Matches(user, dest) {
+				sessions = append(sessions, info)
+			}
+		}
+		writeJSON(w, http.StatusOK, sessions)
+	})
+	mux.HandleFunc("DELETE /sessions/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid session id")
+			return
+		}
+		if !s.CloseSession(id) {
+			writeError(w, http.StatusNotFound, "no such session")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]int{"closed": 1})
+	})
+	mux.HandleFunc("POST /sessions/close", func(w http.ResponseWriter, r *http.Request) {
+		user, dest := r.URL.Query().Get("user"), r.URL.Query().Get("dest")
+		if user == "" && dest == "" {
+			writeError(w, http.StatusBadRequest, "user or dest is required")
+			return
+		}
+		n := s.CloseSessions(func(info SessionInfo) bool { return info.Matches(user, dest) })
+		writeJSON(w, http.StatusOK, map[string]int{"closed": n})
+	})
+	mux.HandleFunc("POST /reload", func(w http.ResponseWriter, r *http.Request) {
+		if cfg.Reload == nil {
+			writeError(w, http.StatusNotImplemented, "reload is not configured")
+			return
+		}
+		if err := cfg.Reload(); err != nil {
+			s.logger.Error("Failed to reload", "err", err)
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "reloaded"})
+	})
+	mux.HandleFunc("POST /upgrade", func(w http.ResponseWriter, r *http.Request) {
+		if cfg.Upgrade == nil {
+			writeError(w, http.StatusNotImplemented, "upgrade is not configured")
+			return
+		}
+		pid, err := cfg.Upgrade()
+		if err != nil {
+			s.logger.Error("Upgrade failed", "err", err)
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"status": "upgraded", "pid": pid})
+	})
+	mux.HandleFunc("GET /proxy", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.proxyStatus())
+	})
+	mux.HandleFunc("GET /stats", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.Stats())
+	})
+	mux.HandleFunc("GET /events", func(w http.ResponseWriter, r *http.Request) {
+		s.serveEvents(w, r, cfg.EventBuffer)
+	})
+	return requireToken(cfg.Token, mux)
+}
+
+// requireToken rejects requests without the bearer token
+func requireToken(token string, next http.Handler) http.Handler {
+	if token == "" {
+		return next
+	}
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type proxyInfoJSON struct {
+	Enabled bool   `json:"enabled"`
+	Type    string `json:"type,omitempty"`
+	Addr    string `json:"addr,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+type listenerProxyJSON struct {
+	Listener    string        `json:"listener"`
+	SystemProxy bool          `json:"system_proxy"` // 未配置下游代理时使用系统代理
+	DownProxy   proxyInfoJSON `json:"down_proxy"`
+	Routes      int           `json:"routes"`
+}
+
+// proxyStatus reports the current system proxy and the downstream proxy of
+// each listener, with passwords hidden
+func (s *Server) proxyStatus() any {
+	var system proxyInfoJSON
+	if info, err := GetSystemProxy(); err != nil {
+		system.Error = err.Error()
+	} else if info.Enabled {
+		system = proxyInfoJSON{Enabled: true, Type: info.ProxyType, Addr: redactURL(info.Addr)}
+	}
+
+	s.mu.Lock()
+	listeners := s.listeners
+	s.mu.Unlock()
+	status := []listenerProxyJSON{}
+	for _, l := range listeners {
+		state := l.current()
+		lp := listenerProxyJSON{
+			Listener:    l.String(),
+			SystemProxy: state.profile.SystemProxy,
+			Routes:      len(state.profile.Routes),
+		}
+		if state.profile.DownProxy != "" {
+			lp.DownProxy = proxyInfoJSON{
+				Enabled: state.downProxy.Enabled,
+				Type:    state.downProxy.ProxyType,
+				Addr:    redactURL(state.downProxy.Addr),
+			}
+		}
+		status = append(status, lp)
+	}
+	return map[string]any{"system": system, "listeners": status}
+}
+
+// sseHeartbeat keeps idle event streams from being cut by proxies
+const sseHeartbeat = 15 * time.Second
+
+// serveEvents streams events as Server-Sent Events, optionally only the
+// types listed in ?type=. Events the client is too slow for are dropped
+// and reported with a "dropped" event carrying the running count.
+func (s *Server) serveEvents(w http.ResponseWriter, r *http.Request, buffer int) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming is not supported")
+		return
+	}
+	var types map[EventType]bool
+	if v := r.URL.Query().Get("type"); v != "" {
+		types = make(map[EventType]bool)
+		for _, t := range strings.Split(v, ",") {
+			types[EventType(t)] = true
+		}
+	}
+	sub := s.Subscribe(buffer)
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+	var dropped uint64
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := io.WriteString(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		case ev, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			if n := sub.Dropped(); n != dropped {
+				dropped = n
+				if err := writeEvent(w, "dropped", map[string]uint64{"dropped": n}); err != nil {
+					return
+				}
+			}
+			if types != nil && !types[ev.Type] {
+				continue
+			}
+			if err := writeEvent(w, string(ev.Type), ev); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+func writeEvent(w io.Writer, name string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, data)
+	return err
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, map[string]string{"error": msg})
+}
@@ -0,0 +1,285 @@
+package socks5
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// adminRequest sends a request to the admin API, with the token when it is
+// not empty, and decodes the JSON reply into v
+func adminRequest(t *testing.T, url, method, path, token string, v any) int {
+	t.Helper()
+	req, err := http.NewRequest(method, url+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if v != nil && resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestAdminToken(t *testing.T) {
+	s, _ := startServer(t, ListenerConfig{})
+	admin := httptest.NewServer(s.AdminHandler(AdminConfig{Token: "s3cret"}))
+	defer admin.Close()
+
+	for _, token := range []string{"", "wrong", "s3cre"} {
+		req, _ := http.NewRequest(http.MethodGet, admin.URL+"/stats", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("WWW-Authenticate") != "Bearer" {
+			t.Errorf("token %q: status %d, WWW-Authenticate %q; want 401 with a bearer challenge",
+				token, resp.StatusCode, resp.Header.Get("WWW-Authenticate"))
+		}
+	}
+	// The token is checked before routing, so unknown paths do not leak
+	if code := adminRequest(t, admin.URL, http.MethodPost, "/nothing", "", nil); code != http.StatusUnauthorized {
+		t.Errorf("unknown path without a token: status %d, want 401", code)
+	}
+	var stats Stats
+	if code := adminRequest(t, admin.URL, http.MethodGet, "/stats", "s3cret", &stats); code != http.StatusOK {
+		t.Errorf("with the token: status %d, want 200", code)
+	}
+
+	// Without a token the API is open
+	open := httptest.NewServer(s.AdminHandler(AdminConfig{}))
+	defer open.Close()
+	if code := adminRequest(t, open.URL, http.MethodGet, "/stats", "", &stats); code != http.StatusOK {
+		t.Errorf("without a configured token: status %d, want 200", code)
+	}
+}
+
+func TestAdminCloseSession(t *testing.T) {
+	echo := startEcho(t)
+	hook, closed := closeHook()
+	s, addr := startServer(t, ListenerConfig{Profile: &Profile{Username: "user", Password: "secret"}}, hook)
+	admin := httptest.NewServer(s.AdminHandler(AdminConfig{Token: "s3cret"}))
+	defer admin.Close()
+	const token = "s3cret"
+
+	conn, err := userDialer(addr).Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	echoThrough(t, conn, "hello")
+
+	var sessions []SessionInfo
+	adminRequest(t, admin.URL, http.MethodGet, "/sessions?user=user", token, &sessions)
+	if len(sessions) != 1 || sessions[0].Identity != "user" || sessions[0].Requested != echo {
+		t.Fatalf("sessions = %+v, want one of user to %s", sessions, echo)
+	}
+	adminRequest(t, admin.URL, http.MethodGet, "/sessions?user=other", token, &sessions)
+	if len(sessions) != 0 {
+		t.Errorf("sessions of other = %+v, want none", sessions)
+	}
+
+	id := strconv.FormatUint(s.Sessions()[0].ID, 10)
+	var closedN map[string]int
+	if code := adminRequest(t, admin.URL, http.MethodDelete, "/sessions/"+id, "", nil); code != http.StatusUnauthorized {
+		t.Errorf("DELETE without a token: status %d, want 401", code)
+	}
+	if code := adminRequest(t, admin.URL, http.MethodDelete, "/sessions/"+id, token, &closedN); code != http.StatusOK || closedN["closed"] != 1 {
+		t.Fatalf("DELETE: status %d, %v; want one closed", code, closedN)
+	}
+	if stats := nextClose(t, closed); stats.Reason != CloseKilled || stats.Identity != "user" {
+		t.Errorf("reason = %s of %q, want %s of user", stats.Reason, stats.Identity, CloseKilled)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadAll(conn); errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("client connection still open: %v", err)
+	}
+	if code := adminRequest(t, admin.URL, http.MethodDelete, "/sessions/"+id, token, nil); code != http.StatusNotFound {
+		t.Errorf("DELETE of a closed session: status %d, want 404", code)
+	}
+	if code := adminRequest(t, admin.URL, http.MethodDelete, "/sessions/x", token, nil); code != http.StatusBadRequest {
+		t.Errorf("DELETE of an invalid id: status %d, want 400", code)
+	}
+
+	// Closing by user and destination
+	if code := adminRequest(t, admin.URL, http.MethodPost, "/sessions/close", token, nil); code != http.StatusBadRequest {
+		t.Errorf("close without a filter: status %d, want 400", code)
+	}
+	conn, err = userDialer(addr).Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	echoThrough(t, conn, "hello")
+	if code := adminRequest(t, admin.URL, http.MethodPost, "/sessions/close?user=user&dest=127.0.0.1", token, &closedN); code != http.StatusOK || closedN["closed"] != 1 {
+		t.Fatalf("close: status %d, %v; want one closed", code, closedN)
+	}
+	if stats := nextClose(t, closed); stats.Reason != CloseKilled {
+		t.Errorf("reason = %s, want %s", stats.Reason, CloseKilled)
+	}
+}
+
+// readEvent returns the name and data of the next Server-Sent Event,
+// skipping comments
+func readEvent(t *testing.T, r *bufio.Reader) (string, string) {
+	t.Helper()
+	var name, data string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading events: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && name != "":
+			return name, data
+		case strings.HasPrefix(line, "event: "):
+			name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func TestAdminEvents(t *testing.T) {
+	echo := startEcho(t)
+	s, addr := startServer(t, ListenerConfig{})
+	admin := httptest.NewServer(s.AdminHandler(AdminConfig{Token: "s3cret"}))
+	defer admin.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, admin.URL+"/events?type=dial_failed,closed", nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); resp.StatusCode != http.StatusOK || ct != "text/event-stream" {
+		t.Fatalf("status %d, content type %q; want an event stream", resp.StatusCode, ct)
+	}
+
+	conn, err := (&Dialer{ProxyAddr: addr}).Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoThrough(t, conn, "hello")
+	conn.Close()
+	if _, err := (&Dialer{ProxyAddr: addr}).Dial("tcp", "refused.test:80"); err == nil {
+		t.Fatal("connected to refused.test")
+	}
+
+	// Only the requested types are streamed
+	r := bufio.NewReader(resp.Body)
+	for _, want := range []EventType{EventClosed, EventDialFailed, EventClosed} {
+		name, data := readEvent(t, r)
+		var ev Event
+		if err := json.Unmarshal([]byte(data), &ev); err != nil {
+			t.Fatal(err)
+		}
+		if name != string(want) || ev.Type != want {
+			t.Fatalf("event %s (%s), want %s", name, data, want)
+		}
+		if want == EventClosed && ev.Target == echo && (ev.Reason != CloseClientClosed || ev.Upload != 5) {
+			t.Errorf("closed event = %s", data)
+		}
+	}
+}
+
+// blockedStream is a ResponseWriter whose first write blocks until
+// released, then passes the stream on to a pipe
+type blockedStream struct {
+	header  http.Header
+	w       *io.PipeWriter
+	once    sync.Once
+	blocked chan struct{}
+	release chan struct{}
+}
+
+func (b *blockedStream) Header() http.Header { return b.header }
+func (b *blockedStream) WriteHeader(int)     {}
+func (b *blockedStream) Flush()              {}
+
+func (b *blockedStream) Write(p []byte) (int, error) {
+	b.once.Do(func() { close(b.blocked) })
+	<-b.release
+	return b.w.Write(p)
+}
+
+func TestAdminEventsDropped(t *testing.T) {
+	echo := startEcho(t)
+	hook, closed := closeHook()
+	s, addr := startServer(t, ListenerConfig{}, hook)
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	w := &blockedStream{header: http.Header{}, w: pw, blocked: make(chan struct{}), release: make(chan struct{})}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req := httptest.NewRequest(http.MethodGet, "/events", nil).WithContext(ctx)
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		s.AdminHandler(AdminConfig{EventBuffer: 1}).ServeHTTP(w, req)
+	}()
+	for s.events.active.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The stream is stuck on the first event: one more fits, the rest of
+	// the connection's five are dropped
+	tunnel(t, &Dialer{ProxyAddr: addr}, echo).Close()
+	nextClose(t, closed)
+	<-w.blocked
+	close(w.release)
+
+	// The count is reported before the next event
+	tunnel(t, &Dialer{ProxyAddr: addr}, echo).Close()
+	r := bufio.NewReader(pr)
+	for {
+		name, data := readEvent(t, r)
+		if name != "dropped" {
+			continue
+		}
+		var v map[string]uint64
+		if err := json.Unmarshal([]byte(data), &v); err != nil {
+			t.Fatal(err)
+		}
+		if v["dropped"] < 3 {
+			t.Errorf("dropped = %d, want at least 3", v["dropped"])
+		}
+		break
+	}
+
+	pr.Close()
+	cancel()
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("event stream did not end")
+	}
+	if n := s.events.active.Load(); n != 0 {
+		t.Errorf("%d subscriptions left", n)
+	}
+}
@@ -0,0 +1,378 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dcsunny/socks5/wire"
+	"golang.org/x/net/proxy"
+)
+
+// Dialer is a SOCKS5 client. It implements proxy.ContextDialer for CONNECT
+// and also supports BIND and UDP ASSOCIATE.
+type Dialer struct {
+	ProxyAddr      string              // SOCKS5 服务器地址 host:port
+	Username       string              // 用户名，为空时只协商无认证
+	Password       string              // 密码
+	ResolveLocally bool                // 在本地解析目标域名，否则把域名交给服务器解析
+	Forward        proxy.ContextDialer // 用于连接 SOCKS5 服务器，默认直连
+}
+
+var _ proxy.ContextDialer = (*Dialer)(nil)
+
+// NewDialer creates a Dialer from a socks5:// or socks5h:// URL. socks5h
+// lets the server resolve domain names, socks5 resolves them locally.
+func NewDialer(u *url.URL) (*Dialer, error) {
+	d := &Dialer{ProxyAddr: u.Host}
+	switch u.Scheme {
+	case "socks5":
+		d.ResolveLocally = true
+	case "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q for a SOCKS5 proxy", u.Scheme)
+	}
+	if u.Port() == "" {
+		d.ProxyAddr = net.JoinHostPort(u.Hostname(), "1080")
+	}
+	if u.User != nil {
+		d.Username = u.User.Username()
+		d.Password, _ = u.User.Password()
+	}
+	return d, nil
+}
+
+// ReplyError is returned when the server refuses a request
+type ReplyError struct {
+	Code byte // wire.Rep* 回复码
+}
+
+func (e *ReplyError) Error() string {
+	return "socks5: " + wire.ReplyText(e.Code)
+}
+
+// Addr is an address reported by the server, which may be a domain name
+type Addr struct {
+	wire.AddrSpec
+	Net string
+}
+
+func (a *Addr) Network() string {
+	return a.Net
+}
+
+// netAddr returns a *net.TCPAddr or *net.UDPAddr for IP addresses
+func netAddr(network string, a wire.AddrSpec) net.Addr {
+	if a.FQDN != "" {
+		return &Addr{AddrSpec: a, Net: network}
+	}
+	if network == "udp" {
+		return &net.UDPAddr{IP: a.IP, Port: a.Port}
+	}
+	return &net.TCPAddr{IP: a.IP, Port: a.Port}
+}
+
+// Conn is a connection established through a SOCKS5 server
+type Conn struct {
+	net.Conn
+	bound net.Addr
+}
+
+// BoundAddr returns the address the server connected from. For a connection
+// accepted with BIND it is the address of the peer.
+func (c *Conn) BoundAddr() net.Addr {
+	return c.bound
+}
+
+// NetConn returns the connection to the server
+func (c *Conn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to addr with a CONNECT request
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("socks5: unsupported network %q", network)
+	}
+	conn, bound, err := d.request(ctx, wire.CmdConnect, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{Conn: conn, bound: netAddr("tcp", bound)}, nil
+}
+
+// Bind asks the server to accept a single connection from addr. The
+// returned listener's Addr is where the peer has to connect to.
+func (d *Dialer) Bind(ctx context.Context, addr string) (*BindListener, error) {
+	conn, bound, err := d.request(ctx, wire.CmdBind, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &BindListener{conn: conn, addr: netAddr("tcp", bound)}, nil
+}
+
+// BindListener waits for the connection of a BIND request
+type BindListener struct {
+	conn     net.Conn
+	addr     net.Addr
+	mu       sync.Mutex
+	accepted bool
+}
+
+// Accept waits for the peer to connect. It can be called only once; the
+// server does not accept more than one connection.
+func (l *BindListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.accepted {
+		return nil, net.ErrClosed
+	}
+	l.accepted = true
+	var reply wire.Reply
+	if _, err := reply.ReadFrom(l.conn); err != nil {
+		l.conn.Close()
+		return nil, err
+	}
+	if reply.Code != wire.RepSucceeded {
+		l.conn.Close()
+		return nil, &ReplyError{Code: reply.Code}
+	}
+	return &Conn{Conn: l.conn, bound: netAddr("tcp", reply.Addr)}, nil
+}
+
+// Close aborts the BIND request unless the connection was accepted
+func (l *BindListener) Close() error {
+	if l.mu.TryLock() {
+		defer l.mu.Unlock()
+		if l.accepted {
+			return nil
+		}
+		l.accepted = true
+	}
+	return l.conn.Close()
+}
+
+func (l *BindListener) Addr() net.Addr {
+	return l.addr
+}
+
+// ListenPacket sends a UDP ASSOCIATE request. Datagrams written to the
+// returned PacketConn are relayed by the server; the association ends when
+// it is closed or the server closes the control connection.
+func (d *Dialer) ListenPacket(ctx context.Context) (net.PacketConn, error) {
+	ctrl, bound, err := d.request(ctx, wire.CmdUDPAssociate, "0.0.0.0:0")
+	if err != nil {
+		return nil, err
+	}
+	relay, err := d.relayAddr(ctx, ctrl, bound)
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	udp, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	c := &packetConn{UDPConn: udp, ctrl: ctrl, relay: relay, dialer: d}
+	go func() {
+		// The server keeps the control connection open as long as the
+		// association lasts
+		_, _ = io.Copy(io.Discard, ctrl)
+		c.Close()
+	}()
+	return c, nil
+}
+
+// relayAddr returns where datagrams go, the server's address when it
+// reports an unspecified one
+func (d *Dialer) relayAddr(ctx context.Context, ctrl net.Conn, bound wire.AddrSpec) (*net.UDPAddr, error) {
+	if bound.FQDN != "" {
+		ips, err := net.DefaultResolver.LookupIPAddr(ctx, bound.FQDN)
+		if err != nil {
+			return nil, err
+		}
+		return &net.UDPAddr{IP: ips[0].IP, Port: bound.Port}, nil
+	}
+	relay := &net.UDPAddr{IP: bound.IP, Port: bound.Port}
+	if relay.IP == nil || relay.IP.IsUnspecified() {
+		relay.IP = addrIP(ctrl.RemoteAddr())
+	}
+	return relay, nil
+}
+
+// packetConn relays datagrams through a UDP ASSOCIATE
+type packetConn struct {
+	*net.UDPConn
+	ctrl   net.Conn
+	relay  *net.UDPAddr
+	dialer *Dialer
+	once   sync.Once
+}
+
+// maxUDPHeader is the size of a UDP header with the longest domain name
+const maxUDPHeader = 3 + 1 + 1 + 255 + 2
+
+func (c *packetConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buf := make([]byte, len(b)+maxUDPHeader)
+	for {
+		n, from, err := c.UDPConn.ReadFromUDP(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		// Only the relay may send to us, and fragments are not supported
+		if !from.IP.Equal(c.relay.IP) || from.Port != c.relay.Port {
+			continue
+		}
+		header, payload, err := wire.ParseUDPDatagram(buf[:n])
+		if err != nil || header.Frag != 0 {
+			continue
+		}
+		return copy(b, payload), netAddr("udp", header.Addr), nil
+	}
+}
+
+func (c *packetConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	var spec wire.AddrSpec
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		spec = wire.AddrSpecOf(a)
+	case *Addr:
+		spec = a.AddrSpec
+	default:
+		var err error
+		if spec, err = wire.ParseAddrSpec(addr.String()); err != nil {
+			return 0, err
+		}
+	}
+	spec, err := c.dialer.resolve(context.Background(), spec)
+	if err != nil {
+		return 0, err
+	}
+	header := wire.UDPHeader{Addr: spec}
+	datagram, err := header.Datagram(b)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := c.UDPConn.WriteToUDP(datagram, c.relay); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *packetConn) Close() error {
+	var err error
+	c.once.Do(func() {
+		c.ctrl.Close()
+		err = c.UDPConn.Close()
+	})
+	return err
+}
+
+// resolve replaces a domain name with its first address when resolving locally
+func (d *Dialer) resolve(ctx context.Context, spec wire.AddrSpec) (wire.AddrSpec, error) {
+	if !d.ResolveLocally || spec.FQDN == "" {
+		return spec, nil
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, spec.FQDN)
+	if err != nil {
+		return spec, err
+	}
+	return wire.AddrSpec{IP: ips[0].IP, Port: spec.Port}, nil
+}
+
+// request connects to the server, authenticates and sends a request. It
+// returns the control connection and the bound address of the first reply.
+func (d *Dialer) request(ctx context.Context, cmd byte, addr string) (net.Conn, wire.AddrSpec, error) {
+	target, err := wire.ParseAddrSpec(addr)
+	if err != nil {
+		return nil, wire.AddrSpec{}, err
+	}
+	if target, err = d.resolve(ctx, target); err != nil {
+		return nil, wire.AddrSpec{}, err
+	}
+
+	forward := d.Forward
+	if forward == nil {
+		forward = &net.Dialer{}
+	}
+	conn, err := forward.DialContext(ctx, "tcp", d.ProxyAddr)
+	if err != nil {
+		return nil, wire.AddrSpec{}, err
+	}
+
+	// Abort the handshake when ctx is done
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Unix(1, 0))
+	})
+	bound, err := d.handshake(conn, &wire.Request{Command: cmd, Addr: target})
+	if !stop() {
+		conn.Close()
+		return nil, wire.AddrSpec{}, ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, wire.AddrSpec{}, err
+	}
+	return conn, bound, nil
+}
+
+func (d *Dialer) handshake(conn net.Conn, req *wire.Request) (wire.AddrSpec, error) {
+	greeting := wire.Greeting{Methods: []byte{wire.MethodNoAuth}}
+	if d.Username != "" {
+		greeting.Methods = append(greeting.Methods, wire.MethodUserPass)
+	}
+	if _, err := greeting.WriteTo(conn); err != nil {
+		return wire.AddrSpec{}, err
+	}
+	var selection wire.MethodSelection
+	if _, err := selection.ReadFrom(conn); err != nil {
+		return wire.AddrSpec{}, err
+	}
+	switch selection.Method {
+	case wire.MethodNoAuth:
+	case wire.MethodUserPass:
+		if d.Username == "" {
+			return wire.AddrSpec{}, errors.New("socks5: server selected username/password authentication that was not offered")
+		}
+		auth := wire.UserPassRequest{Username: d.Username, Password: d.Password}
+		if _, err := auth.WriteTo(conn); err != nil {
+			return wire.AddrSpec{}, err
+		}
+		var status wire.UserPassReply
+		if _, err := status.ReadFrom(conn); err != nil {
+			return wire.AddrSpec{}, err
+		}
+		if status.Status != wire.UserPassSucceeded {
+			return wire.AddrSpec{}, errors.New("socks5: authentication failed")
+		}
+	case wire.MethodNoAcceptable:
+		return wire.AddrSpec{}, errors.New("socks5: no acceptable authentication method")
+	default:
+		return wire.AddrSpec{}, errors.New("socks5: server selected unsupported method " + strconv.Itoa(int(selection.Method)))
+	}
+
+	if _, err := req.WriteTo(conn); err != nil {
+		return wire.AddrSpec{}, err
+	}
+	var reply wire.Reply
+	if _, err := reply.ReadFrom(conn); err != nil {
+		return wire.AddrSpec{}, err
+	}
+	if reply.Code != wire.RepSucceeded {
+		return wire.AddrSpec{}, &ReplyError{Code: reply.Code}
+	}
+	return reply.Addr, nil
+}
@@ -0,0 +1,185 @@
+package socks5
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dcsunny/socks5/wire"
+)
+
+// bindHandler accepts one connection for a BIND request and relays it
+func bindHandler(ctx context.Context, conn net.Conn, req *Request) error {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		_ = writeReply(conn, wire.RepGeneralFailure, nil)
+		return err
+	}
+	defer ln.Close()
+	if err := writeReply(conn, wire.RepSucceeded, ln.Addr()); err != nil {
+		return err
+	}
+	peer, err := ln.Accept()
+	if err != nil {
+		return err
+	}
+	defer peer.Close()
+	if err := writeReply(conn, wire.RepSucceeded, peer.RemoteAddr()); err != nil {
+		return err
+	}
+	go func() {
+		_, _ = io.Copy(peer, conn)
+		peer.Close()
+	}()
+	_, err = io.Copy(conn, peer)
+	return err
+}
+
+// udpHandler relays datagrams for a UDP ASSOCIATE request until the client
+// closes the control connection
+func udpHandler(ctx context.Context, conn net.Conn, req *Request) error {
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		_ = writeReply(conn, wire.RepGeneralFailure, nil)
+		return err
+	}
+	defer relay.Close()
+	if err := writeReply(conn, wire.RepSucceeded, relay.LocalAddr()); err != nil {
+		return err
+	}
+	go func() {
+		var client *net.UDPAddr
+		buf := make([]byte, 64<<10)
+		for {
+			n, from, err := relay.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if client == nil || from.Port == client.Port {
+				// From the client: send the payload on
+				client = from
+				header, payload, err := wire.ParseUDPDatagram(buf[:n])
+				if err != nil {
+					continue
+				}
+				dst, err := net.ResolveUDPAddr("udp", header.Addr.String())
+				if err == nil {
+					_, _ = relay.WriteToUDP(payload, dst)
+				}
+				continue
+			}
+			// From a target: wrap it for the client
+			header := wire.UDPHeader{Addr: wire.AddrSpecOf(from)}
+			if datagram, err := header.Datagram(buf[:n]); err == nil {
+				_, _ = relay.WriteToUDP(datagram, client)
+			}
+		}
+	}()
+	_, err = io.Copy(io.Discard, conn)
+	return err
+}
+
+// startUDPEcho runs a UDP server that sends datagrams back
+func startUDPEcho(t *testing.T) *net.UDPAddr {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 64<<10)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			_, _ = conn.WriteToUDP(buf[:n], from)
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+func TestClientBind(t *testing.T) {
+	_, addr := startServer(t, ListenerConfig{}, WithCommandHandler(wire.CmdBind, CommandHandlerFunc(bindHandler)))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ln, err := (&Dialer{ProxyAddr: addr}).Bind(ctx, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	peer, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got := conn.(*Conn).BoundAddr().String(); got != peer.LocalAddr().String() {
+		t.Errorf("BoundAddr = %s, want the peer %s", got, peer.LocalAddr())
+	}
+	if _, err := ln.Accept(); err == nil {
+		t.Error("second Accept succeeded")
+	}
+
+	_, _ = io.WriteString(peer, "hello")
+	buf := make([]byte, 5)
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("read %q, %v; want hello", buf, err)
+	}
+	_, _ = io.WriteString(conn, "world")
+	_ = peer.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(peer, buf); err != nil || string(buf) != "world" {
+		t.Fatalf("peer read %q, %v; want world", buf, err)
+	}
+}
+
+func TestClientUDPAssociate(t *testing.T) {
+	echo := startUDPEcho(t)
+	_, addr := startServer(t, ListenerConfig{}, WithCommandHandler(wire.CmdUDPAssociate, CommandHandlerFunc(udpHandler)))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	pc, err := (&Dialer{ProxyAddr: addr}).ListenPacket(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	_ = pc.SetDeadline(time.Now().Add(5 * time.Second))
+	for _, msg := range []string{"ping", "pong"} {
+		if _, err := pc.WriteTo([]byte(msg), echo); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 16)
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != msg || from.String() != echo.String() {
+			t.Errorf("got %q from %v, want %q from %v", buf[:n], from, msg, echo)
+		}
+	}
+}
+
+func TestClientUnsupportedCommands(t *testing.T) {
+	_, addr := startServer(t, ListenerConfig{})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	d := &Dialer{ProxyAddr: addr}
+
+	// Without a handler the server has CONNECT only
+	if _, err := d.Bind(ctx, "127.0.0.1:0"); replyCode(err) != int(wire.RepCommandUnsupported) {
+		t.Errorf("Bind: %v, want command not supported", err)
+	}
+	if _, err := d.ListenPacket(ctx); replyCode(err) != int(wire.RepCommandUnsupported) {
+		t.Errorf("ListenPacket: %v, want command not supported", err)
+	}
+}
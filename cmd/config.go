@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/dcsunny/socks5"
+)
+
+// loadConfig builds the default listener config, with the default profile,
+// and the listener configs from the flags and the credentials file. It runs
+// again on reload.
+func loadConfig(specs []string) (socks5.ListenerConfig, []socks5.ListenerConfig, error) {
+	user, pass := username, password
+	if credentialsFile != "" {
+		var err error
+		if user, pass, err = readCredentials(credentialsFile); err != nil {
+			return socks5.ListenerConfig{}, nil, err
+		}
+	}
+	trusted, err := socks5.ParseCIDRs(trustedProxies)
+	if err != nil {
+		return socks5.ListenerConfig{}, nil, err
+	}
+	var routes []socks5.Route
+	for _, spec := range routeSpecs {
+		route, err := socks5.ParseRoute(spec)
+		if err != nil {
+			return socks5.ListenerConfig{}, nil, err
+		}
+		routes = append(routes, route)
+	}
+	defaults := socks5.ListenerConfig{
+		ProxyProtocol:  proxyProtocol,
+		TrustedProxies: trusted,
+		TLSCertFile:    tlsCert,
+		TLSKeyFile:     tlsKey,
+		ClientCAFile:   clientCA,
+		Profile: &socks5.Profile{
+			Username:    user,
+			Password:    pass,
+			SystemProxy: useSystemProxy,
+			DownProxy:   downProxy,
+			Routes:      routes,
+			FastOpen:    fastOpen,
+		},
+	}
+	var configs []socks5.ListenerConfig
+	for _, spec := range specs {
+		cfg, err := socks5.ParseListener(spec, defaults)
+		if err != nil {
+			return socks5.ListenerConfig{}, nil, err
+		}
+		configs = append(configs, cfg)
+	}
+	return defaults, configs, nil
+}
+
+// readCredentials reads a username:password line
+func readCredentials(path string) (string, string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", "", err
+	}
+	user, pass, ok := strings.Cut(strings.TrimSpace(string(data)), ":")
+	if !ok || user == "" || pass == "" {
+		return "", "", fmt.Errorf("%s: expected username:password", path)
+	}
+	return user, pass, nil
+}
@@ -1,19 +1,56 @@
 package main
 
 import (
-	"log"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/dcsunny/socks5"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/spf13/cobra"
 )
 
 var (
-	listenAddr     string
-	downProxy      string
-	useSystemProxy bool
-	username       string
-	password       string
+	listenAddrs     []string
+	downProxy       string
+	useSystemProxy  bool
+	username        string
+	password        string
+	tlsCert         string
+	tlsKey          string
+	clientCA        string
+	runUser         string
+	runGroup        string
+	pidFile         string
+	drainTimeout    time.Duration
+	proxyProtocol   bool
+	trustedProxies  []string
+	fastOpen        bool
+	routeSpecs      []string
+	limitGlobal     string
+	limitUser       string
+	limitConn       string
+	accountingFile  string
+	quotaDaily      string
+	quotaMonthly    string
+	accessLog       socks5.AccessLogConfig
+	accessLogSize   string
+	connLimits      socks5.ConnLimits
+	timeouts        socks5.Timeouts
+	logLevel        string
+	logFormat       string
+	metricsListen   string
+	otlpEndpoint    string
+	traceRatio      float64
+	credentialsFile string
+	adminListen     string
+	adminToken      string
 )
 
 // rootCmd represents the base command when called without any subcommands
@@ -21,12 +58,200 @@ var rootCmd = &cobra.Command{
 	Use:   "socks5",
 	Short: "A SOCKS5 proxy server",
 	Long:  `A SOCKS5 proxy server that can use a downstream proxy.`,
-	Run: func(cmd *cobra.Command, args []string) {
-		s := socks5.NewServer(useSystemProxy, listenAddr, downProxy, username, password)
-		s.Run()
+	RunE: func(cmd *cobra.Command, args []string) error {
+		logger, err := newLogger(logLevel, logFormat)
+		if err != nil {
+			return err
+		}
+		slog.SetDefault(logger)
+
+		// Sockets inherited from systemd socket activation or from a previous
+		// process during an upgrade. Named systemd sockets can be given their
+		// own profile with systemd://name listener specs.
+		activated, err := socks5.ActivationListeners()
+		if err != nil {
+			return err
+		}
+		specs := listenAddrs
+		if len(activated) > 0 && !cmd.Flags().Changed("listen") {
+			specs = nil
+		}
+
+		defaults, configs, err := loadConfig(specs)
+		if err != nil {
+			return err
+		}
+		// Inherited sockets without a spec get the TLS, PROXY protocol and
+		// profile flags too
+		opts := []socks5.Option{
+			socks5.WithLogger(logger),
+			socks5.WithInheritedListeners(activated),
+			socks5.WithDefaultListener(defaults),
+		}
+		for _, cfg := range configs {
+			opts = append(opts, socks5.WithListener(cfg))
+		}
+
+		var limits socks5.RateLimits
+		for _, l := range []struct {
+			spec  string
+			limit *socks5.RateLimit
+		}{{limitGlobal, &limits.Global}, {limitUser, &limits.PerUser}, {limitConn, &limits.PerConn}} {
+			if l.spec == "" {
+				continue
+			}
+			if *l.limit, err = socks5.ParseRateLimit(l.spec); err != nil {
+				return err
+			}
+		}
+		opts = append(opts, socks5.WithRateLimits(limits), socks5.WithConnLimits(connLimits), socks5.WithTimeouts(timeouts))
+
+		if accountingFile != "" || quotaDaily != "" || quotaMonthly != "" {
+			acct := socks5.AccountingConfig{File: accountingFile}
+			if acct.Quota.Daily, err = socks5.ParseSize(quotaDaily); err != nil {
+				return err
+			}
+			if acct.Quota.Monthly, err = socks5.ParseSize(quotaMonthly); err != nil {
+				return err
+			}
+			opts = append(opts, socks5.WithAccounting(acct))
+		}
+
+		if accessLog.File != "" {
+			if accessLog.MaxSize, err = socks5.ParseSize(accessLogSize); err != nil {
+				return err
+			}
+			opts = append(opts, socks5.WithAccessLog(accessLog))
+		}
+
+		var metricsReg *prometheus.Registry
+		if metricsListen != "" {
+			metricsReg = newMetricsRegistry()
+			opts = append(opts, socks5.WithMetrics(metricsReg))
+		}
+
+		if otlpEndpoint != "" {
+			tp, err := newTracerProvider(context.Background(), otlpEndpoint, traceRatio)
+			if err != nil {
+				return fmt.Errorf("failed to set up tracing: %v", err)
+			}
+			// Send the spans of the drained connections before exiting
+			defer func() {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				_ = tp.Shutdown(ctx)
+			}()
+			opts = append(opts, socks5.WithTracerProvider(tp))
+		}
+
+		if adminToken == "" {
+			adminToken = os.Getenv("SOCKS5_ADMIN_TOKEN")
+		}
+		if adminListen != "" && !strings.HasPrefix(adminListen, "unix://") && adminToken == "" {
+			return errors.New("--admin-token or SOCKS5_ADMIN_TOKEN is required for an admin API on TCP")
+		}
+
+		profile := defaults.Profile
+		if pidFile != "" {
+			opts = append(opts, socks5.WithPidFile(pidFile))
+		}
+		s := socks5.NewServer(useSystemProxy, "", downProxy, profile.Username, profile.Password, opts...)
+		if err := s.Start(); err != nil {
+			return err
+		}
+		if pidFile != "" {
+			// After an upgrade the previous process writes our pid once we
+			// are ready; the file may not be ours to write before
+			if !socks5.StartedByUpgrade() {
+				if err := socks5.WritePidFile(pidFile); err != nil {
+					s.Close()
+					return err
+				}
+				if err := socks5.ChownForUser(pidFile, runUser, runGroup); err != nil {
+					s.Close()
+					return fmt.Errorf("failed to chown pidfile: %v", err)
+				}
+			}
+			defer socks5.RemovePidFile(pidFile)
+		}
+		if err := socks5.DropPrivileges(runUser, runGroup); err != nil {
+			s.Close()
+			return fmt.Errorf("failed to drop privileges: %v", err)
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		go socks5.SdWatchdog(ctx)
+		go func() {
+			<-ctx.Done()
+			_, _ = socks5.SdNotify("STOPPING=1")
+			s.Close()
+		}()
+		reload := func() error {
+			defaults, configs, err := loadConfig(specs)
+			if err != nil {
+				return err
+			}
+			return s.Reload(defaults.Profile, configs)
+		}
+		go handleSignals(ctx, s, reload)
+		// The metrics and admin addresses are given up with the listeners,
+		// for the process that takes over after an upgrade
+		httpCtx, stopHTTP := context.WithCancel(ctx)
+		defer stopHTTP()
+		if metricsReg != nil {
+			go serveHTTP(httpCtx, "metrics", metricsListen, metricsHandler(metricsReg))
+		}
+		if adminListen != "" {
+			go serveHTTP(httpCtx, "admin API", loopbackDefault(adminListen), s.AdminHandler(socks5.AdminConfig{
+				Token:   adminToken,
+				Reload:  reload,
+				Upgrade: func() (int, error) { return upgrade(s) },
+			}))
+		}
+		_, _ = socks5.SdNotify("READY=1")
+		// The previous process stops accepting once we are ready
+		if err := socks5.NotifyUpgradeReady(); err != nil {
+			slog.Error("Failed to notify the previous process", "err", err)
+		}
+		s.Wait()
+		stopHTTP()
+
+		// Listeners are closed, either for shutdown or after handing them to a
+		// new process: let the established tunnels finish
+		drainCtx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+		defer cancel()
+		_ = s.Shutdown(drainCtx)
+		return nil
 	},
 }
 
+// newLogger builds the logger for --log-level and --log-format
+func newLogger(level, format string) (*slog.Logger, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q", level)
+	}
+	opts := &slog.HandlerOptions{Level: l}
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(os.Stderr, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts)), nil
+	}
+	return nil, fmt.Errorf("invalid log format %q, want text or json", format)
+}
+
+// upgrade hands the listeners to a new process and tells systemd about it
+func upgrade(s *socks5.Server) (int, error) {
+	pid, err := s.Upgrade()
+	if err != nil {
+		return 0, err
+	}
+	_, _ = socks5.SdNotify(fmt.Sprintf("MAINPID=%d", pid))
+	return pid, nil
+}
+
 func main() {
 	Execute()
 }
@@ -35,15 +260,54 @@ func main() {
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
 	if err := rootCmd.Execute(); err != nil {
-		log.Print(err)
+		slog.Error(err.Error())
 		os.Exit(1)
 	}
 }
 
 func init() {
-	rootCmd.Flags().StringVarP(&listenAddr, "listen", "l", "0.0.0.0:21080", "Address to listen on")
+	rootCmd.Flags().StringArrayVarP(&listenAddrs, "listen", "l", []string{"0.0.0.0:21080"}, "Address to listen on, repeatable: host:port, tcp://, tls:// or unix:// with per-listener options")
 	rootCmd.Flags().StringVarP(&downProxy, "down-proxy", "d", "", "Downstream proxy type (socks5, http)")
 	rootCmd.Flags().BoolVarP(&useSystemProxy, "system-proxy", "s", true, "use system proxy")
 	rootCmd.Flags().StringVarP(&username, "username", "u", "", "Username for authentication")
 	rootCmd.Flags().StringVarP(&password, "password", "p", "", "Password for authentication")
+	rootCmd.Flags().StringVar(&credentialsFile, "credentials-file", "", "File holding username:password, replaces --username and --password and is re-read on reload")
+	rootCmd.Flags().StringVar(&tlsCert, "tls-cert", "", "TLS certificate file, enables SOCKS5 over TLS")
+	rootCmd.Flags().StringVar(&tlsKey, "tls-key", "", "TLS private key file")
+	rootCmd.Flags().StringVar(&clientCA, "client-ca", "", "CA bundle for verifying client certificates, a verified certificate replaces username/password and is required without one")
+	rootCmd.Flags().StringArrayVar(&routeSpecs, "route", nil, "Route for matching destinations, repeatable: match=*.internal,10.0.0.0/8&upstream=direct|system|URL&proxy-protocol=1|2")
+	rootCmd.Flags().StringVar(&limitGlobal, "limit-global", "", "Bandwidth shared by all connections, upload:download[:burst] in bytes/s, e.g. 10M:50M")
+	rootCmd.Flags().StringVar(&limitUser, "limit-user", "", "Bandwidth per user, or per client IP without authentication, upload:download[:burst]")
+	rootCmd.Flags().StringVar(&limitConn, "limit-conn", "", "Bandwidth per connection, upload:download[:burst]")
+	rootCmd.Flags().DurationVar(&timeouts.Handshake, "handshake-timeout", 10*time.Second, "Time allowed for the TLS handshake, greeting, authentication and request")
+	rootCmd.Flags().DurationVar(&timeouts.Dial, "dial-timeout", 30*time.Second, "Time allowed to connect to the target or upstream proxy")
+	rootCmd.Flags().DurationVar(&timeouts.Idle, "idle-timeout", 0, "Close tunnels without traffic in either direction for this long, 0 disables")
+	rootCmd.Flags().DurationVar(&timeouts.Lifetime, "max-lifetime", 0, "Close tunnels older than this, 0 disables")
+	rootCmd.Flags().DurationVar(&timeouts.Linger, "linger-timeout", 30*time.Second, "How long the other direction may keep running after one side half-closed, 0 disables")
+	rootCmd.Flags().IntVar(&connLimits.MaxConns, "max-conns", 0, "Maximum concurrent connections, new ones are refused when reached")
+	rootCmd.Flags().IntVar(&connLimits.MaxConnsPerIP, "max-conns-per-ip", 0, "Maximum concurrent connections per client IP")
+	rootCmd.Flags().IntVar(&connLimits.MaxConnsPerUser, "max-conns-per-user", 0, "Maximum concurrent connections per authenticated user")
+	rootCmd.Flags().IntVar(&connLimits.ConnRatePerIP, "conn-rate-per-ip", 0, "Maximum new connections per second per client IP")
+	rootCmd.Flags().StringVar(&accountingFile, "accounting-file", "", "File to persist per-user traffic counters to")
+	rootCmd.Flags().StringVar(&quotaDaily, "quota-daily", "", "Daily traffic quota per user, upload and download combined, e.g. 10G")
+	rootCmd.Flags().StringVar(&quotaMonthly, "quota-monthly", "", "Monthly traffic quota per user, e.g. 200G")
+	rootCmd.Flags().StringVar(&accessLog.File, "access-log", "", "Write one line per finished connection to this file, - for stdout; reopened on SIGUSR1")
+	rootCmd.Flags().StringVar(&accessLog.Format, "access-log-format", "json", "Access log format: json, text or a Go template over socks5.ConnStats")
+	rootCmd.Flags().StringVar(&accessLogSize, "access-log-max-size", "", "Rotate the access log when it reaches this size, e.g. 100M")
+	rootCmd.Flags().DurationVar(&accessLog.RotateEvery, "access-log-rotate", 0, "Rotate the access log at this interval, e.g. 24h")
+	rootCmd.Flags().IntVar(&accessLog.MaxBackups, "access-log-max-backups", 0, "Number of rotated access logs to keep, 0 keeps all")
+	rootCmd.Flags().BoolVar(&proxyProtocol, "proxy-protocol", false, "Expect a PROXY protocol v1/v2 header on accepted connections")
+	rootCmd.Flags().BoolVar(&fastOpen, "fast-open", false, "Reply to CONNECT before the target is connected, failures then only close the connection")
+	rootCmd.Flags().StringSliceVar(&trustedProxies, "trusted-proxies", nil, "Peers allowed to send a PROXY protocol header (CIDRs), required with --proxy-protocol")
+	rootCmd.Flags().StringVar(&runUser, "user", "", "User to switch to after binding the listeners")
+	rootCmd.Flags().StringVar(&runGroup, "group", "", "Group to switch to after binding the listeners")
+	rootCmd.Flags().StringVar(&pidFile, "pidfile", "", "Write the process id to this file")
+	rootCmd.Flags().StringVar(&logLevel, "log-level", "info", "Log level: debug, info, warn or error")
+	rootCmd.Flags().StringVar(&logFormat, "log-format", "text", "Log format: text or json")
+	rootCmd.Flags().StringVar(&otlpEndpoint, "otlp-endpoint", "", "Export OpenTelemetry traces over OTLP/HTTP to this URL, e.g. http://localhost:4318")
+	rootCmd.Flags().Float64Var(&traceRatio, "trace-sample-ratio", 1, "Fraction of connections to trace")
+	rootCmd.Flags().StringVar(&adminListen, "admin-listen", "", "Serve the admin API on host:port (loopback when the host is empty) or unix:///path")
+	rootCmd.Flags().StringVar(&adminToken, "admin-token", "", "Bearer token for the admin API, required on TCP; also read from SOCKS5_ADMIN_TOKEN")
+	rootCmd.Flags().StringVar(&metricsListen, "metrics-listen", "", "Serve Prometheus metrics at http://ADDR/metrics, e.g. 127.0.0.1:9090 (:9090 binds all interfaces)")
+	rootCmd.Flags().DurationVar(&drainTimeout, "drain-timeout", 30*time.Second, "How long established connections may keep running after shutdown or upgrade")
 }
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// httpShutdownTimeout bounds the wait for requests in flight on shutdown
+const httpShutdownTimeout = 5 * time.Second
+
+// serveHTTP serves h on addr until ctx is done. addr is host:port or
+// unix:///path. During an upgrade the old process still holds a TCP
+// address, so binding is retried until it lets go.
+func serveHTTP(ctx context.Context, name, addr string, h http.Handler) {
+	srv := &http.Server{Handler: h, ReadHeaderTimeout: 10 * time.Second}
+
+	var ln net.Listener
+	for warned := false; ; warned = true {
+		var err error
+		if ln, err = listenHTTP(addr); err == nil {
+			break
+		}
+		if !warned {
+			slog.Warn("Failed to listen, retrying", "server", name, "addr", addr, "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+	slog.Info("Serving "+name, "addr", ln.Addr().String())
+	go func() {
+		<-ctx.Done()
+		// Let requests in flight finish, such as the POST /upgrade that
+		// stopped us, but not event streams
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+		srv.Close()
+	}()
+	if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("HTTP server failed", "server", name, "err", err)
+	}
+}
+
+func listenHTTP(addr string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(addr, "unix://"); ok {
+		// Take over the socket of a previous process; it must not remove
+		// the file when it closes its listener
+		if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			_ = os.Remove(path)
+		}
+		ln, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, err
+		}
+		ln.(*net.UnixListener).SetUnlinkOnClose(false)
+		if err := os.Chmod(path, 0o600); err != nil {
+			ln.Close()
+			return nil, err
+		}
+		return ln, nil
+	}
+	return net.Listen("tcp", addr)
+}
+
+// loopbackDefault binds addr to loopback when its host is empty, so that
+// the admin API is not exposed by accident
+func loopbackDefault(addr string) string {
+	if strings.HasPrefix(addr, ":") {
+		return "127.0.0.1" + addr
+	}
+	return addr
+}
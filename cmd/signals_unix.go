@@ -0,0 +1,43 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/dcsunny/socks5"
+)
+
+// handleSignals reloads the configuration on SIGHUP, reopens the access
+// log on SIGUSR1 and upgrades to a new binary on SIGUSR2
+func handleSignals(ctx context.Context, s *socks5.Server, reload func() error) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2)
+	defer signal.Stop(c)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case sig := <-c:
+			switch sig {
+			case syscall.SIGHUP:
+				if err := reload(); err != nil {
+					slog.Error("Failed to reload", "err", err)
+				}
+			case syscall.SIGUSR1:
+				if err := s.ReopenAccessLog(); err != nil {
+					slog.Error("Failed to reopen access log", "err", err)
+				}
+			default:
+				if _, err := upgrade(s); err != nil {
+					slog.Error("Upgrade failed", "err", err)
+				}
+			}
+		}
+	}
+}
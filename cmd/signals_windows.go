@@ -0,0 +1,13 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"context"
+
+	"github.com/dcsunny/socks5"
+)
+
+// handleSignals does nothing, Windows has no SIGHUP, SIGUSR1 or SIGUSR2
+func handleSignals(ctx context.Context, s *socks5.Server, reload func() error) {}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/dcsunny/socks5"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// startCollector stands in for an OTLP/HTTP collector and passes on the
+// spans it receives, with the service name of their resource
+func startCollector(t *testing.T) (string, <-chan *tracepb.Span, <-chan string) {
+	t.Helper()
+	spans := make(chan *tracepb.Span, 64)
+	services := make(chan string, 64)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" {
+			http.NotFound(w, r)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var req coltracepb.ExportTraceServiceRequest
+		if err := proto.Unmarshal(body, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				for _, span := range ss.Spans {
+					services <- attrValue(rs.Resource.Attributes, "service.name")
+					spans <- span
+				}
+			}
+		}
+		resp, _ := proto.Marshal(&coltracepb.ExportTraceServiceResponse{})
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		_, _ = w.Write(resp)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL, spans, services
+}
+
+// attrValue returns an attribute as a string, ints in decimal
+func attrValue(attrs []*commonpb.KeyValue, key string) string {
+	for _, kv := range attrs {
+		if kv.Key != key {
+			continue
+		}
+		if v, ok := kv.Value.Value.(*commonpb.AnyValue_IntValue); ok {
+			return strconv.FormatInt(v.IntValue, 10)
+		}
+		return kv.Value.GetStringValue()
+	}
+	return ""
+}
+
+func TestTracingExport(t *testing.T) {
+	endpoint, spans, services := startCollector(t)
+	tp, err := newTracerProvider(context.Background(), endpoint, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tp.Shutdown(context.Background())
+
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := socks5.NewServer(false, "", "", "", "",
+		socks5.WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))),
+		socks5.WithTracerProvider(tp),
+		socks5.WithListener(socks5.ListenerConfig{
+			Network:  "tcp",
+			Addr:     ln.Addr().String(),
+			Listener: ln,
+			Profile:  &socks5.Profile{Username: "user", Password: "secret"},
+		}))
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+
+	d := &socks5.Dialer{ProxyAddr: ln.Addr().String(), Username: "user", Password: "secret"}
+	conn, err := d.Dial("tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = io.WriteString(conn, "hello")
+	_, _ = io.ReadFull(conn, make([]byte, 5))
+	conn.Close()
+
+	// The connection span ends once the server is done with the connection
+	byName := make(map[string]*tracepb.Span)
+	for deadline := time.Now().Add(5 * time.Second); byName["socks5.connection"] == nil; {
+		if time.Now().After(deadline) {
+			t.Fatalf("spans %v, want the connection span", keys(byName))
+		}
+		time.Sleep(20 * time.Millisecond)
+		_ = tp.ForceFlush(context.Background())
+		for len(spans) > 0 {
+			span := <-spans
+			byName[span.Name] = span
+			if service := <-services; service != "socks5" {
+				t.Errorf("span %s from service %q, want socks5", span.Name, service)
+			}
+		}
+	}
+	accept, auth, dial := byName["socks5.connection"], byName["socks5.auth"], byName["socks5.dial"]
+	if accept == nil || auth == nil || dial == nil {
+		t.Fatalf("spans %v, want the connection, auth and dial spans", keys(byName))
+	}
+	if accept.Kind != tracepb.Span_SPAN_KIND_SERVER {
+		t.Errorf("connection span kind %v, want server", accept.Kind)
+	}
+	for _, child := range []*tracepb.Span{auth, dial, byName["socks5.forward"]} {
+		if child == nil {
+			continue
+		}
+		if string(child.TraceId) != string(accept.TraceId) || string(child.ParentSpanId) != string(accept.SpanId) {
+			t.Errorf("span %s is not a child of the connection span", child.Name)
+		}
+	}
+
+	want := []struct {
+		span       *tracepb.Span
+		key, value string
+	}{
+		{accept, "socks5.listener", "tcp://" + ln.Addr().String()},
+		{accept, "socks5.user", "user"},
+		{accept, "socks5.target", echo.Addr().String()},
+		{accept, "socks5.upstream", "direct"},
+		{accept, "socks5.close_reason", "client_closed"},
+		{accept, "socks5.upload_bytes", "5"},
+		{auth, "socks5.auth.method", "password"},
+		{dial, "socks5.target", echo.Addr().String()},
+		{dial, "socks5.upstream", "direct"},
+	}
+	for _, w := range want {
+		if got := attrValue(w.span.Attributes, w.key); got != w.value {
+			t.Errorf("%s %s = %q, want %q", w.span.Name, w.key, got, w.value)
+		}
+	}
+	if got := attrValue(accept.Attributes, "client.address"); got != conn.LocalAddr().String() {
+		t.Errorf("client.address = %q, want %s", got, conn.LocalAddr())
+	}
+}
+
+func keys(m map[string]*tracepb.Span) []string {
+	var names []string
+	for name := range m {
+		names = append(names, name)
+	}
+	return names
+}
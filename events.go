@@ -0,0 +1,181 @@
+package socks5
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EventType is the kind of a connection lifecycle event
+type EventType string
+
+const (
+	EventAccepted      EventType = "accepted"      // 接受了连接
+	EventAuthenticated EventType = "authenticated" // 认证通过，无需认证时也会发布
+	EventAuthFailed    EventType = "auth_failed"   // 认证失败或被 OnAuthenticated 拒绝
+	EventRouted        EventType = "routed"        // 请求通过了 ACL、钩子和限制，即将连接目标
+	EventConnected     EventType = "connected"     // 已连接目标
+	EventDialFailed    EventType = "dial_failed"   // 连接目标失败
+	EventClosed        EventType = "closed"        // 连接结束，带有 Stats
+)
+
+// Event is a step in the life of a connection. Fields not known yet at
+// that step are empty.
+type Event struct {
+	Type       EventType `json:"type"`
+	Time       time.Time `json:"time"`
+	ConnID     uint64    `json:"conn"`
+	Listener   string    `json:"listener"`
+	ClientAddr string    `json:"client,omitempty"`
+	Identity   string    `json:"user,omitempty"`
+	Target     string    `json:"target,omitempty"`
+	Upstream   string    `json:"upstream,omitempty"`
+	Error      string    `json:"error,omitempty"` // auth_failed 和 dial_failed 的原因
+
+	// Closed only
+	Reason     CloseReason `json:"reason,omitempty"`
+	Reply      *int        `json:"reply,omitempty"`
+	Upload     int64       `json:"upload,omitempty"`
+	Download   int64       `json:"download,omitempty"`
+	DurationMs int64       `json:"duration_ms,omitempty"`
+	Stats      *ConnStats  `json:"-"`
+}
+
+// Subscription receives events on C until it is closed. Events that do not
+// fit in its buffer are dropped, so a slow subscriber never holds up the
+// connections.
+type Subscription struct {
+	C <-chan Event
+
+	ch      chan Event
+	bus     *eventBus
+	dropped atomic.Uint64
+}
+
+// Dropped returns the number of events dropped because C was full
+func (sub *Subscription) Dropped() uint64 {
+	return sub.dropped.Load()
+}
+
+// Close stops the subscription and closes C
+func (sub *Subscription) Close() {
+	sub.bus.unsubscribe(sub)
+}
+
+// Subscribe returns a subscription to the events of all connections with
+// room for buffer events, 256 when buffer is not positive. C is closed by
+// Close and when Shutdown returns.
+func (s *Server) Subscribe(buffer int) *Subscription {
+	if buffer <= 0 {
+		buffer = 256
+	}
+	ch := make(chan Event, buffer)
+	sub := &Subscription{C: ch, ch: ch, bus: &s.events}
+	s.events.subscribe(sub)
+	return sub
+}
+
+// eventBus fans events out to the subscriptions
+type eventBus struct {
+	mu      sync.RWMutex
+	subs    map[*Subscription]struct{}
+	active  atomic.Int32 // 订阅数，没有订阅时不构造事件
+	dropped atomic.Uint64
+}
+
+func (b *eventBus) subscribe(sub *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subs == nil {
+		b.subs = make(map[*Subscription]struct{})
+	}
+	b.subs[sub] = struct{}{}
+	b.active.Store(int32(len(b.subs)))
+}
+
+func (b *eventBus) unsubscribe(sub *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subs[sub]; !ok {
+		return
+	}
+	delete(b.subs, sub)
+	close(sub.ch)
+	b.active.Store(int32(len(b.subs)))
+}
+
+// closeAll ends every subscription
+func (b *eventBus) closeAll() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for sub := range b.subs {
+		close(sub.ch)
+	}
+	b.subs = nil
+	b.active.Store(0)
+}
+
+func (b *eventBus) publish(ev Event) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for sub := range b.subs {
+		select {
+		case sub.ch <- ev:
+		default:
+			sub.dropped.Add(1)
+			b.dropped.Add(1)
+		}
+	}
+}
+
+// event publishes an event of sess. The fields are read by the connection's
+// own goroutine, which is the only one writing them.
+func (s *Server) event(typ EventType, sess *session, err error) {
+	if s.events.active.Load() == 0 {
+		return
+	}
+	ev := Event{
+		Type:     typ,
+		Time:     time.Now(),
+		ConnID:   sess.id,
+		Listener: sess.listenerName(),
+		Identity: sess.identity,
+		Target:   sess.target,
+		Upstream: sess.upstream,
+	}
+	if addr := sess.clientAddr(); addr != nil {
+		ev.ClientAddr = addr.String()
+	}
+	if err != nil {
+		ev.Error = err.Error()
+	}
+	s.events.publish(ev)
+}
+
+// closedEvent publishes the end of a connection
+func (s *Server) closedEvent(stats *ConnStats) {
+	if s.events.active.Load() == 0 {
+		return
+	}
+	ev := Event{
+		Type:       EventClosed,
+		Time:       time.Now(),
+		ConnID:     stats.ID,
+		Listener:   stats.Listener,
+		Identity:   stats.Identity,
+		Target:     stats.Target,
+		Upstream:   stats.Upstream,
+		Reason:     stats.Reason,
+		Upload:     stats.Upload,
+		Download:   stats.Download,
+		DurationMs: stats.Duration.Milliseconds(),
+	}
+	// Subscribers get their own copy
+	st := *stats
+	ev.Stats = &st
+	ev.Reply = &st.Reply
+	if stats.ClientAddr != nil {
+		ev.ClientAddr = stats.ClientAddr.String()
+	}
+	s.events.publish(ev)
+}
@@ -0,0 +1,118 @@
+package socks5
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// copyBufferSize is the size of the pooled copy buffers
+const copyBufferSize = 32 * 1024
+
+// spliceChunk is the most a single splice call moves without a limit in
+// place; byte counters and quotas are updated between chunks
+const spliceChunk = 1 << 20
+
+var copyBuffers = sync.Pool{
+	New: func() any {
+		b := make([]byte, copyBufferSize)
+		return &b
+	},
+}
+
+// pipe copies src to dst until EOF, counting, limiting and accounting the
+// bytes. upload is the client to target direction.
+func (s *Server) pipe(dst, src net.Conn, sess *session, upload bool) error {
+	if dstTCP, srcTCP, ok := spliceable(dst, src); ok {
+		return sess.splice(dstTCP, srcTCP, upload, s.timeouts.Idle)
+	}
+
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+	// Hide ReadFrom so that io.CopyBuffer uses the pooled buffer
+	_, err := io.CopyBuffer(writerOnly{dst}, sess.reader(src, upload), *buf)
+	return err
+}
+
+// splice moves data in chunks with TCPConn.ReadFrom, which uses splice(2)
+// between TCP sockets on Linux. splice gives no sign of life until a whole
+// chunk went through; with an idle timeout a read deadline cuts the chunk
+// short every quarter of it so that slow transfers are counted in time.
+func (sess *session) splice(dst, src *net.TCPConn, upload bool, idle time.Duration) error {
+	if idle > 0 {
+		defer src.SetReadDeadline(time.Time{})
+	}
+	for {
+		chunk := sess.limiter.chunk(upload, spliceChunk)
+		if idle > 0 {
+			_ = src.SetReadDeadline(time.Now().Add(idle / 4))
+		}
+		n, err := dst.ReadFrom(&io.LimitedReader{R: src, N: int64(chunk)})
+		if n > 0 {
+			if sess.count(int(n), upload) {
+				return errQuotaExceeded
+			}
+			sess.limiter.wait(int(n), upload)
+		}
+		// The watchdog decides whether the tunnel is idle
+		if idle > 0 && errors.Is(err, os.ErrDeadlineExceeded) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+	}
+}
+
+// endPipe records why one direction of the tunnel ended and passes a clean
+// EOF on to dst. It reports whether dst was half-closed, in which case the
+// other direction may keep going.
+func (s *Server) endPipe(err error, dst net.Conn, sess *session, upload bool) bool {
+	from, to, reason := "client", "target", CloseClientClosed
+	if !upload {
+		from, to, reason = "target", "client", CloseTargetClosed
+	}
+	switch {
+	case errors.Is(err, errQuotaExceeded):
+		sess.log.Info("Traffic quota exceeded, closing connection", "key", sess.key)
+		sess.setReason(CloseQuotaExceeded)
+		return false
+	case err != nil:
+		if !IsConnectionClosed(err) {
+			sess.log.Warn("Failed to copy data", "from", from, "to", to, "err", err)
+			sess.setReason(CloseError)
+		}
+		sess.setReason(reason)
+		return false
+	}
+	sess.setReason(reason)
+	return closeWrite(dst) == nil
+}
+
+// closeWrite shuts down the writing side of conn, unwrapping PROXY protocol
+// and buffered connections. TLS connections send close_notify first.
+func closeWrite(conn net.Conn) error {
+	switch c := conn.(type) {
+	case *tls.Conn:
+		if err := c.CloseWrite(); err != nil {
+			return err
+		}
+		return closeWrite(c.NetConn())
+	case interface{ CloseWrite() error }:
+		return c.CloseWrite()
+	case interface{ NetConn() net.Conn }:
+		return closeWrite(c.NetConn())
+	}
+	return errors.ErrUnsupported
+}
+
+type writerOnly struct {
+	io.Writer
+}
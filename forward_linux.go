@@ -0,0 +1,13 @@
+//go:build linux
+// +build linux
+
+package socks5
+
+import "net"
+
+// spliceable reports whether data can move between the connections with splice(2)
+func spliceable(dst, src net.Conn) (*net.TCPConn, *net.TCPConn, bool) {
+	dstTCP, ok1 := dst.(*net.TCPConn)
+	srcTCP, ok2 := src.(*net.TCPConn)
+	return dstTCP, srcTCP, ok1 && ok2
+}
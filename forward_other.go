@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package socks5
+
+import "net"
+
+// spliceable is always false, splice(2) is Linux only
+func spliceable(dst, src net.Conn) (*net.TCPConn, *net.TCPConn, bool) {
+	return nil, nil, false
+}
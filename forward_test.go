@@ -0,0 +1,249 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dcsunny/socks5/wire"
+)
+
+// startSink runs a TCP server that reads everything and reports how many
+// bytes each connection sent
+func startSink(tb testing.TB) (string, <-chan int64) {
+	tb.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { ln.Close() })
+	received := make(chan int64, 1)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				n, _ := io.Copy(io.Discard, conn)
+				received <- n
+			}()
+		}
+	}()
+	return ln.Addr().String(), received
+}
+
+// bufferedDialer connects directly, hiding the *net.TCPConn so that the
+// tunnel goes through the pooled buffers instead of splice(2)
+type bufferedDialer struct{}
+
+func (bufferedDialer) DialContext(ctx context.Context, req *Request) (net.Conn, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", req.Addr())
+	if err != nil {
+		return nil, err
+	}
+	return struct{ *net.TCPConn }{conn.(*net.TCPConn)}, nil
+}
+
+// forwardPaths are the ways a tunnel moves data, as server options
+var forwardPaths = map[string][]Option{
+	// TCP to TCP moves data with splice(2) on Linux
+	"splice": nil,
+	// With an idle timeout splice is cut short to report progress
+	"splice idle": {WithTimeouts(Timeouts{Idle: time.Minute})},
+	// Other connections, e.g. TLS, go through the pooled buffers
+	"buffered": {WithDialer(bufferedDialer{})},
+}
+
+func BenchmarkForward(b *testing.B) {
+	for name, opts := range forwardPaths {
+		b.Run(name, func(b *testing.B) {
+			sink, received := startSink(b)
+			_, addr := startServer(b, ListenerConfig{}, opts...)
+			conn, err := (&Dialer{ProxyAddr: addr}).Dial("tcp", sink)
+			if err != nil {
+				b.Fatal(err)
+			}
+			buf := make([]byte, copyBufferSize)
+			b.SetBytes(int64(len(buf)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := conn.Write(buf); err != nil {
+					b.Fatal(err)
+				}
+			}
+			conn.Close()
+			if n := <-received; n != int64(b.N)*int64(len(buf)) {
+				b.Fatalf("target received %d bytes, want %d", n, b.N*len(buf))
+			}
+		})
+	}
+}
+
+// closeWriteOf half-closes a connection made by Dialer
+func closeWriteOf(t *testing.T, conn net.Conn) {
+	t.Helper()
+	if err := conn.(*Conn).NetConn().(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// startTarget runs a TCP server that calls serve for each connection
+func startTarget(t *testing.T, serve func(*net.TCPConn)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				serve(conn.(*net.TCPConn))
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestForwardHalfClose(t *testing.T) {
+	// The target answers once the client is done sending, like an HTTP/1.0
+	// upload or nc -N
+	upload := startTarget(t, func(conn *net.TCPConn) {
+		data, _ := io.ReadAll(conn)
+		_, _ = io.WriteString(conn, "got "+string(data))
+	})
+	// The target says goodbye first and still takes the client's last words
+	lastWords := make(chan string, 1)
+	download := startTarget(t, func(conn *net.TCPConn) {
+		_, _ = io.WriteString(conn, "bye")
+		_ = conn.CloseWrite()
+		data, _ := io.ReadAll(conn)
+		lastWords <- string(data)
+	})
+	for name, opts := range forwardPaths {
+		t.Run(name, func(t *testing.T) {
+			hook, closed := closeHook()
+			_, addr := startServer(t, ListenerConfig{}, append(opts, hook)...)
+
+			conn, err := (&Dialer{ProxyAddr: addr}).Dial("tcp", upload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _ = io.WriteString(conn, "hello")
+			closeWriteOf(t, conn)
+			_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if reply, err := io.ReadAll(conn); err != nil || string(reply) != "got hello" {
+				t.Errorf("reply %q, %v; want got hello", reply, err)
+			}
+			conn.Close()
+			if stats := nextClose(t, closed); stats.Reason != CloseClientClosed {
+				t.Errorf("reason = %s, want %s", stats.Reason, CloseClientClosed)
+			}
+
+			conn, err = (&Dialer{ProxyAddr: addr}).Dial("tcp", download)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if msg, err := io.ReadAll(conn); err != nil || string(msg) != "bye" {
+				t.Errorf("read %q, %v; want bye", msg, err)
+			}
+			_, _ = io.WriteString(conn, "see you")
+			closeWriteOf(t, conn)
+			select {
+			case got := <-lastWords:
+				if got != "see you" {
+					t.Errorf("target read %q, want see you", got)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("target did not get EOF")
+			}
+			conn.Close()
+			if stats := nextClose(t, closed); stats.Reason != CloseTargetClosed {
+				t.Errorf("reason = %s, want %s", stats.Reason, CloseTargetClosed)
+			}
+		})
+	}
+}
+
+func TestForwardLinger(t *testing.T) {
+	// The target neither answers nor closes
+	target := startTarget(t, func(conn *net.TCPConn) {
+		_, _ = io.Copy(io.Discard, conn)
+		time.Sleep(5 * time.Second)
+	})
+	hook, closed := closeHook()
+	_, addr := startServer(t, ListenerConfig{}, hook, WithTimeouts(Timeouts{Linger: 200 * time.Millisecond}))
+	conn, err := (&Dialer{ProxyAddr: addr}).Dial("tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	closeWriteOf(t, conn)
+	start := time.Now()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Fatalf("tunnel still open: %v", err)
+	}
+	if d := time.Since(start); d < 150*time.Millisecond || d > 2*time.Second {
+		t.Errorf("closed after %v, want the 200ms linger", d)
+	}
+	if stats := nextClose(t, closed); stats.Reason != CloseClientClosed {
+		t.Errorf("reason = %s, want %s", stats.Reason, CloseClientClosed)
+	}
+}
+
+func TestForwardPipelined(t *testing.T) {
+	echo := startEcho(t)
+	_, addr := startServer(t, ListenerConfig{})
+
+	// Data sent along with the request, such as a TLS ClientHello, reaches
+	// the target first
+	conn, r := rawConnect(t, addr, echo, []byte("hello"))
+	if code := readReply(t, r); code != wire.RepSucceeded {
+		t.Fatalf("reply %d, want success", code)
+	}
+	_, _ = io.WriteString(conn, " world")
+	buf := make([]byte, len("hello world"))
+	if _, err := io.ReadFull(r, buf); err != nil || string(buf) != "hello world" {
+		t.Fatalf("echo %q, %v; want hello world", buf, err)
+	}
+
+	// A handshake split into single bytes parses all the same
+	raw, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	dst, _ := wire.ParseAddrSpec(echo)
+	var msg bytes.Buffer
+	_, _ = (&wire.Greeting{Methods: []byte{wire.MethodNoAuth}}).WriteTo(&msg)
+	_, _ = (&wire.Request{Command: wire.CmdConnect, Addr: dst}).WriteTo(&msg)
+	msg.WriteString("hello")
+	go func() {
+		for _, b := range msg.Bytes() {
+			if _, err := raw.Write([]byte{b}); err != nil {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	_ = raw.SetDeadline(time.Now().Add(5 * time.Second))
+	if code := readReply(t, raw); code != wire.RepSucceeded {
+		t.Fatalf("reply %d, want success", code)
+	}
+	buf = make([]byte, len("hello"))
+	if _, err := io.ReadFull(raw, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("echo %q, %v; want hello", buf, err)
+	}
+}
@@ -0,0 +1,169 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/dcsunny/socks5/wire"
+)
+
+// Hooks are called at the stages of a connection. Any of them may be nil.
+// Hooks added with WithHooks run in the order they were added; the first
+// error stops the chain and ends the connection.
+type Hooks struct {
+	// OnAccept is called before the TLS handshake and the greeting
+	OnAccept func(conn net.Conn) error
+	// OnAuthenticated is called once the client is authenticated; identity
+	// is empty when no authentication was required
+	OnAuthenticated func(conn net.Conn, identity string) error
+	// OnRequest may rewrite req.Host and req.Port or set req.Route. A
+	// *ReplyError rejects the request with its reply code, other errors
+	// with a general failure.
+	OnRequest func(req *Request) error
+	// OnConnected is called when the target is connected, before forwarding
+	OnConnected func(req *Request, target net.Conn)
+	// OnClose is called when the connection has ended
+	OnClose func(stats ConnStats)
+}
+
+// ConnStats describes a finished connection
+type ConnStats struct {
+	ID         uint64   // 连接 ID，与日志中的 conn 字段一致
+	ClientAddr net.Addr // 客户端地址，LocalDialer 的连接为 nil
+	Listener   string
+	Identity   string
+	Requested  string // 客户端请求的目标
+	Target     string // 实际连接的目标，OnRequest 改写后为改写的地址
+	Resolved   string // 直连时目标的 IP
+	Upstream   string // 实际使用的上游：direct 或代理地址
+	Reply      int    // 发给客户端的回复码，未回复时为 -1
+	Upload     int64  // 客户端到目标的字节数
+	Download   int64  // 目标到客户端的字节数
+	Start      time.Time
+	Duration   time.Duration
+	Reason     CloseReason
+}
+
+// WithHooks adds a set of hooks to the chain
+func WithHooks(h Hooks) Option {
+	return func(s *Server) {
+		s.hooks = append(s.hooks, h)
+	}
+}
+
+// CommandHandler serves a request in place of the built-in handling. It is
+// called after authentication, the ACLs, the OnRequest hooks and the limits;
+// it writes the reply itself, for example with wire.Reply, and owns conn
+// until it returns. Data the client sent after the request can be read
+// from conn.
+type CommandHandler interface {
+	ServeCommand(ctx context.Context, conn net.Conn, req *Request) error
+}
+
+// CommandHandlerFunc adapts a function to a CommandHandler
+type CommandHandlerFunc func(ctx context.Context, conn net.Conn, req *Request) error
+
+func (f CommandHandlerFunc) ServeCommand(ctx context.Context, conn net.Conn, req *Request) error {
+	return f(ctx, conn, req)
+}
+
+// WithCommandHandler serves cmd (wire.CmdConnect, wire.CmdBind or
+// wire.CmdUDPAssociate) with h. A CONNECT handler replaces dialing.
+func WithCommandHandler(cmd byte, h CommandHandler) Option {
+	return func(s *Server) {
+		if s.handlers == nil {
+			s.handlers = make(map[byte]CommandHandler)
+		}
+		s.handlers[cmd] = h
+	}
+}
+
+func (s *Server) onAccept(conn net.Conn) error {
+	for _, h := range s.hooks {
+		if h.OnAccept != nil {
+			if err := h.OnAccept(conn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Server) onAuthenticated(conn net.Conn, identity string) error {
+	for _, h := range s.hooks {
+		if h.OnAuthenticated != nil {
+			if err := h.OnAuthenticated(conn, identity); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Server) onRequest(req *Request) error {
+	for _, h := range s.hooks {
+		if h.OnRequest != nil {
+			if err := h.OnRequest(req); err != nil {
+				return err
+			}
+		}
+	}
+	if req.Route != nil {
+		return req.Route.validate()
+	}
+	return nil
+}
+
+func (s *Server) onConnected(req *Request, target net.Conn) {
+	for _, h := range s.hooks {
+		if h.OnConnected != nil {
+			h.OnConnected(req, target)
+		}
+	}
+}
+
+// onClose logs the end of a connection and runs the OnClose hooks
+func (s *Server) onClose(sess *session) {
+	stats := ConnStats{
+		ID:         sess.id,
+		ClientAddr: sess.clientAddr(),
+		Listener:   sess.listenerName(),
+		Identity:   sess.identity,
+		Requested:  sess.request,
+		Target:     sess.target,
+		Resolved:   sess.resolved,
+		Upstream:   sess.upstream,
+		Reply:      sess.rep,
+		Upload:     sess.upload.Load(),
+		Download:   sess.download.Load(),
+		Start:      sess.start,
+		Duration:   time.Since(sess.start),
+		Reason:     sess.closeReason(),
+	}
+	s.mu.Lock()
+	delete(s.sessions, sess.id)
+	s.mu.Unlock()
+	sess.log.Debug("Connection closed", "reason", stats.Reason, "upload", stats.Upload, "download", stats.Download, "duration", stats.Duration)
+	s.metrics.closed(&stats)
+	endConnSpan(sess.span, &stats)
+	s.closedEvent(&stats)
+	if s.accessLog != nil {
+		s.accessLog.log(stats)
+	}
+	for _, h := range s.hooks {
+		if h.OnClose != nil {
+			h.OnClose(stats)
+		}
+	}
+}
+
+// rejectCode returns the reply code for an error returned by OnRequest
+func rejectCode(err error) byte {
+	var re *ReplyError
+	if errors.As(err, &re) && re.Code != wire.RepSucceeded {
+		return re.Code
+	}
+	return wire.RepGeneralFailure
+}
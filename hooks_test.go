@@ -0,0 +1,122 @@
+package socks5
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/dcsunny/socks5/wire"
+)
+
+// rewriteHook sends requests for the hosts in the map to another address,
+// and refuses refused.test with host unreachable
+func rewriteHook(rewrites map[string]string) Option {
+	return WithHooks(Hooks{OnRequest: func(req *Request) error {
+		if req.Host == "refused.test" {
+			return &ReplyError{Code: wire.RepHostUnreachable}
+		}
+		if to, ok := rewrites[req.Host]; ok {
+			req.Host, req.Port, _ = net.SplitHostPort(to)
+		}
+		return nil
+	}})
+}
+
+func TestHooks(t *testing.T) {
+	echo := startEcho(t)
+	var mu sync.Mutex
+	var calls []string
+	record := func(call string) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls = append(calls, call)
+	}
+	hook, closed := closeHook()
+	_, addr := startServer(t, ListenerConfig{Profile: &Profile{
+		Username:         "user",
+		Password:         "secret",
+		DenyDestinations: []string{"blocked.test"},
+	}}, WithHooks(Hooks{
+		OnAccept:        func(net.Conn) error { record("accept"); return nil },
+		OnAuthenticated: func(_ net.Conn, identity string) error { record("authenticated " + identity); return nil },
+		OnRequest:       func(req *Request) error { record("request " + req.Host); return nil },
+		OnConnected:     func(req *Request, _ net.Conn) { record("connected " + req.Addr()) },
+	}), rewriteHook(map[string]string{"alias.test": echo, "sneaky.test": "blocked.test:80"}), hook)
+	d := userDialer(addr)
+
+	conn, err := d.Dial("tcp", "alias.test:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoThrough(t, conn, "hello")
+	conn.Close()
+	stats := nextClose(t, closed)
+	if stats.Requested != "alias.test:80" || stats.Target != echo || stats.Identity != "user" || stats.Upload != 5 {
+		t.Errorf("stats = %+v, want alias.test:80 rewritten to %s", stats, echo)
+	}
+	want := []string{"accept", "authenticated user", "request alias.test", "connected " + echo}
+	mu.Lock()
+	if len(calls) != len(want) {
+		t.Errorf("calls = %q, want %q", calls, want)
+	} else {
+		for i := range want {
+			if calls[i] != want[i] {
+				t.Errorf("call %d = %q, want %q", i, calls[i], want[i])
+			}
+		}
+	}
+	mu.Unlock()
+
+	// A hook picks the reply code
+	if _, err := d.Dial("tcp", "refused.test:80"); replyCode(err) != int(wire.RepHostUnreachable) {
+		t.Errorf("err = %v, want host unreachable", err)
+	}
+	if stats := nextClose(t, closed); stats.Reason != CloseRejected {
+		t.Errorf("reason = %s, want %s", stats.Reason, CloseRejected)
+	}
+
+	// A rewrite cannot get around the ACL
+	if _, err := d.Dial("tcp", "sneaky.test:80"); replyCode(err) != int(wire.RepRulesetDenied) {
+		t.Errorf("err = %v, want ruleset denied", err)
+	}
+	if stats := nextClose(t, closed); stats.Reason != CloseRejected || stats.Target != "blocked.test:80" {
+		t.Errorf("reason = %s to %s, want %s to blocked.test:80", stats.Reason, stats.Target, CloseRejected)
+	}
+}
+
+func TestCommandHandlerConnect(t *testing.T) {
+	// CONNECT served in-process, without dialing
+	handler := CommandHandlerFunc(func(ctx context.Context, conn net.Conn, req *Request) error {
+		if req.Host != "mock.test" {
+			return writeReply(conn, wire.RepHostUnreachable, nil)
+		}
+		if err := writeReply(conn, wire.RepSucceeded, nil); err != nil {
+			return err
+		}
+		_, err := io.Copy(conn, conn)
+		return err
+	})
+	hook, closed := closeHook()
+	_, addr := startServer(t, ListenerConfig{}, WithCommandHandler(wire.CmdConnect, handler), hook)
+	d := &Dialer{ProxyAddr: addr}
+
+	// Data pipelined with the request reaches the handler too
+	conn, r := rawConnect(t, addr, "mock.test:80", []byte("early"))
+	if code := readReply(t, r); code != wire.RepSucceeded {
+		t.Fatalf("reply %d, want success", code)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(r, buf); err != nil || string(buf) != "early" {
+		t.Fatalf("read %q, %v; want early", buf, err)
+	}
+	conn.Close()
+	if stats := nextClose(t, closed); stats.Reason != CloseClientClosed {
+		t.Errorf("reason = %s, want %s", stats.Reason, CloseClientClosed)
+	}
+
+	if _, err := d.Dial("tcp", "elsewhere.test:80"); replyCode(err) != int(wire.RepHostUnreachable) {
+		t.Errorf("err = %v, want host unreachable", err)
+	}
+}
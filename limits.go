@@ -0,0 +1,146 @@
+package socks5
+
+import (
+	"sync"
+	"time"
+)
+
+// ConnLimits bound the number of connections served at once; 0 means unlimited
+type ConnLimits struct {
+	MaxConns        int // 总并发连接数，达到上限时拒绝新连接
+	MaxConnsPerIP   int // 每个客户端 IP 的并发连接数
+	MaxConnsPerUser int // 每个认证用户的并发连接数
+	ConnRatePerIP   int // 每个客户端 IP 每秒新建连接数
+}
+
+// WithConnLimits sets the connection concurrency limits
+func WithConnLimits(limits ConnLimits) Option {
+	return func(s *Server) {
+		s.admission = newAdmission(limits)
+	}
+}
+
+// admission enforces ConnLimits
+type admission struct {
+	limits ConnLimits
+	slots  chan struct{} // 总连接数信号量，不限制时为 nil
+
+	mu        sync.Mutex
+	perIP     map[string]int
+	perUser   map[string]int
+	rates     map[string]*tokenBucket
+	lastPrune time.Time
+}
+
+func newAdmission(limits ConnLimits) *admission {
+	a := &admission{
+		limits:  limits,
+		perIP:   make(map[string]int),
+		perUser: make(map[string]int),
+		rates:   make(map[string]*tokenBucket),
+	}
+	if limits.MaxConns > 0 {
+		a.slots = make(chan struct{}, limits.MaxConns)
+	}
+	return a
+}
+
+// takeSlot takes a connection slot, it reports false when the server is full
+func (a *admission) takeSlot() bool {
+	if a.slots == nil {
+		return true
+	}
+	select {
+	case a.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (a *admission) releaseSlot() {
+	if a.slots != nil {
+		<-a.slots
+	}
+}
+
+// admitIP checks the per-IP concurrency and rate limits, the returned
+// reason is empty when the connection is admitted
+func (a *admission) admitIP(ip string) string {
+	if ip == "" || (a.limits.MaxConnsPerIP <= 0 && a.limits.ConnRatePerIP <= 0) {
+		return ""
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.limits.ConnRatePerIP > 0 {
+		now := time.Now()
+		a.pruneRates(now)
+		b := a.rates[ip]
+		if b == nil {
+			b = &tokenBucket{}
+			b.set(int64(a.limits.ConnRatePerIP), 0)
+			b.tokens = b.burst
+			a.rates[ip] = b
+		}
+		if !b.allow(1) {
+			return "rate"
+		}
+	}
+	if a.limits.MaxConnsPerIP > 0 && a.perIP[ip] >= a.limits.MaxConnsPerIP {
+		return "ip"
+	}
+	a.perIP[ip]++
+	return ""
+}
+
+func (a *admission) releaseIP(ip string) {
+	if ip == "" || (a.limits.MaxConnsPerIP <= 0 && a.limits.ConnRatePerIP <= 0) {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.perIP[ip]--; a.perIP[ip] <= 0 {
+		delete(a.perIP, ip)
+	}
+}
+
+// admitUser checks the per-user concurrency limit
+func (a *admission) admitUser(user string) bool {
+	if user == "" || a.limits.MaxConnsPerUser <= 0 {
+		return true
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.perUser[user] >= a.limits.MaxConnsPerUser {
+		return false
+	}
+	a.perUser[user]++
+	return true
+}
+
+func (a *admission) releaseUser(user string) {
+	if user == "" || a.limits.MaxConnsPerUser <= 0 {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.perUser[user]--; a.perUser[user] <= 0 {
+		delete(a.perUser, user)
+	}
+}
+
+// pruneRates drops the rate buckets of clients idle for a while
+func (a *admission) pruneRates(now time.Time) {
+	if now.Sub(a.lastPrune) < time.Minute {
+		return
+	}
+	a.lastPrune = now
+	for ip, b := range a.rates {
+		b.mu.Lock()
+		idle := now.Sub(b.last) > time.Minute
+		b.mu.Unlock()
+		if idle {
+			delete(a.rates, ip)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dcsunny/socks5/wire"
+)
+
+// refused reports whether the server closes a new connection to addr
+// without answering the greeting
+func refused(t *testing.T, addr string) bool {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, _ = (&wire.Greeting{Methods: []byte{wire.MethodNoAuth}}).WriteTo(conn)
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 2))
+	return err != nil && !errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+// tunnel opens a connection through the server and keeps it open
+func tunnel(t *testing.T, d *Dialer, echo string) net.Conn {
+	t.Helper()
+	conn, err := d.Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	echoThrough(t, conn, "hello")
+	return conn
+}
+
+func TestMaxConns(t *testing.T) {
+	echo := startEcho(t)
+	hook, closed := closeHook()
+	logs := newLogRecords()
+	var addrs []string
+	var opts []Option
+	for i := 0; i < 2; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs = append(addrs, ln.Addr().String())
+		opts = append(opts, WithListener(ListenerConfig{Network: "tcp", Addr: ln.Addr().String(), Listener: ln, Profile: &Profile{}}))
+	}
+	s := NewServer(false, "", "", "", "", append(opts, hook,
+		WithLogger(slog.New(logs)), WithConnLimits(ConnLimits{MaxConns: 2}))...)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	// Registered first, it runs after the tunnels are closed
+	t.Cleanup(func() { _ = s.Shutdown(context.Background()) })
+
+	// Idle listeners do not hold slots, both go to the first one
+	first := tunnel(t, &Dialer{ProxyAddr: addrs[0]}, echo)
+	tunnel(t, &Dialer{ProxyAddr: addrs[0]}, echo)
+	if !refused(t, addrs[1]) {
+		t.Fatal("connection over the limit served")
+	}
+	if got := s.Stats().LimitedTotal; got != 1 {
+		t.Errorf("LimitedTotal = %d, want 1", got)
+	}
+	refusals := logs.find("Connection refused")
+	if len(refusals) != 1 || refusals[0]["reason"] != "max_conns" || refusals[0]["conn"] == "" {
+		t.Errorf("refusals logged = %v, want one for max_conns with a conn ID", refusals)
+	}
+
+	// A freed slot is taken by the next connection, on any listener
+	first.Close()
+	nextClose(t, closed)
+	tunnel(t, &Dialer{ProxyAddr: addrs[1]}, echo)
+}
+
+func TestMaxConnsPerIP(t *testing.T) {
+	echo := startEcho(t)
+	hook, closed := closeHook()
+	s, addr := startServer(t, ListenerConfig{}, hook, WithConnLimits(ConnLimits{MaxConnsPerIP: 1}))
+
+	conn := tunnel(t, &Dialer{ProxyAddr: addr}, echo)
+	if !refused(t, addr) {
+		t.Fatal("second connection from the IP served")
+	}
+	if got := s.Stats().LimitedPerIP; got != 1 {
+		t.Errorf("LimitedPerIP = %d, want 1", got)
+	}
+	conn.Close()
+	nextClose(t, closed)
+	tunnel(t, &Dialer{ProxyAddr: addr}, echo)
+}
+
+func TestConnRatePerIP(t *testing.T) {
+	echo := startEcho(t)
+	s, addr := startServer(t, ListenerConfig{}, WithConnLimits(ConnLimits{ConnRatePerIP: 2}))
+
+	// A burst of one second's worth, then the bucket is empty
+	for i := 0; i < 2; i++ {
+		tunnel(t, &Dialer{ProxyAddr: addr}, echo).Close()
+	}
+	if !refused(t, addr) {
+		t.Fatal("connection over the rate served")
+	}
+	if got := s.Stats().LimitedRate; got != 1 {
+		t.Errorf("LimitedRate = %d, want 1", got)
+	}
+	time.Sleep(600 * time.Millisecond)
+	tunnel(t, &Dialer{ProxyAddr: addr}, echo)
+}
+
+func TestMaxConnsPerUser(t *testing.T) {
+	echo := startEcho(t)
+	hook, closed := closeHook()
+	s, addr := startServer(t, ListenerConfig{Profile: &Profile{Username: "user", Password: "secret"}},
+		hook, WithConnLimits(ConnLimits{MaxConnsPerUser: 1}))
+
+	conn := tunnel(t, userDialer(addr), echo)
+	if _, err := userDialer(addr).Dial("tcp", echo); replyCode(err) != int(wire.RepRulesetDenied) {
+		t.Fatalf("err = %v, want ruleset denied", err)
+	}
+	if stats := nextClose(t, closed); stats.Reason != CloseRejected {
+		t.Errorf("reason = %s, want %s", stats.Reason, CloseRejected)
+	}
+	if got := s.Stats().LimitedPerUser; got != 1 {
+		t.Errorf("LimitedPerUser = %d, want 1", got)
+	}
+	conn.Close()
+	nextClose(t, closed)
+	tunnel(t, userDialer(addr), echo)
+}
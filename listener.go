@@ -0,0 +1,323 @@
+package socks5
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Profile is the policy applied to connections accepted on a listener
+type Profile struct {
+	Username    string // 用户名，与 Password 同时设置时启用认证
+	Password    string // 密码
+	SystemProxy bool   // 是否使用系统代理设置
+	DownProxy   string // 下游代理地址
+
+	AllowSources      []*net.IPNet // 允许的客户端网段，为空时不限制
+	AllowDestinations []string     // 允许的目标地址，为空时不限制
+	DenyDestinations  []string     // 禁止的目标地址，优先于 AllowDestinations
+	MaxConns          int          // 该监听器的最大并发连接数，0 表示不限制
+
+	Routes []Route // 按目标地址选择路由，按顺序匹配
+
+	// FastOpen 在连接目标之前就回复成功，客户端可以立即发送数据；
+	// 连接失败时只能直接断开，无法返回错误码
+	FastOpen bool
+}
+
+func (p *Profile) authRequired() bool {
+	return p.Username != "" && p.Password != ""
+}
+
+// ListenerConfig describes one listening socket and the profile it serves
+type ListenerConfig struct {
+	Network string // tcp 或 unix
+	Addr    string // host:port，或 unix socket 路径
+
+	TLSCertFile  string // 设置后以 SOCKS5 over TLS 提供服务
+	TLSKeyFile   string
+	ClientCAFile string
+
+	UnixMode os.FileMode // unix socket 文件权限，0 表示保持默认
+
+	// ProxyProtocol expects a PROXY v1 or v2 header from peers in
+	// TrustedProxies, which must not be empty
+	ProxyProtocol  bool
+	TrustedProxies []*net.IPNet
+
+	// Listener is an already bound socket, e.g. inherited from systemd.
+	// Network and Addr are then only used for logging.
+	Listener net.Listener
+
+	Profile *Profile // 为空时使用 NewServer 参数对应的默认配置
+}
+
+// ParseListener parses a listener spec given on the command line. The spec is
+// either a plain "host:port", which inherits defaults, or a URL such as
+//
+//	tcp://127.0.0.1:1080
+//	tls://0.0.0.0:1443?cert=server.pem&key=server.key&client-ca=ca.pem
+//	unix:///run/socks5.sock?mode=0660
+//	systemd://socks?username=admin&password=secret
+//
+// A systemd:// spec names an inherited socket (see ActivationListeners) whose
+// Listener the caller fills in. Query parameters override the default profile: username, password,
+// down-proxy, system-proxy, allow-src, allow-dst, deny-dst, max-conns and fast-open;
+// proxy-protocol and trusted-proxies configure the listener itself.
+func ParseListener(spec string, defaults ListenerConfig) (ListenerConfig, error) {
+	cfg := defaults
+	profile := Profile{}
+	if defaults.Profile != nil {
+		profile = *defaults.Profile
+	}
+	cfg.Profile = &profile
+	if cfg.Network == "" {
+		cfg.Network = "tcp"
+	}
+
+	if !strings.Contains(spec, "://") {
+		cfg.Addr = spec
+		return cfg, nil
+	}
+	u, err := url.Parse(spec)
+	if err != nil {
+		return cfg, fmt.Errorf("invalid listener %q: %v", spec, err)
+	}
+	q := u.Query()
+	switch u.Scheme {
+	case "tcp":
+		cfg.Network, cfg.Addr = "tcp", u.Host
+		cfg.TLSCertFile, cfg.TLSKeyFile, cfg.ClientCAFile = "", "", ""
+	case "tls":
+		cfg.Network, cfg.Addr = "tcp", u.Host
+		if v := q.Get("cert"); v != "" {
+			cfg.TLSCertFile = v
+		}
+		if v := q.Get("key"); v != "" {
+			cfg.TLSKeyFile = v
+		}
+		if v := q.Get("client-ca"); v != "" {
+			cfg.ClientCAFile = v
+		}
+		if cfg.TLSCertFile == "" || cfg.TLSKeyFile == "" {
+			return cfg, fmt.Errorf("tls listener %q needs cert and key", spec)
+		}
+	case "systemd":
+		cfg.Network, cfg.Addr = "systemd", u.Host
+	case "unix":
+		cfg.Network, cfg.Addr = "unix", u.Host+u.Path
+		cfg.TLSCertFile, cfg.TLSKeyFile, cfg.ClientCAFile = "", "", ""
+		if v := q.Get("mode"); v != "" {
+			mode, err := strconv.ParseUint(v, 8, 32)
+			if err != nil {
+				return cfg, fmt.Errorf("invalid unix socket mode %q: %v", v, err)
+			}
+			cfg.UnixMode = os.FileMode(mode)
+		}
+	default:
+		return cfg, fmt.Errorf("unsupported listener scheme: %s", u.Scheme)
+	}
+	if cfg.Addr == "" {
+		return cfg, fmt.Errorf("listener %q has no address", spec)
+	}
+
+	if v := q.Get("proxy-protocol"); v != "" {
+		if cfg.ProxyProtocol, err = strconv.ParseBool(v); err != nil {
+			return cfg, fmt.Errorf("invalid proxy-protocol %q: %v", v, err)
+		}
+	}
+	if v := q.Get("trusted-proxies"); v != "" {
+		if cfg.TrustedProxies, err = ParseCIDRs(strings.Split(v, ",")); err != nil {
+			return cfg, err
+		}
+	}
+
+	if q.Has("username") {
+		profile.Username = q.Get("username")
+	}
+	if q.Has("password") {
+		profile.Password = q.Get("password")
+	}
+	if q.Has("down-proxy") {
+		profile.DownProxy = q.Get("down-proxy")
+	}
+	if v := q.Get("system-proxy"); v != "" {
+		if profile.SystemProxy, err = strconv.ParseBool(v); err != nil {
+			return cfg, fmt.Errorf("invalid system-proxy %q: %v", v, err)
+		}
+	}
+	if v := q.Get("allow-src"); v != "" {
+		if profile.AllowSources, err = ParseCIDRs(strings.Split(v, ",")); err != nil {
+			return cfg, err
+		}
+	}
+	if v := q.Get("allow-dst"); v != "" {
+		profile.AllowDestinations = strings.Split(v, ",")
+	}
+	if v := q.Get("deny-dst"); v != "" {
+		profile.DenyDestinations = strings.Split(v, ",")
+	}
+	if v := q.Get("max-conns"); v != "" {
+		if profile.MaxConns, err = strconv.Atoi(v); err != nil {
+			return cfg, fmt.Errorf("invalid max-conns %q: %v", v, err)
+		}
+	}
+	if v := q.Get("fast-open"); v != "" {
+		if profile.FastOpen, err = strconv.ParseBool(v); err != nil {
+			return cfg, fmt.Errorf("invalid fast-open %q: %v", v, err)
+		}
+	}
+	return cfg, nil
+}
+
+// listener is a bound ListenerConfig together with its runtime state
+type listener struct {
+	net.Listener
+	cfg       ListenerConfig
+	state     atomic.Pointer[listenerState]
+	tlsConfig *tls.Config
+	active    int32
+
+	usesDefault bool // 使用 NewServer 参数对应的默认配置，Reload 时随之更新
+}
+
+// listenerState is the part of a listener that Reload replaces
+type listenerState struct {
+	profile   *Profile
+	downProxy *DownProxyInfo
+}
+
+func newListenerState(profile *Profile) (*listenerState, error) {
+	for i := range profile.Routes {
+		if err := profile.Routes[i].validate(); err != nil {
+			return nil, err
+		}
+	}
+	return &listenerState{profile: profile, downProxy: parseDownProxy(profile.DownProxy)}, nil
+}
+
+func newListener(cfg ListenerConfig, logger *slog.Logger) (*listener, error) {
+	// Trusting any peer would let every client pick its source address
+	if cfg.ProxyProtocol && len(cfg.TrustedProxies) == 0 {
+		return nil, fmt.Errorf("proxy-protocol on %s needs trusted-proxies", cfg.Addr)
+	}
+	l := &listener{cfg: cfg}
+	state, err := newListenerState(cfg.Profile)
+	if err != nil {
+		return nil, err
+	}
+	l.state.Store(state)
+	if cfg.TLSCertFile != "" || cfg.TLSKeyFile != "" {
+		files, err := newTLSFiles(cfg.TLSCertFile, cfg.TLSKeyFile, cfg.ClientCAFile, logger)
+		if err != nil {
+			return nil, err
+		}
+		l.tlsConfig = files.serverConfig()
+	}
+
+	if cfg.Listener != nil {
+		l.Listener = cfg.Listener
+		return l, nil
+	}
+	if cfg.Network == "systemd" {
+		return nil, fmt.Errorf("no inherited socket named %s", cfg.Addr)
+	}
+	if cfg.Network == "unix" {
+		if err := removeStaleSocket(cfg.Addr); err != nil {
+			return nil, err
+		}
+	}
+	ln, err := net.Listen(cfg.Network, cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Network == "unix" && cfg.UnixMode != 0 {
+		if err := os.Chmod(cfg.Addr, cfg.UnixMode); err != nil {
+			ln.Close()
+			return nil, fmt.Errorf("failed to chmod %s: %v", cfg.Addr, err)
+		}
+	}
+	l.Listener = ln
+	return l, nil
+}
+
+// removeStaleSocket removes a socket file left by a previous run. A socket
+// that still accepts connections belongs to a running server and is kept.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return nil
+	}
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by another process", path)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return fmt.Errorf("cannot tell whether %s is in use: %v", path, err)
+	}
+	return os.Remove(path)
+}
+
+func (l *listener) String() string {
+	scheme := l.cfg.Network
+	if l.tlsConfig != nil {
+		scheme = "tls"
+	}
+	return scheme + "://" + l.cfg.Addr
+}
+
+// acceptsProxyHeader reports whether a PROXY header is expected from addr
+func (l *listener) acceptsProxyHeader(addr net.Addr) bool {
+	if !l.cfg.ProxyProtocol {
+		return false
+	}
+	ip := addrIP(addr)
+	return ip != nil && containsIP(l.cfg.TrustedProxies, ip)
+}
+
+// current returns the profile connections accepted now are served with
+func (l *listener) current() *listenerState {
+	return l.state.Load()
+}
+
+// acquire reserves a connection slot on the listener
+func (l *listener) acquire(profile *Profile) bool {
+	if atomic.AddInt32(&l.active, 1) > int32(profile.MaxConns) && profile.MaxConns > 0 {
+		atomic.AddInt32(&l.active, -1)
+		return false
+	}
+	return true
+}
+
+func (l *listener) release() {
+	atomic.AddInt32(&l.active, -1)
+}
+
+func parseDownProxy(downProxy string) *DownProxyInfo {
+	downProxyInfo := &DownProxyInfo{
+		Addr: downProxy,
+	}
+	if downProxy != "" {
+		downProxyInfo.Enabled = true
+		if strings.HasPrefix(downProxy, "socks5") {
+			downProxyInfo.ProxyType = "socks5"
+		} else if strings.HasPrefix(downProxy, "https") {
+			downProxyInfo.ProxyType = "https"
+		} else if strings.HasPrefix(downProxy, "http") {
+			downProxyInfo.ProxyType = "http"
+		} else {
+			downProxyInfo.Enabled = false
+		}
+	}
+	return downProxyInfo
+}
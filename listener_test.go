@@ -0,0 +1,191 @@
+package socks5
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// unixDialer connects to the socket at its path whatever address it is given
+type unixDialer string
+
+func (d unixDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return (&net.Dialer{}).DialContext(ctx, "unix", string(d))
+}
+
+// startListeners starts a server on the given listeners, a loopback port
+// for those without an address
+func startListeners(t *testing.T, cfgs []ListenerConfig, opts ...Option) (*Server, []string) {
+	t.Helper()
+	var addrs []string
+	for _, cfg := range cfgs {
+		if cfg.Network == "" {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg.Network, cfg.Addr, cfg.Listener = "tcp", ln.Addr().String(), ln
+		}
+		addrs = append(addrs, cfg.Addr)
+		opts = append(opts, WithListener(cfg))
+	}
+	s := NewServer(false, "", "", "", "", append([]Option{WithLogger(testLogger())}, opts...)...)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = s.Shutdown(context.Background()) })
+	return s, addrs
+}
+
+func TestParseListener(t *testing.T) {
+	defaults := ListenerConfig{Profile: &Profile{Username: "admin", Password: "secret"}}
+	tests := []struct {
+		spec    string
+		check   func(ListenerConfig) bool
+		wantErr bool
+	}{
+		{spec: "127.0.0.1:1080", check: func(c ListenerConfig) bool {
+			return c.Network == "tcp" && c.Addr == "127.0.0.1:1080" && c.Profile.Username == "admin"
+		}},
+		{spec: "unix:///run/socks5.sock?mode=0660&username=", check: func(c ListenerConfig) bool {
+			return c.Network == "unix" && c.Addr == "/run/socks5.sock" && c.UnixMode == 0660 && !c.Profile.authRequired()
+		}},
+		{spec: "tcp://0.0.0.0:1081?max-conns=3&deny-dst=*.internal", check: func(c ListenerConfig) bool {
+			return c.Profile.MaxConns == 3 && len(c.Profile.DenyDestinations) == 1 && c.Profile.Username == "admin"
+		}},
+		{spec: "tls://0.0.0.0:1443?cert=a.pem&key=a.key", check: func(c ListenerConfig) bool {
+			return c.Network == "tcp" && c.TLSCertFile == "a.pem" && c.TLSKeyFile == "a.key"
+		}},
+		{spec: "unix:///run/socks5.sock?mode=0999", wantErr: true},
+		{spec: "tls://0.0.0.0:1443", wantErr: true},
+		{spec: "udp://0.0.0.0:1080", wantErr: true},
+		{spec: "tcp://?username=a", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseListener(tt.spec, defaults)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseListener(%q) error = %v, want error %v", tt.spec, err, tt.wantErr)
+			continue
+		}
+		if err == nil && !tt.check(got) {
+			t.Errorf("ParseListener(%q) = %+v, profile %+v", tt.spec, got, *got.Profile)
+		}
+	}
+	if defaults.Profile.Username != "admin" {
+		t.Error("ParseListener changed the default profile")
+	}
+}
+
+func TestMultipleListeners(t *testing.T) {
+	echo := startEcho(t)
+	hook, closed := closeHook()
+	sock := filepath.Join(t.TempDir(), "socks5.sock")
+	_, addrs := startListeners(t, []ListenerConfig{
+		{Profile: &Profile{}},
+		{Network: "unix", Addr: sock, UnixMode: 0600, Profile: &Profile{Username: "user", Password: "secret"}},
+	}, hook)
+
+	if fi, err := os.Stat(sock); err != nil || fi.Mode().Perm() != 0600 {
+		t.Fatalf("socket mode = %v, %v; want 0600", fi.Mode().Perm(), err)
+	}
+
+	// Each listener serves its own profile
+	conn := tunnel(t, &Dialer{ProxyAddr: addrs[0]}, echo)
+	conn.Close()
+	if stats := nextClose(t, closed); stats.Listener != "tcp://"+addrs[0] || stats.Identity != "" {
+		t.Errorf("listener %s, user %q; want tcp://%s without a user", stats.Listener, stats.Identity, addrs[0])
+	}
+	if _, err := (&Dialer{ProxyAddr: sock, Forward: unixDialer(sock)}).Dial("tcp", echo); err == nil {
+		t.Fatal("connected to the unix listener without credentials")
+	}
+	nextClose(t, closed)
+	conn = tunnel(t, &Dialer{ProxyAddr: sock, Forward: unixDialer(sock), Username: "user", Password: "secret"}, echo)
+	conn.Close()
+	if stats := nextClose(t, closed); stats.Listener != "unix://"+sock || stats.Identity != "user" {
+		t.Errorf("listener %s, user %q; want unix://%s and user", stats.Listener, stats.Identity, sock)
+	}
+}
+
+func TestUnixSocketInUse(t *testing.T) {
+	echo := startEcho(t)
+	sock := filepath.Join(t.TempDir(), "socks5.sock")
+	cfg := ListenerConfig{Network: "unix", Addr: sock, Profile: &Profile{}}
+	startListeners(t, []ListenerConfig{cfg})
+
+	// A second server does not take the socket of a running one
+	s := NewServer(false, "", "", "", "", WithLogger(testLogger()), WithListener(cfg))
+	if err := s.Start(); err == nil || !strings.Contains(err.Error(), "in use") {
+		s.Shutdown(context.Background())
+		t.Fatalf("Start = %v, want the socket in use", err)
+	}
+	tunnel(t, &Dialer{ProxyAddr: sock, Forward: unixDialer(sock)}, echo).Close()
+
+	// A socket nobody accepts on is left over and replaced
+	stale := filepath.Join(t.TempDir(), "stale.sock")
+	ln, err := net.Listen("unix", stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+	startListeners(t, []ListenerConfig{{Network: "unix", Addr: stale, Profile: &Profile{}}})
+	tunnel(t, &Dialer{ProxyAddr: stale, Forward: unixDialer(stale)}, echo).Close()
+}
+
+func TestReloadProfiles(t *testing.T) {
+	echo := startEcho(t)
+	// The first listener follows the default profile, the second has its own
+	s, addrs := startListeners(t, []ListenerConfig{
+		{},
+		{Profile: &Profile{Username: "user", Password: "secret"}},
+	})
+	anon := func(i int) *Dialer { return &Dialer{ProxyAddr: addrs[i]} }
+	as := func(i int, user, pass string) *Dialer {
+		return &Dialer{ProxyAddr: addrs[i], Username: user, Password: pass}
+	}
+	refusedBy := func(d *Dialer) bool {
+		t.Helper()
+		conn, err := d.Dial("tcp", echo)
+		if err == nil {
+			conn.Close()
+		}
+		return err != nil
+	}
+	established := tunnel(t, anon(0), echo)
+
+	// A new default profile applies to the listeners that use it
+	if err := s.Reload(&Profile{Username: "new", Password: "pw"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !refusedBy(anon(0)) || refusedBy(as(0, "new", "pw")) {
+		t.Error("default listener did not switch to the new default profile")
+	}
+	if refusedBy(as(1, "user", "secret")) {
+		t.Error("listener with its own profile changed with the default profile")
+	}
+	// Established connections keep theirs
+	echoThrough(t, established, "hello")
+
+	// A config replaces the profile of its listener only
+	if err := s.Reload(nil, []ListenerConfig{{Network: "tcp", Addr: addrs[1], Profile: &Profile{}}}); err != nil {
+		t.Fatal(err)
+	}
+	if refusedBy(anon(1)) || refusedBy(as(0, "new", "pw")) {
+		t.Error("reloading one listener's profile")
+	}
+
+	// Nothing changes when part of a reload is invalid
+	if err := s.Reload(&Profile{}, []ListenerConfig{{Network: "tcp", Addr: "127.0.0.1:1", Profile: &Profile{}}}); err == nil {
+		t.Error("reloaded a listener that is not running")
+	}
+	bad := &Profile{Routes: []Route{{Match: []string{"*"}, Upstream: "ftp://nowhere"}}}
+	if err := s.Reload(nil, []ListenerConfig{{Network: "tcp", Addr: addrs[1], Profile: bad}}); err == nil {
+		t.Error("reloaded an invalid route")
+	}
+	if !refusedBy(anon(0)) || refusedBy(anon(1)) {
+		t.Error("a failed reload changed the profiles")
+	}
+}
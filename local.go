@@ -0,0 +1,240 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/dcsunny/socks5/wire"
+	"golang.org/x/net/proxy"
+)
+
+// localListener names the connections of LocalDialer in requests and stats
+const localListener = "local"
+
+// LocalDialer connects the way a CONNECT request to the server would: the
+// same ACLs, OnRequest hooks, routing, limits and accounting apply, without
+// going through SOCKS5. A CONNECT CommandHandler serves the connection in
+// place of the dial, as it would for a client. Refused destinations return
+// a *ReplyError. Request.ClientAddr and ConnStats.ClientAddr are nil.
+type LocalDialer struct {
+	Identity string   // 限速和流量统计使用的身份，为空时为 "local"
+	Profile  *Profile // 使用的配置，为空时为默认配置
+
+	s *Server
+}
+
+var _ proxy.ContextDialer = (*LocalDialer)(nil)
+
+// Dialer returns a LocalDialer with the default profile
+func (s *Server) Dialer() *LocalDialer {
+	return &LocalDialer{s: s}
+}
+
+func (d *LocalDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *LocalDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("unsupported network %q", network)
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	s := d.s
+	profile := d.Profile
+	if profile == nil {
+		profile = s.DefaultProfile()
+	}
+	req := &Request{
+		Command:  wire.CmdConnect,
+		Identity: d.Identity,
+		Host:     host,
+		Port:     port,
+		Listener: localListener,
+		Profile:  profile,
+	}
+	sess := s.newSession(ctx, nil, nil)
+	sess.setIdentity(d.Identity)
+	sess.key = d.Identity
+	if sess.key == "" {
+		sess.key = localListener
+	}
+	sess.setRequest(req.Addr())
+	sess.with("user", d.Identity, "dest", sess.target)
+	reject := func() {
+		sess.setReason(CloseRejected)
+		s.onClose(sess)
+	}
+
+	if !profile.destinationAllowed(host) {
+		s.stats.rejected.Add(1)
+		reject()
+		return nil, &ReplyError{Code: wire.RepRulesetDenied}
+	}
+	if err := s.onRequest(req); err != nil {
+		s.stats.rejected.Add(1)
+		reject()
+		return nil, err
+	}
+	sess.setTarget(req.Addr())
+	// The ACL applies to where the connection really goes
+	if req.Host != host && !profile.destinationAllowed(req.Host) {
+		s.stats.rejected.Add(1)
+		reject()
+		return nil, &ReplyError{Code: wire.RepRulesetDenied}
+	}
+	if !s.admission.admitUser(d.Identity) {
+		s.stats.limitedPerUser.Add(1)
+		reject()
+		return nil, &ReplyError{Code: wire.RepRulesetDenied}
+	}
+	sess.open(s)
+	fail := func(reason CloseReason) {
+		sess.setReason(reason)
+		sess.close()
+		s.admission.releaseUser(d.Identity)
+		s.onClose(sess)
+	}
+	if sess.account.exceeded() {
+		s.stats.rejected.Add(1)
+		fail(CloseQuotaExceeded)
+		return nil, errQuotaExceeded
+	}
+	s.event(EventRouted, sess, nil)
+
+	if h := s.handlers[wire.CmdConnect]; h != nil {
+		return d.serveCommand(h, sess, req, fail)
+	}
+
+	// The dial span belongs to the connection's
+	ctx = sess.ctx
+	if s.timeouts.Dial > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeouts.Dial)
+		defer cancel()
+	}
+	conn, err := s.dial(ctx, req)
+	if err != nil {
+		sess.log.Warn("Failed to connect", "upstream", req.Upstream, "err", err)
+		sess.setUpstream(req.Upstream)
+		s.event(EventDialFailed, sess, err)
+		s.stats.dialFailures.Add(1)
+		fail(CloseDialFailed)
+		return nil, err
+	}
+	sess.connected(req, conn)
+	s.event(EventConnected, sess, nil)
+	sess.setCloser(func() { conn.Close() })
+	s.onConnected(req, conn)
+	return &localConn{Conn: conn, sess: sess, s: s, r: sess.reader(conn, false)}, nil
+}
+
+// serveCommand runs a CONNECT handler on one end of an in-memory pipe and
+// returns the other end once the handler has replied
+func (d *LocalDialer) serveCommand(h CommandHandler, sess *session, req *Request, fail func(CloseReason)) (net.Conn, error) {
+	s := d.s
+	client, server := net.Pipe()
+	served := make(chan CloseReason, 1)
+	go func() {
+		defer server.Close()
+		if err := h.ServeCommand(sess.ctx, server, req); err != nil && !IsConnectionClosed(err) {
+			sess.log.Warn("Command handler failed", "command", req.Command, "err", err)
+			sess.setReason(CloseError)
+			served <- CloseError
+			return
+		}
+		served <- CloseClientClosed
+	}()
+
+	var reply wire.Reply
+	_, err := reply.ReadFrom(client)
+	if err == nil && reply.Code != wire.RepSucceeded {
+		err = &ReplyError{Code: reply.Code}
+	}
+	if err != nil {
+		client.Close()
+		fail(<-served)
+		return nil, err
+	}
+	sess.setCloser(func() { client.Close() })
+	return &localConn{Conn: client, sess: sess, s: s, r: sess.reader(client, false)}, nil
+}
+
+// HTTPTransport returns a copy of http.DefaultTransport that connects with d
+func (d *LocalDialer) HTTPTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = nil
+	t.DialContext = d.DialContext
+	return t
+}
+
+// HTTPClient returns an http.Client using HTTPTransport
+func (d *LocalDialer) HTTPClient() *http.Client {
+	return &http.Client{Transport: d.HTTPTransport()}
+}
+
+// localConn meters, limits and accounts a LocalDialer connection; writes
+// are the upload direction
+type localConn struct {
+	net.Conn
+	sess *session
+	s    *Server
+	r    io.Reader
+	once sync.Once
+}
+
+func (c *localConn) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	if errors.Is(err, errQuotaExceeded) {
+		c.sess.setReason(CloseQuotaExceeded)
+	}
+	return n, err
+}
+
+func (c *localConn) Write(b []byte) (int, error) {
+	var written int
+	for len(b) > 0 {
+		chunk := c.sess.limiter.chunk(true, len(b))
+		n, err := c.Conn.Write(b[:chunk])
+		written += n
+		if n > 0 {
+			if c.sess.count(n, true) {
+				c.sess.log.Info("Traffic quota exceeded, closing connection", "key", c.sess.key)
+				c.sess.setReason(CloseQuotaExceeded)
+				c.Close()
+				return written, errQuotaExceeded
+			}
+			c.sess.limiter.wait(n, true)
+		}
+		if err != nil {
+			return written, err
+		}
+		b = b[chunk:]
+	}
+	return written, nil
+}
+
+// NetConn returns the connection to the target
+func (c *localConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *localConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() {
+		c.sess.setReason(CloseClientClosed)
+		c.sess.close()
+		c.s.admission.releaseUser(c.sess.identity)
+		c.s.onClose(c.sess)
+	})
+	return err
+}
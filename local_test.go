@@ -0,0 +1,135 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dcsunny/socks5/wire"
+)
+
+func TestLocalDialer(t *testing.T) {
+	echo := startEcho(t)
+	hook, closed := closeHook()
+	s, _ := startServer(t, ListenerConfig{}, hook,
+		rewriteHook(map[string]string{"alias.test": echo, "sneaky.test": "blocked.test:80"}),
+		WithAccounting(AccountingConfig{UserQuotas: map[string]Quota{"billing": {Daily: 20}}}))
+	d := s.Dialer()
+	d.Identity = "billing"
+	d.Profile = &Profile{DenyDestinations: []string{"blocked.test"}}
+
+	// Hooks see the connection like a SOCKS request
+	conn, err := d.Dial("tcp", "alias.test:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoThrough(t, conn, "hello")
+	conn.Close()
+	stats := nextClose(t, closed)
+	if stats.Listener != localListener || stats.Identity != "billing" || stats.Target != echo ||
+		stats.Upload != 5 || stats.Download != 5 || stats.Reason != CloseClientClosed {
+		t.Errorf("stats = %+v", stats)
+	}
+
+	// The ACL applies, before and after a rewrite
+	for _, dest := range []string{"blocked.test:80", "sneaky.test:80"} {
+		if _, err := d.Dial("tcp", dest); replyCode(err) != int(wire.RepRulesetDenied) {
+			t.Errorf("Dial %s: %v, want ruleset denied", dest, err)
+		}
+		if stats := nextClose(t, closed); stats.Reason != CloseRejected {
+			t.Errorf("reason = %s, want %s", stats.Reason, CloseRejected)
+		}
+	}
+	if _, err := d.Dial("tcp", "refused.test:80"); replyCode(err) != int(wire.RepHostUnreachable) {
+		t.Errorf("err = %v, want host unreachable", err)
+	}
+	nextClose(t, closed)
+
+	// So does the quota of the identity
+	conn, err = d.Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoThrough(t, conn, "hello")
+	conn.Close()
+	nextClose(t, closed)
+	if u := s.Usage()["billing"]; u.Upload != 10 || u.Download != 10 {
+		t.Errorf("usage = %+v, want 10 bytes each way", u)
+	}
+	if _, err := d.Dial("tcp", echo); !errors.Is(err, errQuotaExceeded) {
+		t.Errorf("err = %v, want the quota exceeded", err)
+	}
+	if stats := nextClose(t, closed); stats.Reason != CloseQuotaExceeded {
+		t.Errorf("reason = %s, want %s", stats.Reason, CloseQuotaExceeded)
+	}
+}
+
+func TestLocalDialerHTTP(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "hello over "+r.Host)
+	}))
+	defer target.Close()
+	hook, closed := closeHook()
+	s, _ := startServer(t, ListenerConfig{}, hook)
+
+	client := s.Dialer().HTTPClient()
+	defer client.CloseIdleConnections()
+	resp, err := client.Get(target.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if want := "hello over " + target.Listener.Addr().String(); string(body) != want {
+		t.Errorf("body = %q, want %q", body, want)
+	}
+	client.CloseIdleConnections()
+	if stats := nextClose(t, closed); stats.Listener != localListener || stats.Target != target.Listener.Addr().String() {
+		t.Errorf("stats = %+v, want a local connection to the target", stats)
+	}
+}
+
+func TestLocalDialerCommandHandler(t *testing.T) {
+	// The CONNECT handler serves local connections like SOCKS ones
+	requests := make(chan *Request, 2)
+	handler := CommandHandlerFunc(func(ctx context.Context, conn net.Conn, req *Request) error {
+		requests <- req
+		if req.Host != "mock.test" {
+			return writeReply(conn, wire.RepHostUnreachable, nil)
+		}
+		if err := writeReply(conn, wire.RepSucceeded, nil); err != nil {
+			return err
+		}
+		_, err := io.Copy(conn, conn)
+		return err
+	})
+	hook, closed := closeHook()
+	s, _ := startServer(t, ListenerConfig{}, WithCommandHandler(wire.CmdConnect, handler), hook)
+	d := s.Dialer()
+
+	conn, err := d.Dial("tcp", "mock.test:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req := <-requests; req.Listener != localListener || req.ClientAddr != nil {
+		t.Errorf("request from %s, client %v; want %s and no client address", req.Listener, req.ClientAddr, localListener)
+	}
+	echoThrough(t, conn, "hello")
+	conn.Close()
+	if stats := nextClose(t, closed); stats.Reason != CloseClientClosed || stats.ClientAddr != nil ||
+		stats.Upload != 5 || stats.Download != 5 {
+		t.Errorf("stats = %+v", stats)
+	}
+
+	if _, err := d.Dial("tcp", "elsewhere.test:80"); replyCode(err) != int(wire.RepHostUnreachable) {
+		t.Errorf("err = %v, want host unreachable", err)
+	}
+	<-requests
+	if stats := nextClose(t, closed); stats.Target != "elsewhere.test:80" {
+		t.Errorf("closed %s, want elsewhere.test:80", stats.Target)
+	}
+}
@@ -0,0 +1,203 @@
+package socks5
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// maxUpstreamLabels bounds the upstream label; routes and hooks may use any
+// number of proxies, the ones beyond this are counted as "other"
+const maxUpstreamLabels = 64
+
+// WithMetrics registers Prometheus metrics of the server with reg. Labels
+// are bounded: listeners, upstreams, reply codes and close reasons, never
+// users or destinations.
+func WithMetrics(reg prometheus.Registerer) Option {
+	return func(s *Server) {
+		s.metrics = newMetrics(reg, s)
+	}
+}
+
+// metrics are the Prometheus collectors of a Server. A nil *metrics
+// records nothing.
+type metrics struct {
+	connections *prometheus.CounterVec
+	auth        *prometheus.CounterVec
+	bytes       *prometheus.CounterVec
+	dial        *prometheus.HistogramVec
+	handshake   *prometheus.HistogramVec
+	systemProxy *prometheus.CounterVec
+
+	mu        sync.Mutex
+	upstreams map[string]struct{}
+}
+
+func newMetrics(reg prometheus.Registerer, s *Server) *metrics {
+	m := &metrics{
+		connections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "socks5_connections_total",
+			Help: "Finished connections by listener, reply code and close reason.",
+		}, []string{"listener", "reply", "reason"}),
+		auth: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "socks5_auth_total",
+			Help: "Authentications by listener, method and result.",
+		}, []string{"listener", "method", "result"}),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "socks5_bytes_total",
+			Help: "Bytes forwarded by direction and upstream.",
+		}, []string{"direction", "upstream"}),
+		dial: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "socks5_dial_duration_seconds",
+			Help:    "Time to connect to the target by upstream and result.",
+			Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+		}, []string{"upstream", "result"}),
+		handshake: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "socks5_handshake_duration_seconds",
+			Help:    "Time from accepting a connection to reading its request.",
+			Buckets: []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+		}, []string{"listener"}),
+		systemProxy: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "socks5_system_proxy_lookups_total",
+			Help: "System proxy lookups by result: proxy, none or error.",
+		}, []string{"result"}),
+		upstreams: make(map[string]struct{}),
+	}
+	reg.MustRegister(
+		m.connections, m.auth, m.bytes, m.dial, m.handshake, m.systemProxy,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "socks5_active_connections",
+			Help: "Connections currently open.",
+		}, func() float64 { return float64(s.stats.active.Load()) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "socks5_accepted_connections_total",
+			Help: "Connections accepted by all listeners.",
+		}, func() float64 { return float64(s.stats.accepted.Load()) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "socks5_rejected_connections_total",
+			Help: "Connections refused by ACLs, hooks or traffic quotas.",
+		}, func() float64 { return float64(s.stats.rejected.Load()) }),
+	)
+	// One series per connection limit
+	for limit, counter := range map[string]*atomic.Uint64{
+		"rate":     &s.stats.limitedRate,
+		"ip":       &s.stats.limitedPerIP,
+		"listener": &s.stats.limitedListener,
+		"total":    &s.stats.limitedTotal,
+		"user":     &s.stats.limitedPerUser,
+	} {
+		reg.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name:        "socks5_limited_connections_total",
+			Help:        "Connections refused by a connection limit: rate and ip per client IP, listener per listener, total for the whole server, user per user.",
+			ConstLabels: prometheus.Labels{"limit": limit},
+		}, func() float64 { return float64(counter.Load()) }))
+	}
+	return m
+}
+
+// upstream returns the label for an upstream, keeping the number of
+// distinct values bounded
+func (m *metrics) upstream(u string) string {
+	if u == "" {
+		return "none"
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.upstreams[u]; ok {
+		return u
+	}
+	if len(m.upstreams) >= maxUpstreamLabels {
+		return "other"
+	}
+	m.upstreams[u] = struct{}{}
+	return u
+}
+
+func (m *metrics) closed(stats *ConnStats) {
+	if m == nil {
+		return
+	}
+	reply := "none"
+	if stats.Reply >= 0 {
+		reply = strconv.Itoa(stats.Reply)
+	}
+	m.connections.WithLabelValues(stats.Listener, reply, string(stats.Reason)).Inc()
+}
+
+// authenticated counts an authentication; method is none, password or
+// certificate
+func (m *metrics) authenticated(listener, method string, ok bool) {
+	if m == nil {
+		return
+	}
+	result := "success"
+	if !ok {
+		result = "failure"
+	}
+	m.auth.WithLabelValues(listener, method, result).Inc()
+}
+
+func (m *metrics) handshaked(listener string, start time.Time) {
+	if m == nil {
+		return
+	}
+	m.handshake.WithLabelValues(listener).Observe(time.Since(start).Seconds())
+}
+
+func (m *metrics) dialed(upstream string, start time.Time, err error) {
+	if m == nil {
+		return
+	}
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	m.dial.WithLabelValues(m.upstream(upstream), result).Observe(time.Since(start).Seconds())
+}
+
+func (m *metrics) systemProxyLookup(info *ProxyInfo, err error) {
+	if m == nil {
+		return
+	}
+	result := "none"
+	switch {
+	case err != nil:
+		result = "error"
+	case info.Enabled:
+		result = "proxy"
+	}
+	m.systemProxy.WithLabelValues(result).Inc()
+}
+
+// traffic returns the byte counters of a connection through upstream
+func (m *metrics) traffic(upstream string) *traffic {
+	if m == nil {
+		return nil
+	}
+	u := m.upstream(upstream)
+	return &traffic{
+		upload:   m.bytes.WithLabelValues("upload", u),
+		download: m.bytes.WithLabelValues("download", u),
+	}
+}
+
+// traffic counts the bytes of one connection, looked up once so that
+// forwarding does not hash labels for every read
+type traffic struct {
+	upload   prometheus.Counter
+	download prometheus.Counter
+}
+
+func (t *traffic) add(n int, upload bool) {
+	if t == nil {
+		return
+	}
+	if upload {
+		t.upload.Add(float64(n))
+	} else {
+		t.download.Add(float64(n))
+	}
+}
@@ -0,0 +1,81 @@
+package socks5
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// counterValue returns the value of the counter name with the given limit
+// label, or the unlabelled one when limit is empty
+func counterValue(t *testing.T, reg *prometheus.Registry, name, limit string) float64 {
+	t.Helper()
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			var got string
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "limit" {
+					got = l.GetValue()
+				}
+			}
+			if got == limit {
+				return m.GetCounter().GetValue()
+			}
+		}
+	}
+	t.Fatalf("no %s{limit=%q}", name, limit)
+	return 0
+}
+
+func TestLimitMetrics(t *testing.T) {
+	echo := startEcho(t)
+	reg := prometheus.NewRegistry()
+	hook, closed := closeHook()
+	_, addr := startServer(t, ListenerConfig{Profile: &Profile{
+		MaxConns:         1,
+		DenyDestinations: []string{"blocked.example"},
+	}}, hook, WithMetrics(reg))
+
+	for _, limit := range []string{"rate", "ip", "listener", "total", "user"} {
+		if v := counterValue(t, reg, "socks5_limited_connections_total", limit); v != 0 {
+			t.Errorf("limited{%s} = %v before any limit", limit, v)
+		}
+	}
+
+	// The listener serves one connection at a time
+	conn, err := (&Dialer{ProxyAddr: addr}).Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	over, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = over.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := over.Read(make([]byte, 1)); err == nil {
+		t.Fatal("connection over the listener limit served")
+	}
+	over.Close()
+	if v := counterValue(t, reg, "socks5_limited_connections_total", "listener"); v != 1 {
+		t.Errorf("limited{listener} = %v, want 1", v)
+	}
+	conn.Close()
+	nextClose(t, closed)
+
+	if _, err := (&Dialer{ProxyAddr: addr}).Dial("tcp", "blocked.example:80"); err == nil {
+		t.Fatal("denied destination reached")
+	}
+	nextClose(t, closed)
+	if v := counterValue(t, reg, "socks5_rejected_connections_total", ""); v != 1 {
+		t.Errorf("rejected = %v, want 1", v)
+	}
+}
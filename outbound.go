@@ -0,0 +1,212 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Request is an outbound connection a client asked for
+type Request struct {
+	Command    byte     // wire.CmdConnect 等
+	Identity   string   // 认证的用户名或客户端证书身份，未认证时为空
+	ClientAddr net.Addr // 客户端地址，经过 PROXY protocol 时为真实地址，LocalDialer 的连接为 nil
+	Host       string   // 客户端请求的目标，域名或 IP
+	Port       string
+	Listener   string   // 接受连接的监听器
+	Profile    *Profile // 该监听器的配置
+	Route      *Route   // OnRequest 指定时代替按目标匹配的路由
+	Upstream   string   // 实际使用的上游：direct、代理地址，由 DefaultDialer 填写
+
+	downProxy *DownProxyInfo
+}
+
+// Addr returns the destination as host:port
+func (r *Request) Addr() string {
+	return net.JoinHostPort(r.Host, r.Port)
+}
+
+// OutboundDialer connects to the destination of a request
+type OutboundDialer interface {
+	DialContext(ctx context.Context, req *Request) (net.Conn, error)
+}
+
+// Resolver looks up the addresses of a host name; *net.Resolver implements it
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// WithDialer replaces the DefaultDialer used to connect to destinations
+func WithDialer(d OutboundDialer) Option {
+	return func(s *Server) {
+		s.dialer = d
+	}
+}
+
+// WithResolver sets the resolver of the DefaultDialer
+func WithResolver(r Resolver) Option {
+	return func(s *Server) {
+		s.resolver = r
+	}
+}
+
+// DefaultDialer connects the way the request's profile says: through a
+// matching route, the downstream proxy, the system proxy or directly
+type DefaultDialer struct {
+	Resolver Resolver     // 直连时解析域名，为空时使用系统解析
+	Logger   *slog.Logger // 为空时使用 slog.Default()
+
+	metrics *metrics
+}
+
+func (d *DefaultDialer) logger() *slog.Logger {
+	if d.Logger == nil {
+		return slog.Default()
+	}
+	return d.Logger
+}
+
+func (d *DefaultDialer) DialContext(ctx context.Context, req *Request) (net.Conn, error) {
+	profile := req.Profile
+	if profile == nil {
+		profile = &Profile{}
+	}
+	route := req.Route
+	if route == nil {
+		route = profile.route(req.Host)
+	}
+	if route != nil && route.Upstream != "" {
+		switch route.Upstream {
+		case UpstreamDirect:
+			return d.dialDirect(ctx, route, req)
+		case UpstreamSystem:
+			return d.dialSystem(ctx, route, req)
+		default:
+			return d.useDownProxy(ctx, parseDownProxy(route.Upstream), req)
+		}
+	}
+
+	//二级代理的优先级高于系统代理
+	downProxy := req.downProxy
+	if downProxy == nil {
+		downProxy = parseDownProxy(profile.DownProxy)
+	}
+	if downProxy.Enabled {
+		return d.useDownProxy(ctx, downProxy, req)
+	}
+	if !profile.SystemProxy {
+		return d.dialDirect(ctx, route, req)
+	}
+	return d.dialSystem(ctx, route, req)
+}
+
+// dialSystem connects through the system proxy, or directly when none is set
+func (d *DefaultDialer) dialSystem(ctx context.Context, route *Route, req *Request) (net.Conn, error) {
+	_, span := startSpan(ctx, "socks5.system_proxy")
+	sysProxy, err := GetSystemProxy()
+	d.metrics.systemProxyLookup(sysProxy, err)
+	if err == nil && sysProxy.Enabled {
+		span.SetAttributes(attribute.String("socks5.proxy", redactURL(sysProxy.Addr)))
+	}
+	endSpan(span, err)
+	if err != nil {
+		d.logger().Error("Failed to get system proxy", "err", err)
+		return nil, err
+	}
+	if !sysProxy.Enabled {
+		return d.dialDirect(ctx, route, req)
+	}
+
+	return d.useSystemProxy(ctx, sysProxy, req)
+}
+
+// dialDirect connects to the target, prepending a PROXY header if the route asks for one
+func (d *DefaultDialer) dialDirect(ctx context.Context, route *Route, req *Request) (net.Conn, error) {
+	req.Upstream = UpstreamDirect
+	conn, err := d.dialTCP(ctx, req.Host, req.Port)
+	if err != nil {
+		return nil, err
+	}
+	if route == nil || route.ProxyProtocol == 0 {
+		return conn, nil
+	}
+	authority := ""
+	if net.ParseIP(req.Host) == nil {
+		authority = req.Host
+	}
+	if err := writeProxyHeader(conn, route.ProxyProtocol, req.ClientAddr, conn.RemoteAddr(), authority); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to write PROXY header: %v", err)
+	}
+	return conn, nil
+}
+
+// dialTCP resolves host and connects to its addresses in turn
+func (d *DefaultDialer) dialTCP(ctx context.Context, host, port string) (net.Conn, error) {
+	var nd net.Dialer
+	if net.ParseIP(host) != nil {
+		return nd.DialContext(ctx, "tcp", net.JoinHostPort(host, port))
+	}
+	resolver := d.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	resolveCtx, span := startSpan(ctx, "socks5.resolve", attribute.String("socks5.host", host))
+	addrs, err := resolver.LookupIPAddr(resolveCtx, host)
+	if err == nil && len(addrs) == 0 {
+		err = fmt.Errorf("no addresses for %s", host)
+	}
+	span.SetAttributes(attribute.Int("socks5.addresses", len(addrs)))
+	endSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+	var errs []error
+	for _, addr := range addrs {
+		conn, err := nd.DialContext(ctx, "tcp", net.JoinHostPort(addr.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, errors.Join(errs...)
+}
+
+func (d *DefaultDialer) useDownProxy(ctx context.Context, downProxyInfo *DownProxyInfo, req *Request) (net.Conn, error) {
+	req.Upstream = redactURL(downProxyInfo.Addr)
+	d.logger().Debug("Using downstream proxy", "proxy", req.Upstream, "dest", req.Addr())
+	switch downProxyInfo.ProxyType {
+	case "http", "https", "socks5":
+		return connectViaProxy(ctx, downProxyInfo.Addr, req.Host, req.Port)
+	}
+	err := fmt.Errorf("unsupported downstream proxy type: %s", downProxyInfo.ProxyType)
+	return nil, err
+}
+
+func (d *DefaultDialer) useSystemProxy(ctx context.Context, sysProxy *ProxyInfo, req *Request) (net.Conn, error) {
+	req.Upstream = redactURL(sysProxy.Addr)
+	d.logger().Debug("Using system proxy", "proxy", req.Upstream, "dest", req.Addr())
+	switch sysProxy.ProxyType {
+	case "http", "https", "socks5":
+		return connectViaProxy(ctx, sysProxy.Addr, req.Host, req.Port)
+	}
+	err := fmt.Errorf("unsupported system proxy type: %s", sysProxy.ProxyType)
+	return nil, err
+}
+
+// redactURL hides the password of a proxy URL
+func redactURL(addr string) string {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return addr
+	}
+	return u.Redacted()
+}
@@ -0,0 +1,86 @@
+//go:build !windows
+// +build !windows
+
+package socks5
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// DropPrivileges switches the process to the given user and group. It is
+// meant to be called after the listeners are bound. An empty group uses the
+// primary group of the user.
+func DropPrivileges(username, group string) error {
+	if username == "" && group == "" {
+		return nil
+	}
+	uid, gid, err := lookupIDs(username, group)
+	if err != nil {
+		return err
+	}
+
+	// Already switched, e.g. a process started by Upgrade after dropping
+	if (uid < 0 || uid == syscall.Getuid()) && gid == syscall.Getgid() && syscall.Geteuid() != 0 {
+		return nil
+	}
+
+	// Group must change first, we lose the right to do so with the user
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		return fmt.Errorf("setgroups: %v", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("setgid: %v", err)
+	}
+	if uid >= 0 {
+		if err := syscall.Setuid(uid); err != nil {
+			return fmt.Errorf("setuid: %v", err)
+		}
+	}
+	return nil
+}
+
+// ChownForUser gives path to the user and group DropPrivileges switches
+// to, so that the process can still rewrite it, e.g. a pidfile after an
+// upgrade. Only root can and needs to; others leave the file as it is.
+func ChownForUser(path, username, group string) error {
+	if (username == "" && group == "") || os.Geteuid() != 0 {
+		return nil
+	}
+	uid, gid, err := lookupIDs(username, group)
+	if err != nil {
+		return err
+	}
+	return os.Chown(path, uid, gid)
+}
+
+// lookupIDs resolves the user and group, -1 for the uid when username is
+// empty. The gid defaults to the primary group of the user.
+func lookupIDs(username, group string) (int, int, error) {
+	uid, gid := -1, -1
+	if username != "" {
+		u, err := user.Lookup(username)
+		if err != nil {
+			return 0, 0, err
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return 0, 0, fmt.Errorf("unsupported uid %q: %v", u.Uid, err)
+		}
+		if gid, err = strconv.Atoi(u.Gid); err != nil {
+			return 0, 0, fmt.Errorf("unsupported gid %q: %v", u.Gid, err)
+		}
+	}
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			return 0, 0, err
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return 0, 0, fmt.Errorf("unsupported gid %q: %v", g.Gid, err)
+		}
+	}
+	return uid, gid, nil
+}
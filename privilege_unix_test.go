@@ -0,0 +1,97 @@
+//go:build !windows
+
+package socks5
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+// privilegeChildEnv makes the test binary drop to the user it names
+const privilegeChildEnv = "SOCKS5_TEST_PRIVILEGE_CHILD"
+
+// privilegeChild drops to username twice: the second call finds the
+// process already switched
+func privilegeChild(username string) {
+	fail := func(err error) {
+		fmt.Fprintln(os.Stderr, "privilege child:", err)
+		os.Exit(1)
+	}
+	u, err := user.Lookup(username)
+	if err != nil {
+		fail(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := DropPrivileges(username, ""); err != nil {
+			fail(err)
+		}
+		if uid := strconv.Itoa(os.Getuid()); uid != u.Uid || strconv.Itoa(os.Getgid()) != u.Gid {
+			fail(fmt.Errorf("running as %s:%d, want %s:%s", uid, os.Getgid(), u.Uid, u.Gid))
+		}
+	}
+	os.Exit(0)
+}
+
+func TestDropPrivileges(t *testing.T) {
+	if err := DropPrivileges("", ""); err != nil {
+		t.Errorf("without a user: %v", err)
+	}
+	if err := DropPrivileges("no-such-user-socks5", ""); err == nil {
+		t.Error("dropped to an unknown user")
+	}
+
+	if os.Geteuid() != 0 {
+		// Already running as the user
+		u, err := user.Current()
+		if err != nil {
+			t.Skip(err)
+		}
+		if err := DropPrivileges(u.Username, ""); err != nil {
+			t.Errorf("DropPrivileges(%s) = %v", u.Username, err)
+		}
+		return
+	}
+	if _, err := user.Lookup("nobody"); err != nil {
+		t.Skip(err)
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	cmd.Env = append(os.Environ(), privilegeChildEnv+"=nobody")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Errorf("%v: %s", err, out)
+	}
+}
+
+func TestChownForUser(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "socks5.pid")
+	if err := WritePidFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := ChownForUser(path, "", ""); err != nil {
+		t.Errorf("without a user: %v", err)
+	}
+	u, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip(err)
+	}
+	if err := ChownForUser(path, "nobody", ""); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only root changes the owner
+	want := strconv.Itoa(os.Getuid())
+	if os.Geteuid() == 0 {
+		want = u.Uid
+	}
+	if uid := strconv.FormatUint(uint64(fi.Sys().(*syscall.Stat_t).Uid), 10); uid != want {
+		t.Errorf("owner = %s, want %s", uid, want)
+	}
+}
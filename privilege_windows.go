@@ -0,0 +1,19 @@
+//go:build windows
+// +build windows
+
+package socks5
+
+import "errors"
+
+// DropPrivileges is not supported on Windows
+func DropPrivileges(username, group string) error {
+	if username == "" && group == "" {
+		return nil
+	}
+	return errors.New("dropping privileges is not supported on windows")
+}
+
+// ChownForUser does nothing on Windows, DropPrivileges is not supported
+func ChownForUser(path, username, group string) error {
+	return nil
+}
@@ -5,10 +5,12 @@ import (
 	"fmt"
 	"runtime"
 	"time"
+
+	"github.com/dcsunny/socks5/wire"
 )
 
 const (
-	Socks5Version = uint8(5)
+	Socks5Version = wire.Version
 )
 
 // ProxyInfo stores proxy configuration
@@ -1,29 +1,23 @@
 package socks5
 
 import (
-	"fmt"
-	"log"
+	"context"
 	"net"
-	"net/url"
 	"strings"
 )
 
 // ConnectViaProxy connects to the target through an proxy
 func ConnectViaProxy(proxyAddr, targetHost, targetPort string) (net.Conn, error) {
-	proxyURL, err := url.Parse(proxyAddr)
-	if err != nil {
-		log.Printf("Error parsing proxy URL:%s", err)
-		return nil, err
-	}
-	remoteAddr := fmt.Sprintf("%s:%s", targetHost, targetPort)
-	dialer := &ProxyDialer{ProxyUrl: proxyURL}
-	var conn net.Conn
-	conn, err = dialer.Dial("tcp", remoteAddr)
+	return connectViaProxy(context.Background(), proxyAddr, targetHost, targetPort)
+}
+
+// connectViaProxy is ConnectViaProxy giving up when ctx is done
+func connectViaProxy(ctx context.Context, proxyAddr, targetHost, targetPort string) (net.Conn, error) {
+	dialer, err := proxyDialerFor(proxyAddr)
 	if err != nil {
-		log.Print(err)
 		return nil, err
 	}
-	return conn, nil
+	return dialer.DialContext(ctx, "tcp", net.JoinHostPort(targetHost, targetPort))
 }
 
 // IsConnectionClosed checks if an error is related to a closed connection
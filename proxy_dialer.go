@@ -1,47 +1,184 @@
 package socks5
 
 import (
+	"bufio"
 	"context"
+	"crypto/tls"
+	"encoding/base64"
 	"errors"
+	"fmt"
 	"net"
 	"net/http"
 	"net/url"
+	"sync"
 	"time"
 
 	"golang.org/x/net/proxy"
 )
 
+// ProxyDialer connects to targets through an upstream proxy. It implements
+// proxy.ContextDialer and may be reused for any number of connections.
 type ProxyDialer struct {
 	ProxyUrl *url.URL
+	Timeout  time.Duration // 连接代理服务器的超时时间，0 表示不限制
+
+	once   sync.Once
+	dialer proxy.ContextDialer
+	err    error
+}
+
+var _ proxy.ContextDialer = (*ProxyDialer)(nil)
+
+// proxyDialers caches one ProxyDialer per upstream URL
+var proxyDialers sync.Map
+
+// proxyDialerFor returns the shared ProxyDialer of an upstream URL
+func proxyDialerFor(proxyAddr string) (*ProxyDialer, error) {
+	if d, ok := proxyDialers.Load(proxyAddr); ok {
+		return d.(*ProxyDialer), nil
+	}
+	proxyURL, err := url.Parse(proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	d, _ := proxyDialers.LoadOrStore(proxyAddr, &ProxyDialer{ProxyUrl: proxyURL})
+	return d.(*ProxyDialer), nil
 }
 
 func (s *ProxyDialer) Dial(network, addr string) (net.Conn, error) {
-	var transport *http.Transport
+	return s.DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to addr through the proxy, giving up when ctx is done
+func (s *ProxyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	s.once.Do(s.init)
+	if s.err != nil {
+		return nil, s.err
+	}
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Timeout)
+		defer cancel()
+	}
+	return s.dialer.DialContext(ctx, network, addr)
+}
+
+func (s *ProxyDialer) init() {
 	if s.ProxyUrl == nil {
-		return nil, errors.New("not set proxy url")
+		s.err = errors.New("not set proxy url")
+		return
+	}
+	switch s.ProxyUrl.Scheme {
+	case "http", "https":
+		s.dialer = &httpConnectDialer{proxyURL: s.ProxyUrl}
+		return
+	case "socks5", "socks5h":
+		d, err := NewDialer(s.ProxyUrl)
+		if err != nil {
+			s.err = err
+			return
+		}
+		// Upstreams have always been handed the domain name, keep that
+		// for socks5:// as well
+		d.ResolveLocally = false
+		s.dialer = d
+		return
+	}
+	dialer, err := proxy.FromURL(s.ProxyUrl, &net.Dialer{})
+	if err != nil {
+		s.err = err
+		return
+	}
+	cd, ok := dialer.(proxy.ContextDialer)
+	if !ok {
+		s.err = fmt.Errorf("proxy scheme %s does not support cancellation", s.ProxyUrl.Scheme)
+		return
 	}
-	dialer, err := proxy.FromURL(s.ProxyUrl, proxy.Direct)
+	s.dialer = cd
+}
+
+// httpConnectDialer tunnels through an HTTP or HTTPS proxy with CONNECT
+type httpConnectDialer struct {
+	proxyURL *url.URL
+}
+
+func (d *httpConnectDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host := d.proxyURL.Host
+	if d.proxyURL.Port() == "" {
+		port := "80"
+		if d.proxyURL.Scheme == "https" {
+			port = "443"
+		}
+		host = net.JoinHostPort(d.proxyURL.Hostname(), port)
+	}
+	var nd net.Dialer
+	conn, err := nd.DialContext(ctx, "tcp", host)
 	if err != nil {
 		return nil, err
 	}
-	transport = &http.Transport{
-		DialContext:           s.defaultTransportDialContext(dialer),
-		ForceAttemptHTTP2:     true,
-		MaxIdleConns:          100,
-		IdleConnTimeout:       90 * time.Second,
-		TLSHandshakeTimeout:   10 * time.Second,
-		ExpectContinueTimeout: 1 * time.Second,
+	if d.proxyURL.Scheme == "https" {
+		conn = tls.Client(conn, &tls.Config{ServerName: d.proxyURL.Hostname()})
 	}
 
-	conn, err := transport.DialContext(context.Background(), network, addr)
+	// Abort the CONNECT exchange when ctx is done
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Unix(1, 0))
+	})
+	conn, err = d.connect(conn, addr)
+	if !stop() {
+		if conn != nil {
+			conn.Close()
+		}
+		return nil, ctx.Err()
+	}
+	return conn, err
+}
+
+func (d *httpConnectDialer) connect(conn net.Conn, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if u := d.proxyURL.User; u != nil {
+		password, _ := u.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(u.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy CONNECT %s: %s", addr, resp.Status)
+	}
+	if br.Buffered() > 0 {
+		// The target spoke first, keep what the proxy sent along
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
 	return conn, nil
 }
 
-func (s *ProxyDialer) defaultTransportDialContext(dialer proxy.Dialer) func(context.Context, string, string) (net.Conn, error) {
-	return func(ctx context.Context, network, addr string) (net.Conn, error) {
-		return dialer.Dial(network, addr)
-	}
+// bufferedConn is a connection with data already read into r
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// NetConn returns the underlying connection
+func (c *bufferedConn) NetConn() net.Conn {
+	return c.Conn
 }
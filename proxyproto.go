@@ -0,0 +1,338 @@
+package socks5
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// PROXY protocol v2 signature
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// PROXY protocol v2 TLV types
+const (
+	PP2TypeALPN      = byte(0x01)
+	PP2TypeAuthority = byte(0x02)
+	PP2TypeCRC32C    = byte(0x03)
+	PP2TypeNoop      = byte(0x04)
+	PP2TypeUniqueID  = byte(0x05)
+	PP2TypeSSL       = byte(0x20)
+	PP2SubTypeSSLVer = byte(0x21)
+	PP2SubTypeSSLCN  = byte(0x22)
+	PP2SubTypeCipher = byte(0x23)
+	PP2TypeNetNS     = byte(0x30)
+)
+
+// ProxyTLV is a type-length-value extension of a PROXY v2 header
+type ProxyTLV struct {
+	Type  byte
+	Value []byte
+}
+
+// ProxyHeader is a parsed PROXY protocol header
+type ProxyHeader struct {
+	Version     int      // 1 或 2
+	Local       bool     // LOCAL 命令或 UNKNOWN，地址为负载均衡器自身
+	Source      net.Addr // 真实客户端地址
+	Destination net.Addr // 客户端连接的地址
+	TLVs        []ProxyTLV
+}
+
+// TLV returns the value of the first TLV of the given type
+func (h *ProxyHeader) TLV(typ byte) ([]byte, bool) {
+	for _, tlv := range h.TLVs {
+		if tlv.Type == typ {
+			return tlv.Value, true
+		}
+	}
+	return nil, false
+}
+
+// Authority returns the host name the client asked for, usually the SNI
+func (h *ProxyHeader) Authority() string {
+	v, _ := h.TLV(PP2TypeAuthority)
+	return string(v)
+}
+
+// ProxySSL is the content of a PP2_TYPE_SSL TLV
+type ProxySSL struct {
+	Client   byte // PP2_CLIENT_SSL、PP2_CLIENT_CERT_CONN、PP2_CLIENT_CERT_SESS 标志位
+	Verified bool // 客户端证书校验通过
+	Version  string
+	CN       string
+	Cipher   string
+}
+
+// SSL returns the TLS details reported by the upstream, if any
+func (h *ProxyHeader) SSL() (*ProxySSL, bool) {
+	v, ok := h.TLV(PP2TypeSSL)
+	if !ok || len(v) < 5 {
+		return nil, false
+	}
+	ssl := &ProxySSL{
+		Client:   v[0],
+		Verified: binary.BigEndian.Uint32(v[1:5]) == 0,
+	}
+	subs, err := parseTLVs(v[5:])
+	if err != nil {
+		return ssl, true
+	}
+	for _, sub := range subs {
+		switch sub.Type {
+		case PP2SubTypeSSLVer:
+			ssl.Version = string(sub.Value)
+		case PP2SubTypeSSLCN:
+			ssl.CN = string(sub.Value)
+		case PP2SubTypeCipher:
+			ssl.Cipher = string(sub.Value)
+		}
+	}
+	return ssl, true
+}
+
+// proxyConn is a connection whose addresses come from a PROXY header
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	header *ProxyHeader
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// NetConn returns the connection the header was read from
+func (c *proxyConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// RemoteAddr returns the client address of the header. Unix addresses say
+// nothing about where the client is, the upstream's own address stands in.
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if _, ok := c.header.Source.(*net.TCPAddr); c.header.Local || !ok {
+		return c.Conn.RemoteAddr()
+	}
+	return c.header.Source
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	if _, ok := c.header.Destination.(*net.TCPAddr); c.header.Local || !ok {
+		return c.Conn.LocalAddr()
+	}
+	return c.header.Destination
+}
+
+// ProxyHeaderOf returns the PROXY header a connection was received with
+func ProxyHeaderOf(conn net.Conn) *ProxyHeader {
+	for {
+		switch c := conn.(type) {
+		case *proxyConn:
+			return c.header
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return nil
+		}
+	}
+}
+
+// readProxyHeader wraps conn after consuming its PROXY v1 or v2 header
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	r := bufio.NewReader(conn)
+	sig, err := r.Peek(len(proxyV2Sig))
+	if err != nil {
+		return nil, err
+	}
+	var header *ProxyHeader
+	switch {
+	case bytes.Equal(sig, proxyV2Sig):
+		header, err = readProxyV2(r)
+	case bytes.HasPrefix(sig, []byte("PROXY ")):
+		header, err = readProxyV1(r)
+	default:
+		return nil, errors.New("missing PROXY protocol header")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: conn, r: r, header: header}, nil
+}
+
+func readProxyV1(r *bufio.Reader) (*ProxyHeader, error) {
+	// The line is at most 107 bytes including CRLF
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("invalid PROXY v1 header")
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	header := &ProxyHeader{Version: 1}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		header.Local = true
+		return header, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid PROXY v1 header: %q", line)
+	}
+	srcIP, dstIP := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	srcPort, err1 := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, err2 := strconv.ParseUint(fields[5], 10, 16)
+	if srcIP == nil || dstIP == nil || err1 != nil || err2 != nil {
+		return nil, fmt.Errorf("invalid PROXY v1 header: %q", line)
+	}
+	header.Source = &net.TCPAddr{IP: srcIP, Port: int(srcPort)}
+	header.Destination = &net.TCPAddr{IP: dstIP, Port: int(dstPort)}
+	return header, nil
+}
+
+func readProxyV2(r *bufio.Reader) (*ProxyHeader, error) {
+	fixed := make([]byte, 16)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, err
+	}
+	if fixed[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY v2 version: %d", fixed[12]>>4)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(fixed[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	header := &ProxyHeader{Version: 2}
+	switch fixed[12] & 0x0f {
+	case 0: // LOCAL
+		header.Local = true
+		return header, nil
+	case 1: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported PROXY v2 command: %d", fixed[12]&0x0f)
+	}
+
+	var rest []byte
+	switch fixed[13] {
+	case 0x11, 0x12: // TCP or UDP over IPv4
+		if len(payload) < 12 {
+			return nil, errors.New("short PROXY v2 IPv4 address")
+		}
+		header.Source = &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}
+		header.Destination = &net.TCPAddr{IP: net.IP(payload[4:8]), Port: int(binary.BigEndian.Uint16(payload[10:12]))}
+		rest = payload[12:]
+	case 0x21, 0x22: // TCP or UDP over IPv6
+		if len(payload) < 36 {
+			return nil, errors.New("short PROXY v2 IPv6 address")
+		}
+		header.Source = &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}
+		header.Destination = &net.TCPAddr{IP: net.IP(payload[16:32]), Port: int(binary.BigEndian.Uint16(payload[34:36]))}
+		rest = payload[36:]
+	case 0x31, 0x32: // unix stream or datagram
+		if len(payload) < 216 {
+			return nil, errors.New("short PROXY v2 unix address")
+		}
+		header.Source = &net.UnixAddr{Name: string(bytes.TrimRight(payload[0:108], "\x00")), Net: "unix"}
+		header.Destination = &net.UnixAddr{Name: string(bytes.TrimRight(payload[108:216], "\x00")), Net: "unix"}
+		rest = payload[216:]
+	default: // UNSPEC
+		header.Local = true
+		return header, nil
+	}
+
+	tlvs, err := parseTLVs(rest)
+	if err != nil {
+		return nil, err
+	}
+	header.TLVs = tlvs
+	return header, nil
+}
+
+func parseTLVs(b []byte) ([]ProxyTLV, error) {
+	var tlvs []ProxyTLV
+	for len(b) > 0 {
+		if len(b) < 3 {
+			return nil, errors.New("truncated PROXY v2 TLV")
+		}
+		n := int(binary.BigEndian.Uint16(b[1:3]))
+		if len(b) < 3+n {
+			return nil, errors.New("truncated PROXY v2 TLV")
+		}
+		tlvs = append(tlvs, ProxyTLV{Type: b[0], Value: b[3 : 3+n]})
+		b = b[3+n:]
+	}
+	return tlvs, nil
+}
+
+// writeProxyHeader writes a PROXY header announcing a connection from src to
+// dst. Addresses other than TCP/IP are sent as UNKNOWN (v1) or LOCAL (v2).
+// Version 2 headers carry authority, the requested host name, as a TLV.
+func writeProxyHeader(w io.Writer, version int, src, dst net.Addr, authority string) error {
+	srcIP, dstIP := addrIP(src), addrIP(dst)
+	var srcPort, dstPort int
+	if a, ok := src.(*net.TCPAddr); ok {
+		srcPort = a.Port
+	}
+	if a, ok := dst.(*net.TCPAddr); ok {
+		dstPort = a.Port
+	}
+	known := srcIP != nil && dstIP != nil
+	ipv4 := known && srcIP.To4() != nil && dstIP.To4() != nil
+
+	if version == 1 {
+		var line string
+		switch {
+		case !known:
+			line = "PROXY UNKNOWN\r\n"
+		case ipv4:
+			line = fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", srcIP.To4(), dstIP.To4(), srcPort, dstPort)
+		default:
+			line = fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", srcIP.To16(), dstIP.To16(), srcPort, dstPort)
+		}
+		_, err := io.WriteString(w, line)
+		return err
+	}
+	if version != 2 {
+		return fmt.Errorf("unsupported PROXY protocol version: %d", version)
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, 64))
+	buf.Write(proxyV2Sig)
+	var addrs []byte
+	switch {
+	case !known:
+		buf.Write([]byte{0x20, 0x00}) // LOCAL, UNSPEC
+	case ipv4:
+		buf.Write([]byte{0x21, 0x11}) // PROXY, TCP over IPv4
+		addrs = append(addrs, srcIP.To4()...)
+		addrs = append(addrs, dstIP.To4()...)
+	default:
+		buf.Write([]byte{0x21, 0x21}) // PROXY, TCP over IPv6
+		addrs = append(addrs, srcIP.To16()...)
+		addrs = append(addrs, dstIP.To16()...)
+	}
+	if known {
+		addrs = binary.BigEndian.AppendUint16(addrs, uint16(srcPort))
+		addrs = binary.BigEndian.AppendUint16(addrs, uint16(dstPort))
+		if authority != "" && len(authority) <= 0xffff {
+			addrs = append(addrs, PP2TypeAuthority)
+			addrs = binary.BigEndian.AppendUint16(addrs, uint16(len(authority)))
+			addrs = append(addrs, authority...)
+		}
+	}
+	_ = binary.Write(buf, binary.BigEndian, uint16(len(addrs)))
+	buf.Write(addrs)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
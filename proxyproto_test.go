@@ -0,0 +1,297 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dcsunny/socks5/wire"
+)
+
+// pipeWith returns a connection that reads data followed by "rest"
+func pipeWith(t *testing.T, data []byte) net.Conn {
+	t.Helper()
+	client, server := net.Pipe()
+	go func() {
+		_, _ = client.Write(append(data, "rest"...))
+		client.Close()
+	}()
+	t.Cleanup(func() { server.Close() })
+	return server
+}
+
+// proxyV2 builds a PROXY v2 header from the command/family bytes and payload
+func proxyV2(cmd, family byte, payload []byte) []byte {
+	b := append([]byte{}, proxyV2Sig...)
+	b = append(b, cmd, family)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(payload)))
+	return append(b, payload...)
+}
+
+func tlv(typ byte, value []byte) []byte {
+	b := []byte{typ}
+	b = binary.BigEndian.AppendUint16(b, uint16(len(value)))
+	return append(b, value...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	ipv4 := []byte{192, 0, 2, 1, 198, 51, 100, 7, 0x30, 0x39, 0x04, 0x38} // 12345 -> 1080
+	ssl := append([]byte{0x07, 0, 0, 0, 0}, tlv(PP2SubTypeSSLVer, []byte("TLSv1.3"))...)
+	ssl = append(ssl, tlv(PP2SubTypeSSLCN, []byte("alice"))...)
+	withTLVs := append(append([]byte{}, ipv4...), tlv(PP2TypeAuthority, []byte("example.com"))...)
+	withTLVs = append(withTLVs, tlv(PP2TypeSSL, ssl)...)
+	ipv6 := make([]byte, 36)
+	copy(ipv6, net.ParseIP("2001:db8::1"))
+	copy(ipv6[16:], net.ParseIP("2001:db8::2"))
+	binary.BigEndian.PutUint16(ipv6[32:], 443)
+	binary.BigEndian.PutUint16(ipv6[34:], 1080)
+
+	tests := []struct {
+		name    string
+		header  []byte
+		version int
+		local   bool
+		source  string
+		dest    string
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 192.0.2.1 198.51.100.7 12345 1080\r\n"), 1, false, "192.0.2.1:12345", "198.51.100.7:1080"},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 443 1080\r\n"), 1, false, "[2001:db8::1]:443", "[2001:db8::2]:1080"},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), 1, true, "", ""},
+		{"v2 ipv4", proxyV2(0x21, 0x11, ipv4), 2, false, "192.0.2.1:12345", "198.51.100.7:1080"},
+		{"v2 ipv4 tlvs", proxyV2(0x21, 0x11, withTLVs), 2, false, "192.0.2.1:12345", "198.51.100.7:1080"},
+		{"v2 ipv6", proxyV2(0x21, 0x21, ipv6), 2, false, "[2001:db8::1]:443", "[2001:db8::2]:1080"},
+		{"v2 local", proxyV2(0x20, 0x00, nil), 2, true, "", ""},
+		{"v2 unspec", proxyV2(0x21, 0x00, nil), 2, true, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := readProxyHeader(pipeWith(t, tt.header))
+			if err != nil {
+				t.Fatal(err)
+			}
+			h := ProxyHeaderOf(conn)
+			if h == nil || h.Version != tt.version || h.Local != tt.local {
+				t.Fatalf("header = %+v, want version %d local %v", h, tt.version, tt.local)
+			}
+			if !tt.local {
+				if got := conn.RemoteAddr().String(); got != tt.source {
+					t.Errorf("RemoteAddr = %s, want %s", got, tt.source)
+				}
+				if got := conn.LocalAddr().String(); got != tt.dest {
+					t.Errorf("LocalAddr = %s, want %s", got, tt.dest)
+				}
+			} else if _, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+				t.Errorf("RemoteAddr of a LOCAL header = %v, want the pipe's", conn.RemoteAddr())
+			}
+			// What follows the header is left for SOCKS5
+			rest, _ := io.ReadAll(conn)
+			if string(rest) != "rest" {
+				t.Errorf("data after header = %q, want rest", rest)
+			}
+		})
+	}
+
+	conn, err := readProxyHeader(pipeWith(t, proxyV2(0x21, 0x11, withTLVs)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := ProxyHeaderOf(conn)
+	if got := h.Authority(); got != "example.com" {
+		t.Errorf("Authority = %q, want example.com", got)
+	}
+	info, ok := h.SSL()
+	if !ok || !info.Verified || info.Client != 0x07 || info.Version != "TLSv1.3" || info.CN != "alice" {
+		t.Errorf("SSL = %+v, %v", info, ok)
+	}
+	if _, ok := h.TLV(PP2TypeNetNS); ok {
+		t.Error("found a TLV that was not sent")
+	}
+}
+
+func TestReadProxyHeaderInvalid(t *testing.T) {
+	ipv4 := []byte{192, 0, 2, 1, 198, 51, 100, 7, 0x30, 0x39, 0x04, 0x38}
+	tests := []struct {
+		name   string
+		header []byte
+	}{
+		{"none", []byte("\x05\x01\x00 and some more")},
+		{"v1 without crlf", []byte("PROXY TCP4 192.0.2.1 198.51.100.7 12345 1080\n")},
+		{"v1 bad address", []byte("PROXY TCP4 192.0.2 198.51.100.7 12345 1080\r\n")},
+		{"v1 bad port", []byte("PROXY TCP4 192.0.2.1 198.51.100.7 123456 1080\r\n")},
+		{"v1 too long", append([]byte("PROXY TCP4 "), bytes.Repeat([]byte("1"), 120)...)},
+		{"v2 version", proxyV2(0x31, 0x11, ipv4)},
+		{"v2 command", proxyV2(0x2f, 0x11, ipv4)},
+		{"v2 short ipv4", proxyV2(0x21, 0x11, ipv4[:8])},
+		{"v2 short ipv6", proxyV2(0x21, 0x21, make([]byte, 20))},
+		{"v2 truncated tlv", proxyV2(0x21, 0x11, append(append([]byte{}, ipv4...), PP2TypeAuthority, 0, 9, 'x'))},
+		{"v2 truncated payload", proxyV2(0x21, 0x11, ipv4)[:20]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := readProxyHeader(pipeWith(t, tt.header)); err == nil {
+				t.Fatal("no error")
+			}
+		})
+	}
+}
+
+func TestWriteProxyHeader(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000}
+	dst := &net.TCPAddr{IP: net.ParseIP("198.51.100.7"), Port: 443}
+	for _, version := range []int{1, 2} {
+		var buf bytes.Buffer
+		if err := writeProxyHeader(&buf, version, src, dst, "example.com"); err != nil {
+			t.Fatal(err)
+		}
+		conn, err := readProxyHeader(pipeWith(t, buf.Bytes()))
+		if err != nil {
+			t.Fatalf("v%d: %v", version, err)
+		}
+		h := ProxyHeaderOf(conn)
+		if h.Source.String() != src.String() || h.Destination.String() != dst.String() {
+			t.Errorf("v%d: %v -> %v, want %v -> %v", version, h.Source, h.Destination, src, dst)
+		}
+		if want := map[int]string{1: "", 2: "example.com"}[version]; h.Authority() != want {
+			t.Errorf("v%d: authority %q, want %q", version, h.Authority(), want)
+		}
+	}
+}
+
+// proxyHeaderHook reports the PROXY header of every accepted connection
+func proxyHeaderHook() (Option, <-chan *ProxyHeader) {
+	headers := make(chan *ProxyHeader, 4)
+	return WithHooks(Hooks{OnAccept: func(conn net.Conn) error {
+		headers <- ProxyHeaderOf(conn)
+		return nil
+	}}), headers
+}
+
+func TestProxyProtocolTrustedSources(t *testing.T) {
+	echo := startEcho(t)
+	header := []byte("PROXY TCP4 192.0.2.1 127.0.0.1 12345 1080\r\n")
+
+	// From a trusted peer the header gives the client address
+	hook, headers := proxyHeaderHook()
+	closeOpt, closed := closeHook()
+	_, addr := startServer(t, ListenerConfig{
+		ProxyProtocol:  true,
+		TrustedProxies: mustCIDRs(t, "127.0.0.0/8"),
+	}, hook, closeOpt)
+	conn, err := (&Dialer{ProxyAddr: addr, Forward: headerDialer(header)}).Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoThrough(t, conn, "hello")
+	conn.Close()
+	if h := <-headers; h == nil || h.Version != 1 {
+		t.Fatalf("header = %+v", h)
+	}
+	if stats := nextClose(t, closed); stats.ClientAddr.String() != "192.0.2.1:12345" {
+		t.Errorf("client = %v, want 192.0.2.1:12345", stats.ClientAddr)
+	}
+
+	// Other peers are not expected to send one, a header is then not SOCKS5
+	hook, headers = proxyHeaderHook()
+	closeOpt, closed = closeHook()
+	_, addr = startServer(t, ListenerConfig{
+		ProxyProtocol:  true,
+		TrustedProxies: mustCIDRs(t, "10.0.0.0/8"),
+	}, hook, closeOpt)
+	if _, err := (&Dialer{ProxyAddr: addr, Forward: headerDialer(header)}).Dial("tcp", echo); err == nil {
+		t.Fatal("header from an untrusted peer accepted")
+	}
+	if h := <-headers; h != nil {
+		t.Errorf("header from an untrusted peer parsed: %+v", h)
+	}
+	if stats := nextClose(t, closed); stats.Reason != CloseProtocolError || addrIP(stats.ClientAddr).String() != "127.0.0.1" {
+		t.Errorf("client %v, reason %s; want 127.0.0.1 and %s", stats.ClientAddr, stats.Reason, CloseProtocolError)
+	}
+	conn, err = (&Dialer{ProxyAddr: addr}).Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoThrough(t, conn, "hello")
+	conn.Close()
+}
+
+func TestProxyProtocolRequired(t *testing.T) {
+	// A trusted peer must send the header, in time
+	_, addr := startServer(t, ListenerConfig{
+		ProxyProtocol:  true,
+		TrustedProxies: mustCIDRs(t, "127.0.0.0/8"),
+	}, WithTimeouts(Timeouts{Handshake: 200 * time.Millisecond}))
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, _ = (&wire.Greeting{Methods: []byte{wire.MethodNoAuth}}).WriteTo(conn)
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := conn.Read(make([]byte, 16)); err != io.EOF {
+		t.Fatalf("read %d bytes, %v; want the connection closed", n, err)
+	}
+}
+
+func TestProxyProtocolNeedsTrustedProxies(t *testing.T) {
+	// Without a list any client could claim any source address
+	s := NewServer(false, "", "", "", "", WithLogger(testLogger()),
+		WithListener(ListenerConfig{Network: "tcp", Addr: "127.0.0.1:0", ProxyProtocol: true}))
+	if err := s.Start(); err == nil {
+		s.Shutdown(context.Background())
+		t.Fatal("started a PROXY protocol listener that trusts every peer")
+	}
+}
+
+func TestProxyProtocolUnixSource(t *testing.T) {
+	echo := startEcho(t)
+	_, addr := startServer(t, ListenerConfig{
+		ProxyProtocol:  true,
+		TrustedProxies: mustCIDRs(t, "127.0.0.0/8"),
+		Profile:        &Profile{AllowSources: mustCIDRs(t, "10.0.0.0/8")},
+	})
+
+	// A TCP source of the header is checked against the ACL
+	ipv4 := []byte{10, 1, 2, 3, 127, 0, 0, 1, 0x30, 0x39, 0x04, 0x38}
+	conn, err := (&Dialer{ProxyAddr: addr, Forward: headerDialer(proxyV2(0x21, 0x11, ipv4))}).Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoThrough(t, conn, "hello")
+	conn.Close()
+
+	// A unix source is not local, the upstream's address is checked instead
+	unix := make([]byte, 216)
+	copy(unix, "/run/client.sock")
+	copy(unix[108:], "/run/socks5.sock")
+	if _, err := (&Dialer{ProxyAddr: addr, Forward: headerDialer(proxyV2(0x21, 0x31, unix))}).Dial("tcp", echo); err == nil {
+		t.Fatal("unix source of a PROXY header allowed past allow-src")
+	}
+}
+
+func mustCIDRs(t *testing.T, cidrs ...string) []*net.IPNet {
+	t.Helper()
+	nets, err := ParseCIDRs(cidrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return nets
+}
+
+// headerDialer connects and sends header first, like a load balancer
+type headerDialer []byte
+
+func (h headerDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(h); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
@@ -0,0 +1,345 @@
+package socks5
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxLimitedRead caps a single read so one direction cannot run far ahead of its tokens
+const maxLimitedRead = 32 * 1024
+
+// RateLimit is a bandwidth limit in bytes per second, 0 means unlimited
+type RateLimit struct {
+	Upload   int64 // 客户端到目标
+	Download int64 // 目标到客户端
+	Burst    int64 // 令牌桶容量，0 表示与速率相同
+}
+
+// RateLimits are the bandwidth limits applied to every connection
+type RateLimits struct {
+	Global  RateLimit // 所有连接共享
+	PerUser RateLimit // 同一用户共享，未认证时按客户端 IP
+	PerConn RateLimit // 每个连接单独计算
+}
+
+// WithRateLimits sets the initial bandwidth limits, see SetRateLimits
+func WithRateLimits(limits RateLimits) Option {
+	return func(s *Server) {
+		s.limiter.set(limits)
+	}
+}
+
+// SetRateLimits changes the bandwidth limits. Established connections pick
+// up the new limits immediately.
+func (s *Server) SetRateLimits(limits RateLimits) {
+	s.limiter.set(limits)
+}
+
+// RateLimits returns the bandwidth limits in effect
+func (s *Server) RateLimits() RateLimits {
+	s.limiter.mu.Lock()
+	defer s.limiter.mu.Unlock()
+	return s.limiter.limits
+}
+
+// ParseRateLimit parses "upload:download[:burst]" where each value is a byte
+// count per second with an optional K, M or G suffix, e.g. "1M:10M".
+func ParseRateLimit(spec string) (RateLimit, error) {
+	var l RateLimit
+	parts := strings.Split(spec, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return l, fmt.Errorf("invalid rate limit %q, want upload:download[:burst]", spec)
+	}
+	values := make([]int64, 3)
+	for i, part := range parts {
+		v, err := ParseSize(part)
+		if err != nil {
+			return l, fmt.Errorf("invalid rate limit %q: %v", spec, err)
+		}
+		values[i] = v
+	}
+	l.Upload, l.Download, l.Burst = values[0], values[1], values[2]
+	return l, nil
+}
+
+// ParseSize parses a byte count with an optional K, M or G (1024 based) suffix
+func ParseSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSuffix(strings.TrimSpace(s), "B"))
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		mult = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		mult = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		s = s[:len(s)-1]
+	}
+	if s == "" {
+		return 0, nil
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(v * float64(mult)), nil
+}
+
+// tokenBucket is a token bucket that may go into debt: a read takes its
+// tokens after the fact and the reader then sleeps until the debt is paid.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) set(rate, burst int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	if burst <= 0 {
+		burst = rate
+	}
+	b.rate, b.burst = float64(rate), float64(burst)
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+}
+
+// take consumes n tokens and returns how long to wait for the debt to clear
+func (b *tokenBucket) take(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate <= 0 {
+		return 0
+	}
+	b.refill(time.Now())
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// delay returns how long until the debt of the bucket is paid
+func (b *tokenBucket) delay() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate <= 0 {
+		return 0
+	}
+	b.refill(time.Now())
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// allow consumes n tokens if they are available
+func (b *tokenBucket) allow(n int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate <= 0 {
+		return true
+	}
+	b.refill(time.Now())
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// size is the largest read worth doing at once, 0 when unlimited
+func (b *tokenBucket) size() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate <= 0 {
+		return 0
+	}
+	return int(b.burst)
+}
+
+// bucketPair limits both directions of a connection
+type bucketPair struct {
+	up, down tokenBucket
+}
+
+func (p *bucketPair) set(l RateLimit) {
+	p.up.set(l.Upload, l.Burst)
+	p.down.set(l.Download, l.Burst)
+}
+
+type userBuckets struct {
+	bucketPair
+	refs int
+}
+
+// rateLimiter owns the shared buckets of a server
+type rateLimiter struct {
+	mu      sync.Mutex
+	limits  RateLimits
+	global  bucketPair
+	users   map[string]*userBuckets
+	conns   map[*connLimiter]struct{}
+	changed chan struct{}   // 下次 set 时关闭，唤醒等待中的连接
+	stop    <-chan struct{} // Server 强制关闭时关闭
+}
+
+func (r *rateLimiter) set(limits RateLimits) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.changed != nil {
+		close(r.changed)
+		r.changed = nil
+	}
+	r.limits = limits
+	r.global.set(limits.Global)
+	for _, u := range r.users {
+		u.set(limits.PerUser)
+	}
+	for c := range r.conns {
+		c.own.set(limits.PerConn)
+	}
+}
+
+// changes returns a channel that is closed when the limits change
+func (r *rateLimiter) changes() <-chan struct{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.changed == nil {
+		r.changed = make(chan struct{})
+	}
+	return r.changed
+}
+
+// open returns the limiter of a new connection; key is the user identity or
+// the client IP, done is closed when the connection is killed
+func (r *rateLimiter) open(key string, done <-chan struct{}) *connLimiter {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.users == nil {
+		r.users = make(map[string]*userBuckets)
+		r.conns = make(map[*connLimiter]struct{})
+	}
+	u := r.users[key]
+	if u == nil {
+		u = &userBuckets{}
+		u.set(r.limits.PerUser)
+		r.users[key] = u
+	}
+	u.refs++
+	c := &connLimiter{r: r, key: key, user: u, done: done}
+	c.own.set(r.limits.PerConn)
+	r.conns[c] = struct{}{}
+	return c
+}
+
+// connLimiter applies the global, per-user and per-connection limits
+type connLimiter struct {
+	r    *rateLimiter
+	key  string
+	user *userBuckets
+	own  bucketPair
+	done <-chan struct{}
+}
+
+func (c *connLimiter) close() {
+	c.r.mu.Lock()
+	defer c.r.mu.Unlock()
+	delete(c.r.conns, c)
+	if c.user.refs--; c.user.refs == 0 {
+		delete(c.r.users, c.key)
+	}
+}
+
+func (c *connLimiter) buckets(upload bool) []*tokenBucket {
+	if upload {
+		return []*tokenBucket{&c.r.global.up, &c.user.up, &c.own.up}
+	}
+	return []*tokenBucket{&c.r.global.down, &c.user.down, &c.own.down}
+}
+
+// chunk is the most one read or splice should move at once, max when unlimited
+func (c *connLimiter) chunk(upload bool, max int) int {
+	for _, b := range c.buckets(upload) {
+		if size := b.size(); size > 0 && size < max {
+			max = size
+		}
+	}
+	return max
+}
+
+// wait takes n tokens from every bucket and sleeps until they are paid for.
+// A killed connection or a stopping server cuts the sleep short, changed
+// limits make it start over with the debt under the new limits.
+func (c *connLimiter) wait(n int, upload bool) {
+	buckets := c.buckets(upload)
+	for _, b := range buckets {
+		b.take(n)
+	}
+	for {
+		changed := c.r.changes()
+		var wait time.Duration
+		for _, b := range buckets {
+			if d := b.delay(); d > wait {
+				wait = d
+			}
+		}
+		if wait <= 0 {
+			return
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-changed:
+			timer.Stop()
+		case <-c.done:
+			timer.Stop()
+			return
+		case <-c.r.stop:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// reader limits reads from src, upload is the client to target direction
+func (c *connLimiter) reader(src io.Reader, upload bool) io.Reader {
+	return &limitedReader{r: src, c: c, upload: upload}
+}
+
+type limitedReader struct {
+	r      io.Reader
+	c      *connLimiter
+	upload bool
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if max := l.c.chunk(l.upload, maxLimitedRead); len(p) > max {
+		p = p[:max]
+	}
+	n, err := l.r.Read(p)
+	if n > 0 {
+		l.c.wait(n, l.upload)
+	}
+	return n, err
+}
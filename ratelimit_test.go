@@ -0,0 +1,189 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    RateLimit
+		wantErr bool
+	}{
+		{spec: "1M:10M", want: RateLimit{Upload: 1 << 20, Download: 10 << 20}},
+		{spec: "512K:1.5M:4M", want: RateLimit{Upload: 512 << 10, Download: 3 << 19, Burst: 4 << 20}},
+		{spec: "0:100", want: RateLimit{Download: 100}},
+		{spec: "1GB:", want: RateLimit{Upload: 1 << 30}},
+		{spec: "1M", wantErr: true},
+		{spec: "1M:2M:3M:4M", wantErr: true},
+		{spec: "fast:slow", wantErr: true},
+		{spec: "-1:1", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseRateLimit(tt.spec)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseRateLimit(%q) error = %v, want error %v", tt.spec, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseRateLimit(%q) = %+v, want %+v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	var b tokenBucket
+	b.set(1000, 0)
+	// It starts empty, going into debt costs the time to earn it back
+	if d := b.take(500); d < 400*time.Millisecond || d > 500*time.Millisecond {
+		t.Errorf("take 500 in debt waits %v, want about 500ms", d)
+	}
+	// Tokens accumulate up to the burst
+	b.last = b.last.Add(-5 * time.Second)
+	if d := b.take(1000); d != 0 {
+		t.Errorf("take within burst waits %v", d)
+	}
+	if d := b.take(500); d < 400*time.Millisecond || d > 500*time.Millisecond {
+		t.Errorf("take 500 in debt waits %v, want about 500ms", d)
+	}
+	if b.allow(1) {
+		t.Error("allow in debt")
+	}
+	if size := b.size(); size != 1000 {
+		t.Errorf("size = %d, want the burst", size)
+	}
+
+	var unlimited tokenBucket
+	if d := unlimited.take(1 << 30); d != 0 || !unlimited.allow(1<<30) || unlimited.size() != 0 {
+		t.Error("unlimited bucket limits")
+	}
+}
+
+// transfer sends n bytes through the echo tunnel and returns how long
+// they took to come back
+func transfer(t *testing.T, s *Server, addr, echo string, n int) time.Duration {
+	t.Helper()
+	conn, err := (&Dialer{ProxyAddr: addr}).Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	start := time.Now()
+	go func() {
+		_, _ = conn.Write(bytes.Repeat([]byte("x"), n))
+	}()
+	_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.ReadFull(conn, make([]byte, n)); err != nil {
+		t.Fatal(err)
+	}
+	return time.Since(start)
+}
+
+func TestRateLimits(t *testing.T) {
+	echo := startEcho(t)
+	s, addr := startServer(t, ListenerConfig{}, WithRateLimits(RateLimits{
+		PerConn: RateLimit{Upload: 200 << 10, Burst: 20 << 10},
+	}))
+
+	// 100K at 200K/s with a 20K burst takes at least 0.4s
+	if d := transfer(t, s, addr, echo, 100<<10); d < 350*time.Millisecond {
+		t.Errorf("limited transfer took %v, want at least 400ms", d)
+	}
+
+	// New limits apply at once, the download direction is limited now
+	s.SetRateLimits(RateLimits{Global: RateLimit{Download: 200 << 10, Burst: 20 << 10}})
+	if got := s.RateLimits(); got.PerConn != (RateLimit{}) || got.Global.Download != 200<<10 {
+		t.Errorf("RateLimits = %+v", got)
+	}
+	if d := transfer(t, s, addr, echo, 100<<10); d < 350*time.Millisecond {
+		t.Errorf("limited transfer took %v, want at least 400ms", d)
+	}
+
+	s.SetRateLimits(RateLimits{})
+	if d := transfer(t, s, addr, echo, 1<<20); d > time.Second {
+		t.Errorf("unlimited transfer took %v", d)
+	}
+}
+
+func TestRateLimitPerUser(t *testing.T) {
+	echo := startEcho(t)
+	s, addr := startServer(t, ListenerConfig{}, WithRateLimits(RateLimits{
+		PerUser: RateLimit{Download: 200 << 10, Burst: 20 << 10},
+	}))
+
+	// Two connections of the same client share its bucket: 2x50K take as
+	// long as 100K on one connection
+	start := time.Now()
+	done := make(chan time.Duration, 2)
+	for i := 0; i < 2; i++ {
+		go func() { done <- transfer(t, s, addr, echo, 50<<10) }()
+	}
+	<-done
+	<-done
+	if d := time.Since(start); d < 350*time.Millisecond {
+		t.Errorf("two limited transfers took %v, want at least 400ms", d)
+	}
+}
+
+func TestRateLimitWakeup(t *testing.T) {
+	echo := startEcho(t)
+	hook, closed := closeHook()
+	limits := RateLimits{PerConn: RateLimit{Upload: 1 << 10}}
+	s, addr := startServer(t, ListenerConfig{}, WithRateLimits(limits), hook)
+	// Each 1K read puts the connection a second into debt
+	slow := func() net.Conn {
+		t.Helper()
+		conn, err := (&Dialer{ProxyAddr: addr}).Dial("tcp", echo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = conn.Write(bytes.Repeat([]byte("x"), 4<<10))
+		time.Sleep(100 * time.Millisecond)
+		return conn
+	}
+
+	// Lifted limits end the current wait
+	conn := slow()
+	start := time.Now()
+	s.SetRateLimits(RateLimits{})
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, make([]byte, 4<<10)); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("data arrived %v after the limits were lifted", d)
+	}
+	conn.Close()
+	nextClose(t, closed)
+
+	// So does closing the connection
+	s.SetRateLimits(limits)
+	conn = slow()
+	defer conn.Close()
+	start = time.Now()
+	for _, info := range s.Sessions() {
+		s.CloseSession(info.ID)
+	}
+	if stats := nextClose(t, closed); stats.Reason != CloseKilled {
+		t.Errorf("reason = %s, want %s", stats.Reason, CloseKilled)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("killed connection ended after %v", d)
+	}
+
+	// And Shutdown once the drain times out
+	conn = slow()
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	_ = s.Shutdown(ctx)
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("Shutdown took %v", d)
+	}
+}
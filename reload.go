@@ -0,0 +1,75 @@
+package socks5
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+)
+
+// Reload replaces the profiles of the running listeners: credentials, ACLs,
+// routes and the downstream proxy. Each of configs is matched to a listener
+// by network and address and gives it its Profile; listeners without a
+// config get defaultProfile if they were started with the default profile
+// and keep theirs otherwise. A nil defaultProfile keeps the current one.
+//
+// Listeners cannot be added, removed or rebound without a restart. Nothing
+// is changed when a config does not match a listener or a profile is
+// invalid. Established connections keep the profile they started with.
+func (s *Server) Reload(defaultProfile *Profile, configs []ListenerConfig) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.listeners) == 0 {
+		return errors.New("server is not running")
+	}
+	if defaultProfile == nil {
+		defaultProfile = s.profile
+	}
+	defaultState, err := newListenerState(defaultProfile)
+	if err != nil {
+		return fmt.Errorf("invalid default profile: %v", err)
+	}
+
+	byName := make(map[string]*listener, len(s.listeners))
+	for _, l := range s.listeners {
+		byName[inheritName(l.cfg)] = l
+	}
+	states := make(map[*listener]*listenerState)
+	for _, cfg := range configs {
+		l, ok := byName[inheritName(cfg)]
+		if !ok {
+			return fmt.Errorf("no running listener on %s://%s, adding listeners requires a restart", cfg.Network, cfg.Addr)
+		}
+		if cfg.Profile == nil {
+			states[l] = defaultState
+			continue
+		}
+		state, err := newListenerState(cfg.Profile)
+		if err != nil {
+			return fmt.Errorf("invalid profile for %s: %v", l, err)
+		}
+		states[l] = state
+	}
+
+	s.profile = defaultProfile
+	for _, l := range s.listeners {
+		state, ok := states[l]
+		if !ok {
+			if !l.usesDefault {
+				continue
+			}
+			state = defaultState
+		}
+		l.state.Store(state)
+		warnDownProxy(s.logger, l)
+	}
+	s.logger.Info("Configuration reloaded", "listeners", len(s.listeners))
+	return nil
+}
+
+// warnDownProxy warns about a downstream proxy the listener cannot use
+func warnDownProxy(logger *slog.Logger, l *listener) {
+	state := l.current()
+	if state.profile.DownProxy != "" && !state.downProxy.Enabled {
+		logger.Warn("Unsupported downstream proxy, ignored", "listener", l.String(), "down_proxy", redactURL(state.profile.DownProxy))
+	}
+}
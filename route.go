@@ -0,0 +1,72 @@
+package socks5
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Route upstream values besides a proxy URL
+const (
+	UpstreamDirect = "direct"
+	UpstreamSystem = "system"
+)
+
+// Route selects how connections to matching destinations leave the server
+type Route struct {
+	Match    []string // 目标地址匹配规则，支持主机名、*.example.com、IP 和网段
+	Upstream string   // direct、system 或代理地址，为空时沿用 Profile 的默认路由
+
+	// ProxyProtocol writes a PROXY v1 or v2 header carrying the SOCKS client
+	// address to direct connections, 0 disables it
+	ProxyProtocol int
+}
+
+// ParseRoute parses a route given on the command line, for example
+//
+//	match=*.internal,10.0.0.0/8&upstream=direct&proxy-protocol=2
+func ParseRoute(spec string) (Route, error) {
+	var r Route
+	q, err := url.ParseQuery(spec)
+	if err != nil {
+		return r, fmt.Errorf("invalid route %q: %v", spec, err)
+	}
+	if v := q.Get("match"); v != "" {
+		r.Match = strings.Split(v, ",")
+	}
+	if len(r.Match) == 0 {
+		return r, fmt.Errorf("route %q has no match", spec)
+	}
+	r.Upstream = q.Get("upstream")
+	if v := q.Get("proxy-protocol"); v != "" {
+		if r.ProxyProtocol, err = strconv.Atoi(v); err != nil {
+			return r, fmt.Errorf("invalid proxy-protocol %q: %v", v, err)
+		}
+	}
+	return r, r.validate()
+}
+
+func (r *Route) validate() error {
+	switch r.Upstream {
+	case "", UpstreamDirect, UpstreamSystem:
+	default:
+		if !parseDownProxy(r.Upstream).Enabled {
+			return fmt.Errorf("unsupported route upstream: %s", r.Upstream)
+		}
+	}
+	if r.ProxyProtocol < 0 || r.ProxyProtocol > 2 {
+		return fmt.Errorf("unsupported proxy protocol version: %d", r.ProxyProtocol)
+	}
+	return nil
+}
+
+// route returns the first route matching host, nil when none does
+func (p *Profile) route(host string) *Route {
+	for i := range p.Routes {
+		if matchHost(p.Routes[i].Match, host) {
+			return &p.Routes[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package socks5
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestParseRoute(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    Route
+		wantErr bool
+	}{
+		{spec: "match=*.internal,10.0.0.0/8&upstream=direct&proxy-protocol=2",
+			want: Route{Match: []string{"*.internal", "10.0.0.0/8"}, Upstream: UpstreamDirect, ProxyProtocol: 2}},
+		{spec: "match=example.com&upstream=socks5://10.0.0.2:1080",
+			want: Route{Match: []string{"example.com"}, Upstream: "socks5://10.0.0.2:1080"}},
+		{spec: "match=example.com",
+			want: Route{Match: []string{"example.com"}}},
+		{spec: "upstream=direct", wantErr: true},
+		{spec: "match=example.com&upstream=ftp://10.0.0.2", wantErr: true},
+		{spec: "match=example.com&proxy-protocol=3", wantErr: true},
+		{spec: "match=example.com&proxy-protocol=v2", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseRoute(tt.spec)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseRoute(%q) error = %v, want error %v", tt.spec, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("ParseRoute(%q) = %+v, want %+v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+// staticResolver resolves host names from a map
+type staticResolver map[string]string
+
+func (r staticResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	ip, ok := r[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return []net.IPAddr{{IP: net.ParseIP(ip)}}, nil
+}
+
+// startProxyHeaderTarget accepts connections that start with a PROXY
+// header, reports the header and echoes the rest
+func startProxyHeaderTarget(t *testing.T) (string, <-chan *ProxyHeader) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	headers := make(chan *ProxyHeader, 4)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				pc, err := readProxyHeader(conn)
+				if err != nil {
+					headers <- nil
+					return
+				}
+				headers <- ProxyHeaderOf(pc)
+				_, _ = io.Copy(conn, pc)
+			}()
+		}
+	}()
+	return ln.Addr().String(), headers
+}
+
+func TestRoutes(t *testing.T) {
+	target, headers := startProxyHeaderTarget(t)
+	_, port, _ := net.SplitHostPort(target)
+	echo := startEcho(t)
+	_, downstream := startServer(t, ListenerConfig{})
+
+	hook, closed := closeHook()
+	_, addr := startServer(t, ListenerConfig{Profile: &Profile{
+		DownProxy: "socks5://" + downstream,
+		Routes: []Route{
+			{Match: []string{"*.internal"}, Upstream: UpstreamDirect, ProxyProtocol: 2},
+			{Match: []string{"10.0.0.0/8"}, Upstream: "socks5://127.0.0.1:1"},
+		},
+	}}, hook, WithResolver(staticResolver{"app.internal": "127.0.0.1"}))
+	client := &Dialer{ProxyAddr: addr}
+
+	// A matching route connects directly and announces the SOCKS client
+	conn, err := client.Dial("tcp", net.JoinHostPort("app.internal", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoThrough(t, conn, "hello")
+	h := <-headers
+	if h == nil {
+		t.Fatal("no PROXY header")
+	}
+	if h.Version != 2 || h.Source.String() != conn.LocalAddr().String() || h.Authority() != "app.internal" {
+		t.Errorf("header v%d from %v for %q, want v2 from %v for app.internal", h.Version, h.Source, h.Authority(), conn.LocalAddr())
+	}
+	conn.Close()
+	if stats := nextClose(t, closed); stats.Upstream != UpstreamDirect || stats.Resolved != "127.0.0.1" {
+		t.Errorf("upstream %q resolved %q, want direct to 127.0.0.1", stats.Upstream, stats.Resolved)
+	}
+
+	// Others take the downstream proxy
+	conn, err = client.Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoThrough(t, conn, "hello")
+	conn.Close()
+	if stats := nextClose(t, closed); stats.Upstream != "socks5://"+downstream {
+		t.Errorf("upstream %q, want the downstream proxy", stats.Upstream)
+	}
+
+	// The first matching route wins, even when its upstream is down
+	if _, err := client.Dial("tcp", "10.1.2.3:80"); replyCode(err) < 0 {
+		t.Fatalf("err = %v, want a failure reply", err)
+	}
+	if stats := nextClose(t, closed); stats.Upstream != "socks5://127.0.0.1:1" || stats.Reason != CloseDialFailed {
+		t.Errorf("upstream %q reason %s, want socks5://127.0.0.1:1 and %s", stats.Upstream, stats.Reason, CloseDialFailed)
+	}
+}
@@ -2,12 +2,26 @@ package socks5
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
+	"net/url"
+	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dcsunny/socks5/wire"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // DownProxyInfo stores downstream proxy configuration
@@ -17,355 +31,823 @@ type DownProxyInfo struct {
 	Enabled   bool
 }
 
+// proxyHeaderTimeout bounds the wait for a PROXY protocol header
+const proxyHeaderTimeout = 10 * time.Second
+
 type Server struct {
-	systemProxy   bool   // 是否使用系统代理设置
-	downProxy     string // 下游代理地址
-	listenAddr    string
-	downProxyInfo *DownProxyInfo
-	username      string // 用户名
-	password      string // 密码
-	authRequired  bool   // 是否启用认证
+	profile    *Profile // NewServer 参数对应的默认配置
+	listenAddr string
+
+	tlsCertFile  string // TLS 证书
+	tlsKeyFile   string // TLS 私钥
+	clientCAFile string // 客户端证书 CA，配置后可用客户端证书认证
+
+	listenerConfigs []ListenerConfig // 额外的监听器
+	defaultListener *ListenerConfig  // 没有对应配置的继承 socket 使用的配置
+	stats           serverStats
+	limiter         rateLimiter
+	accounting      *accounting
+	admission       *admission
+	timeouts        Timeouts
+	dialer          OutboundDialer // 连接目标，默认为 DefaultDialer
+	resolver        Resolver       // DefaultDialer 直连时使用的域名解析
+	hooks           []Hooks
+	accessLogConfig *AccessLogConfig
+	accessLog       *accessLog
+	metrics         *metrics
+	events          eventBus
+	tracer          trace.Tracer
+	logger          *slog.Logger
+	connID          atomic.Uint64
+	handlers        map[byte]CommandHandler // 代替内置处理的命令
+
+	inherited map[string]net.Listener // 继承自 systemd 或上一个进程的 socket
+	upgrading sync.Mutex              // 信号和管理接口同时触发时只升级一次
+	pidFile   string                  // 升级后写入新进程的 pid
+
+	mu        sync.Mutex
+	listeners []*listener
+	wg        sync.WaitGroup
+	conns     map[net.Conn]struct{}
+	sessions  map[uint64]*session // 正在服务的连接，按 ID
+	connWg    sync.WaitGroup
+	ctx       context.Context // 强制关闭时取消，用于中止进行中的连接
+	cancel    context.CancelFunc
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Option configures optional Server features
+type Option func(*Server)
+
+// WithTLS serves SOCKS5 over TLS. When clientCAFile is set, clients may present
+// a certificate signed by that CA instead of a username and password; without
+// a password the certificate is required.
+func WithTLS(certFile, keyFile, clientCAFile string) Option {
+	return func(s *Server) {
+		s.tlsCertFile = certFile
+		s.tlsKeyFile = keyFile
+		s.clientCAFile = clientCAFile
+	}
+}
+
+// WithListener adds a listener with its own profile. A config without a
+// profile uses the default one built from the NewServer arguments.
+func WithListener(cfg ListenerConfig) Option {
+	return func(s *Server) {
+		s.listenerConfigs = append(s.listenerConfigs, cfg)
+	}
+}
+
+// WithDefaultListener sets how inherited sockets that match no listener
+// config are served, such as unnamed systemd sockets or every socket of an
+// upgrade when the listeners were not given explicitly. Without it they
+// are served with the WithTLS files and the default profile. Either way
+// they follow the default profile on Reload.
+func WithDefaultListener(cfg ListenerConfig) Option {
+	return func(s *Server) {
+		s.defaultListener = &cfg
+	}
 }
 
-func NewServer(useSystemProxy bool, listenAddr string, downProxy string, username string, password string) *Server {
+// WithLogger sets the logger, slog.Default() by default. Records of a
+// connection carry its id, client address, listener, user, destination and
+// upstream.
+func WithLogger(logger *slog.Logger) Option {
+	return func(s *Server) {
+		s.logger = logger
+	}
+}
+
+// NewServer creates a server listening on listenAddr. An empty listenAddr
+// skips the default listener, so that only WithListener listeners are served.
+func NewServer(useSystemProxy bool, listenAddr string, downProxy string, username string, password string, opts ...Option) *Server {
 	s := &Server{
-		systemProxy:  useSystemProxy,
-		downProxy:    downProxy,
-		listenAddr:   listenAddr,
-		username:     username,
-		password:     password,
-		authRequired: username != "" && password != "",
-	}
-	downProxyInfo := &DownProxyInfo{
-		Addr: s.downProxy,
-	}
-	if downProxy != "" {
-		downProxyInfo.Enabled = true
-		if strings.HasPrefix(s.downProxy, "socks5") {
-			downProxyInfo.ProxyType = "socks5"
-		} else if strings.HasPrefix(s.downProxy, "https") {
-			downProxyInfo.ProxyType = "https"
-		} else if strings.HasPrefix(s.downProxy, "http") {
-			downProxyInfo.ProxyType = "http"
-		} else {
-			downProxyInfo.Enabled = false
-		}
-	}
-	s.downProxyInfo = downProxyInfo
+		profile: &Profile{
+			Username:    username,
+			Password:    password,
+			SystemProxy: useSystemProxy,
+			DownProxy:   downProxy,
+		},
+		listenAddr: listenAddr,
+		done:       make(chan struct{}),
+		admission:  newAdmission(ConnLimits{}),
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.limiter.stop = s.ctx.Done()
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.logger == nil {
+		s.logger = slog.Default()
+	}
+	if s.tracer == nil {
+		s.tracer = defaultTracer()
+	}
+	if s.dialer == nil {
+		s.dialer = &DefaultDialer{Resolver: s.resolver, Logger: s.logger, metrics: s.metrics}
+	}
 	return s
 }
 
+// DefaultProfile returns the profile built from the NewServer arguments
+func (s *Server) DefaultProfile() *Profile {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.profile
+}
+
+// Run starts the server and blocks until it is closed
 func (s *Server) Run() {
+	if err := s.Start(); err != nil {
+		s.logger.Error("Failed to start", "err", err)
+		os.Exit(1)
+	}
+	s.Wait()
+}
 
-	listener, err := net.Listen("tcp", s.listenAddr)
-	if err != nil {
-		log.Fatalf("Failed to listen on %s: %v", s.listenAddr, err)
+// Start binds every configured listener and starts accepting connections
+func (s *Server) Start() error {
+	var configs []ListenerConfig
+	if s.listenAddr != "" {
+		configs = append(configs, ListenerConfig{
+			Network:      "tcp",
+			Addr:         s.listenAddr,
+			TLSCertFile:  s.tlsCertFile,
+			TLSKeyFile:   s.tlsKeyFile,
+			ClientCAFile: s.clientCAFile,
+		})
+	}
+	configs = append(configs, s.listenerConfigs...)
+	inherited := make(map[string]net.Listener, len(s.inherited))
+	for name, ln := range s.inherited {
+		inherited[name] = ln
+	}
+	for i := range configs {
+		if configs[i].Listener != nil {
+			continue
+		}
+		name := inheritName(configs[i])
+		if ln, ok := inherited[name]; ok {
+			configs[i].Listener = ln
+			delete(inherited, name)
+		}
+	}
+	// The remaining inherited sockets follow the default profile
+	firstInherited := len(configs)
+	for name, ln := range inherited {
+		cfg := ListenerConfig{
+			TLSCertFile:  s.tlsCertFile,
+			TLSKeyFile:   s.tlsKeyFile,
+			ClientCAFile: s.clientCAFile,
+		}
+		if s.defaultListener != nil {
+			cfg = *s.defaultListener
+		}
+		cfg.Network, cfg.Addr, cfg.Listener = "systemd", name, ln
+		if addr, err := url.QueryUnescape(name); err == nil {
+			if network, a, ok := strings.Cut(addr, "://"); ok {
+				cfg.Network, cfg.Addr = network, a
+			}
+		}
+		configs = append(configs, cfg)
+	}
+	if len(configs) == 0 {
+		return errors.New("no listener configured")
 	}
-	defer listener.Close()
 
-	log.Printf("SOCKS5 proxy server started on %s", s.listenAddr)
+	if s.accounting != nil {
+		if err := s.accounting.load(); err != nil {
+			return fmt.Errorf("failed to load traffic accounting: %v", err)
+		}
+	}
 
-	for {
-		conn, err := listener.Accept()
+	var listeners []*listener
+	for i, cfg := range configs {
+		usesDefault := cfg.Profile == nil || i >= firstInherited
+		if cfg.Profile == nil {
+			cfg.Profile = s.profile
+		}
+		l, err := newListener(cfg, s.logger)
 		if err != nil {
-			log.Printf("Failed to accept connection: %v", err)
-			continue
+			for _, l := range listeners {
+				l.Close()
+			}
+			return fmt.Errorf("failed to listen on %s: %v", cfg.Addr, err)
 		}
-		go s.handleConnection(conn)
+		l.usesDefault = usesDefault
+		listeners = append(listeners, l)
+	}
+
+	s.mu.Lock()
+	s.listeners = listeners
+	s.mu.Unlock()
+	if s.accessLogConfig != nil {
+		accessLog, err := newAccessLog(*s.accessLogConfig, s.logger)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return fmt.Errorf("failed to open access log: %v", err)
+		}
+		s.accessLog = accessLog
+	}
+	if s.accounting != nil {
+		go s.accounting.run(s.done, s.logger)
+	}
+	for _, l := range listeners {
+		warnDownProxy(s.logger, l)
+		s.logger.Info("SOCKS5 proxy server started", "listener", l.String())
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer l.Close()
+			s.serve(l)
+		}()
 	}
+	return nil
 }
 
-func (s *Server) handleConnection(conn net.Conn) {
-	defer conn.Close()
-	bufConn := bufio.NewReader(conn)
+// Wait blocks until every listener has stopped accepting
+func (s *Server) Wait() {
+	s.wg.Wait()
+}
 
-	// Read the version and number of authentication methods
-	versionByte, err := bufConn.ReadByte()
-	if err != nil {
-		log.Printf("Failed to read version byte: %v", err)
-		return
+// Shutdown stops accepting and waits for the established connections to
+// finish. When ctx is done first the remaining connections are closed.
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.Close()
+	done := make(chan struct{})
+	go func() {
+		s.connWg.Wait()
+		close(done)
+	}()
+	defer func() {
+		// Count the traffic of the drained connections too
+		if s.accounting != nil {
+			if err := s.accounting.close(); err != nil {
+				s.logger.Error("Failed to save traffic accounting", "err", err)
+			}
+		}
+		if s.accessLog != nil {
+			if err := s.accessLog.close(); err != nil {
+				s.logger.Error("Failed to close access log", "err", err)
+			}
+		}
+		s.events.closeAll()
+	}()
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
 	}
-	version := uint8(versionByte)
-	if version != Socks5Version {
-		//log.Printf("Unsupported SOCKS version: %d (0x%02X)", version, version)
-		return
+
+	s.cancel()
+	s.mu.Lock()
+	s.logger.Warn("Closing connections still open after drain timeout", "count", len(s.conns))
+	for conn := range s.conns {
+		conn.Close()
 	}
+	s.mu.Unlock()
+	<-done
+	return ctx.Err()
+}
 
-	nMethodsByte, err := bufConn.ReadByte()
-	if err != nil {
-		log.Printf("Failed to read number of methods: %v", err)
-		return
+// Close stops accepting new connections on every listener
+func (s *Server) Close() error {
+	s.closeOnce.Do(func() { close(s.done) })
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var firstErr error
+	for _, l := range s.listeners {
+		if err := l.Close(); err != nil && !errors.Is(err, net.ErrClosed) && firstErr == nil {
+			firstErr = err
+		}
 	}
-	nMethods := uint8(nMethodsByte)
+	return firstErr
+}
 
-	// Read the authentication methods
-	methods := make([]byte, nMethods)
-	_, err = bufConn.Read(methods)
-	if err != nil {
-		log.Printf("Failed to read methods: %v", err)
+func (s *Server) serve(l *listener) {
+	var backoff time.Duration
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// Back off on errors such as running out of file descriptors
+			if backoff == 0 {
+				backoff = 5 * time.Millisecond
+			} else if backoff *= 2; backoff > time.Second {
+				backoff = time.Second
+			}
+			s.logger.Error("Failed to accept connection", "listener", l.String(), "err", err, "retry_in", backoff)
+			time.Sleep(backoff)
+			continue
+		}
+		backoff = 0
+		s.stats.accepted.Add(1)
+		s.trackConn(conn, true)
+		go func() {
+			defer s.trackConn(conn, false)
+			s.serveConn(l, conn)
+		}()
+	}
+}
+
+// serveConn applies the listener policy to an accepted connection
+func (s *Server) serveConn(l *listener, conn net.Conn) {
+	// A refused connection still gets an ID, to tell refusals apart in the log
+	var id uint64
+	refuse := func(counter *atomic.Uint64, reason string) {
+		counter.Add(1)
+		if id == 0 {
+			id = s.connID.Add(1)
+		}
+		s.logger.Debug("Connection refused", "conn", id, "listener", l.String(), "client", conn.RemoteAddr().String(), "reason", reason)
+		conn.Close()
+	}
+	if !s.admission.takeSlot() {
+		refuse(&s.stats.limitedTotal, "max_conns")
 		return
 	}
+	defer s.admission.releaseSlot()
 
-	// Check authentication method
-	var method byte = 0 // No authentication by default
-	if s.authRequired {
-		method = 2 // Username/Password authentication
-		if !Contains(methods, method) {
-			log.Printf("Client doesn't support username/password authentication")
-			_, _ = conn.Write([]byte{Socks5Version, 0xFF}) // No acceptable methods
+	if l.acceptsProxyHeader(conn.RemoteAddr()) {
+		timeout := proxyHeaderTimeout
+		if s.timeouts.Handshake > 0 {
+			timeout = s.timeouts.Handshake
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(timeout))
+		pc, err := readProxyHeader(conn)
+		if err != nil {
+			s.logger.Warn("Invalid PROXY protocol header", "listener", l.String(), "client", conn.RemoteAddr().String(), "err", err)
+			conn.Close()
 			return
 		}
-	} else if !Contains(methods, 0) {
-		log.Printf("No supported authentication methods")
-		_, _ = conn.Write([]byte{Socks5Version, 0xFF})
+		_ = conn.SetReadDeadline(time.Time{})
+		conn = pc
+	}
+	// A Reload applies to connections accepted after it
+	state := l.current()
+	if !state.profile.sourceAllowed(conn.RemoteAddr()) {
+		refuse(&s.stats.rejected, "source")
 		return
 	}
+	if !l.acquire(state.profile) {
+		refuse(&s.stats.limitedListener, "listener_max_conns")
+		return
+	}
+	defer l.release()
 
-	// Send auth method
-	_, err = conn.Write([]byte{Socks5Version, method})
-	if err != nil {
-		log.Printf("Failed to write response: %v", err)
+	var ip string
+	if addr := addrIP(conn.RemoteAddr()); addr != nil {
+		ip = addr.String()
+	}
+	switch s.admission.admitIP(ip) {
+	case "rate":
+		refuse(&s.stats.limitedRate, "conn_rate_per_ip")
+		return
+	case "ip":
+		refuse(&s.stats.limitedPerIP, "max_conns_per_ip")
 		return
 	}
+	defer s.admission.releaseIP(ip)
+	if l.tlsConfig != nil {
+		conn = tls.Server(conn, l.tlsConfig)
+	}
+	s.handleConnection(l, state, conn)
+}
 
-	// Handle username/password authentication if required
-	if s.authRequired {
-		// Read auth version
-		authVer, err := bufConn.ReadByte()
-		if err != nil || authVer != 1 {
-			log.Printf("Invalid auth version: %v", err)
-			return
+// trackConn records the connections being served so Shutdown can drain them
+func (s *Server) trackConn(conn net.Conn, add bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if add {
+		if s.conns == nil {
+			s.conns = make(map[net.Conn]struct{})
 		}
+		s.conns[conn] = struct{}{}
+		s.connWg.Add(1)
+		s.stats.active.Add(1)
+		return
+	}
+	delete(s.conns, conn)
+	s.connWg.Done()
+	s.stats.active.Add(-1)
+}
 
-		// Read username
-		userLen, err := bufConn.ReadByte()
-		if err != nil {
-			log.Printf("Failed to read username length: %v", err)
-			return
-		}
-		username := make([]byte, userLen)
-		if _, err = io.ReadFull(bufConn, username); err != nil {
-			log.Printf("Failed to read username: %v", err)
-			return
-		}
+func (s *Server) handleConnection(l *listener, state *listenerState, conn net.Conn) {
+	defer conn.Close()
+	profile := state.profile
+	sess := s.newSession(s.ctx, l, conn)
+	defer func() {
+		sess.close()
+		s.onClose(sess)
+	}()
 
-		// Read password
-		passLen, err := bufConn.ReadByte()
-		if err != nil {
-			log.Printf("Failed to read password length: %v", err)
+	if err := s.onAccept(conn); err != nil {
+		sess.log.Info("Connection refused by hook", "err", err)
+		s.stats.rejected.Add(1)
+		sess.setReason(CloseRejected)
+		return
+	}
+	s.event(EventAccepted, sess, nil)
+
+	// The greeting, authentication and request must arrive in time
+	if s.timeouts.Handshake > 0 {
+		sess.handshakeDeadline = time.Now().Add(s.timeouts.Handshake)
+		_ = conn.SetDeadline(sess.handshakeDeadline)
+	}
+
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			sess.log.Info("TLS handshake failed", "err", err)
 			return
 		}
-		password := make([]byte, passLen)
-		if _, err = io.ReadFull(bufConn, password); err != nil {
-			log.Printf("Failed to read password: %v", err)
-			return
+		sess.setIdentity(certIdentity(tlsConn.ConnectionState()))
+		if sess.identity != "" {
+			sess.with("user", sess.identity)
 		}
+	}
+	bufConn := bufio.NewReader(conn)
 
-		// Verify credentials
-		if string(username) != s.username || string(password) != s.password {
-			log.Printf("Invalid credentials")
-			_, _ = conn.Write([]byte{1, 1}) // Auth failed
-			return
+	// The span ends here on the failures, the reason is set by then
+	_, authSpan := startSpan(sess.ctx, "socks5.auth")
+	defer func() {
+		if reason := sess.closeReason(); reason != "" {
+			authSpan.SetStatus(codes.Error, string(reason))
 		}
+		authSpan.End()
+	}()
 
-		// Auth successful
-		_, err = conn.Write([]byte{1, 0})
-		if err != nil {
-			log.Printf("Failed to write auth response: %v", err)
-			return
-		}
+	var greeting wire.Greeting
+	if _, err := greeting.ReadFrom(bufConn); err != nil {
+		sess.log.Debug("Failed to read greeting", "err", err)
+		sess.setReason(handshakeFailure(err))
+		return
 	}
 
-	// Read the request
-	request := make([]byte, 4)
-	_, err = bufConn.Read(request)
-	if err != nil {
-		log.Printf("Failed to read request: %v", err)
+	// With a client CA and no password the certificate is the only credential
+	if l.cfg.ClientCAFile != "" && !profile.authRequired() && sess.identity == "" {
+		sess.log.Info("Client certificate required")
+		s.stats.authFailures.Add(1)
+		s.authResult(sess, "certificate", errCertificateRequired)
+		sess.setReason(CloseAuthFailed)
+		_, _ = (&wire.MethodSelection{Method: wire.MethodNoAcceptable}).WriteTo(conn)
 		return
 	}
 
-	cmd := request[1]
-	if cmd != 1 { // 1 is for TCP/IP stream connection
-		log.Printf("Unsupported command: %d", cmd)
+	// Check authentication method
+	// A verified client certificate already authenticates the client,
+	// unless it only offers username/password
+	passwordAuth := profile.authRequired() && (sess.identity == "" || !greeting.Offers(wire.MethodNoAuth))
+	selection := wire.MethodSelection{Method: wire.MethodNoAuth}
+	if passwordAuth {
+		selection.Method = wire.MethodUserPass
+	}
+	if !greeting.Offers(selection.Method) {
+		sess.log.Info("No acceptable authentication method", "offered", greeting.Methods)
+		sess.setReason(CloseProtocolError)
+		_, _ = (&wire.MethodSelection{Method: wire.MethodNoAcceptable}).WriteTo(conn)
+		return
+	}
+	if _, err := selection.WriteTo(conn); err != nil {
+		sess.log.Debug("Failed to write response", "err", err)
 		return
 	}
 
-	// Read the address type
-	addrType := request[3]
-	var targetHost string
-	var targetPort string
-
-	switch addrType {
-	case 1: // IPv4
-		ip := make([]byte, 4)
-		_, err = io.ReadFull(bufConn, ip)
-		if err != nil {
-			log.Printf("Failed to read IPv4 address: %v", err)
+	// Handle username/password authentication if required
+	if passwordAuth {
+		var auth wire.UserPassRequest
+		if _, err := auth.ReadFrom(bufConn); err != nil {
+			sess.log.Info("Failed to read credentials", "err", err)
+			sess.setReason(handshakeFailure(err))
 			return
 		}
-		targetHost = net.IPv4(ip[0], ip[1], ip[2], ip[3]).String()
-	case 3: // Domain name
-		length, err := bufConn.ReadByte()
-		if err != nil {
-			log.Printf("Failed to read domain length: %v", err)
+		if auth.Username != profile.Username || auth.Password != profile.Password {
+			sess.log.Warn("Invalid credentials", "user", auth.Username)
+			s.stats.authFailures.Add(1)
+			s.authResult(sess, "password", errInvalidCredentials)
+			sess.setReason(CloseAuthFailed)
+			_, _ = (&wire.UserPassReply{Status: wire.UserPassFailed}).WriteTo(conn)
 			return
 		}
-		domain := make([]byte, length)
-		_, err = io.ReadFull(bufConn, domain)
-		if err != nil {
-			log.Printf("Failed to read domain: %v", err)
+		sess.setIdentity(auth.Username)
+		sess.with("user", sess.identity)
+		reply := wire.UserPassReply{Status: wire.UserPassSucceeded}
+		hookErr := s.onAuthenticated(conn, sess.identity)
+		if hookErr != nil {
+			reply.Status = wire.UserPassFailed
+		}
+		if _, err := reply.WriteTo(conn); err != nil {
+			sess.log.Debug("Failed to write auth response", "err", err)
 			return
 		}
-		targetHost = string(domain)
-	case 4: // IPv6
-		ip := make([]byte, 16)
-		_, err = io.ReadFull(bufConn, ip)
-		if err != nil {
-			log.Printf("Failed to read IPv6 address: %v", err)
+		if hookErr != nil {
+			sess.log.Warn("User refused by hook", "err", hookErr)
+			s.stats.authFailures.Add(1)
+			s.authResult(sess, "password", hookErr)
+			sess.setReason(CloseAuthFailed)
 			return
 		}
-		targetHost = net.IP(ip).String()
-	default:
-		log.Printf("Unsupported address type: %d", addrType)
+	} else if err := s.onAuthenticated(conn, sess.identity); err != nil {
+		sess.log.Warn("Client refused by hook", "err", err)
+		s.stats.authFailures.Add(1)
+		s.authResult(sess, authMethod(passwordAuth, sess.identity), err)
+		sess.setReason(CloseAuthFailed)
 		return
 	}
-
-	// Read the port
-	portBytes := make([]byte, 2)
-	_, err = io.ReadFull(bufConn, portBytes)
-	if err != nil {
-		log.Printf("Failed to read port: %v", err)
+	s.authResult(sess, authMethod(passwordAuth, sess.identity), nil)
+	authSpan.SetAttributes(attribute.String("socks5.auth.method", authMethod(passwordAuth, sess.identity)))
+	authSpan.End()
+
+	var request wire.Request
+	if _, err := request.ReadFrom(bufConn); err != nil {
+		sess.log.Info("Invalid request", "err", err)
+		reason := handshakeFailure(err)
+		sess.setReason(reason)
+		var verErr *wire.VersionError
+		if reason == CloseProtocolError && !errors.As(err, &verErr) && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			_ = sess.reply(wire.ReplyCode(err), nil)
+		}
+		return
+	}
+	s.metrics.handshaked(sess.listenerName(), sess.start)
+	handler := s.handlers[request.Command]
+	if handler == nil && request.Command != wire.CmdConnect {
+		sess.log.Info("Unsupported command", "command", request.Command)
+		sess.setReason(CloseProtocolError)
+		_ = sess.reply(wire.RepCommandUnsupported, nil)
+		return
+	}
+	req := &Request{
+		Command:    request.Command,
+		Identity:   sess.identity,
+		ClientAddr: conn.RemoteAddr(),
+		Host:       request.Addr.Host(),
+		Port:       strconv.Itoa(request.Addr.Port),
+		Listener:   l.String(),
+		Profile:    profile,
+		downProxy:  state.downProxy,
+	}
+	sess.setRequest(req.Addr())
+	sess.with("dest", sess.target)
+
+	if !profile.destinationAllowed(req.Host) {
+		sess.log.Info("Destination denied")
+		s.stats.rejected.Add(1)
+		sess.setReason(CloseRejected)
+		_ = sess.reply(wire.RepRulesetDenied, nil)
 		return
 	}
-	targetPort = fmt.Sprintf("%d", (int(portBytes[0])<<8)|int(portBytes[1]))
 
-	var targetConn net.Conn
-	//二级代理的优先级高于系统代理
-	if s.downProxyInfo.Enabled {
-		targetConn, err = s.useDownProxy(targetHost, targetPort)
-		if err != nil {
+	if err := s.onRequest(req); err != nil {
+		sess.log.Info("Request refused by hook", "err", err)
+		s.stats.rejected.Add(1)
+		sess.setReason(CloseRejected)
+		_ = sess.reply(rejectCode(err), nil)
+		return
+	}
+	if target := req.Addr(); target != sess.target {
+		sess.setTarget(target)
+		sess.with("rewritten", sess.target)
+		// The ACL applies to where the connection really goes
+		if !profile.destinationAllowed(req.Host) {
+			sess.log.Info("Rewritten destination denied")
+			s.stats.rejected.Add(1)
+			sess.setReason(CloseRejected)
+			_ = sess.reply(wire.RepRulesetDenied, nil)
 			return
 		}
+	}
 
-		s.forward(targetConn, conn)
+	if !s.admission.admitUser(sess.identity) {
+		sess.log.Info("Too many connections for user")
+		s.stats.limitedPerUser.Add(1)
+		sess.setReason(CloseRejected)
+		_ = sess.reply(wire.RepRulesetDenied, nil)
 		return
 	}
+	defer s.admission.releaseUser(sess.identity)
+
+	sess.open(s)
+	if sess.account.exceeded() {
+		sess.log.Info("Traffic quota exceeded", "key", sess.key)
+		s.stats.rejected.Add(1)
+		sess.setReason(CloseQuotaExceeded)
+		_ = sess.reply(wire.RepRulesetDenied, nil)
+		return
+	}
+	s.event(EventRouted, sess, nil)
 
-	if !s.systemProxy {
-		targetConn, err = net.Dial("tcp", net.JoinHostPort(targetHost, targetPort))
-		if err != nil {
+	if handler != nil {
+		s.serveCommand(handler, conn, bufConn, sess, req)
+		return
+	}
+
+	// With fast open the client may start sending while the dial is in
+	// progress; a failed dial can then only be reported by closing
+	if profile.FastOpen {
+		if err := sess.reply(wire.RepSucceeded, nil); err != nil {
+			sess.log.Debug("Failed to write response", "err", err)
 			return
 		}
-		s.forward(targetConn, conn)
-		return
 	}
 
-	var sysProxy *ProxyInfo
-	sysProxy, err = GetSystemProxy()
+	// The dial is cancelled when the client hangs up or the server shuts down
+	ctx, cancel := context.WithCancel(sess.ctx)
+	defer cancel()
+	dialCtx := ctx
+	if s.timeouts.Dial > 0 {
+		var cancelDial context.CancelFunc
+		dialCtx, cancelDial = context.WithTimeout(ctx, s.timeouts.Dial)
+		defer cancelDial()
+	}
+	stopWatch := watchHangup(conn, bufConn, cancel)
+	targetConn, err := s.dial(dialCtx, req)
+	stopWatch()
 	if err != nil {
-		log.Printf("Failed to get system proxy: %v", err)
+		// Record the upstream that failed in the access log
+		sess.setUpstream(req.Upstream)
+		s.stats.dialFailures.Add(1)
+		switch {
+		case s.ctx.Err() != nil:
+			sess.setReason(CloseShutdown)
+		case ctx.Err() != nil:
+			sess.setReason(CloseClientClosed)
+		case errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded):
+			sess.setReason(CloseDialTimeout)
+		default:
+			sess.setReason(CloseDialFailed)
+		}
+		sess.log.Warn("Failed to connect", "upstream", req.Upstream, "reason", sess.closeReason(), "err", err)
+		s.event(EventDialFailed, sess, err)
+		// Fast open already replied, closing is all that is left
+		if !profile.FastOpen {
+			_ = sess.reply(wire.RepGeneralFailure, nil)
+		}
 		return
 	}
-	if !sysProxy.Enabled {
-		targetConn, err = net.Dial("tcp", net.JoinHostPort(targetHost, targetPort))
-		if err != nil {
+	defer targetConn.Close()
+	_ = conn.SetDeadline(time.Time{})
+	sess.handshakeDeadline = time.Time{}
+	sess.connected(req, targetConn)
+	s.event(EventConnected, sess, nil)
+	sess.log.Debug("Connected", "local", targetConn.LocalAddr().String())
+	s.onConnected(req, targetConn)
+
+	if !profile.FastOpen {
+		if err := sess.reply(wire.RepSucceeded, targetConn.LocalAddr()); err != nil {
+			sess.log.Debug("Failed to write response", "err", err)
 			return
 		}
-		s.forward(targetConn, conn)
-		return
-
 	}
 
-	targetConn, err = s.useSystemProxy(sysProxy, targetHost, targetPort)
-	if err != nil {
-		return
+	// Data the client sent right after the request, such as a TLS
+	// ClientHello, is already buffered and goes first
+	if n := bufConn.Buffered(); n > 0 {
+		pending, _ := bufConn.Peek(n)
+		if _, err := io.Copy(targetConn, sess.reader(bytes.NewReader(pending), true)); err != nil {
+			s.endPipe(err, targetConn, sess, true)
+			return
+		}
 	}
-	s.forward(targetConn, conn)
-	return
+	s.forward(targetConn, conn, sess)
 }
 
-func (s *Server) forward(targetConn net.Conn, conn net.Conn) {
-	if targetConn == nil {
-		return
-	}
-	localAddr := targetConn.LocalAddr().(*net.TCPAddr)
-	ip := localAddr.IP.To4()
-	port := uint16(localAddr.Port)
-
-	// Prepare the response
-	response := make([]byte, 10)
-	response[0] = Socks5Version // VER
-	response[1] = 0             // REP - 0 for success
-	response[2] = 0             // RSV - reserved, must be 0
-
-	if ip != nil {
-		// IPv4
-		response[3] = 1         // ATYP - 1 for IPv4
-		copy(response[4:8], ip) // BND.ADDR
-	} else {
-		// If not IPv4, use 0.0.0.0 as placeholder
-		response[3] = 1 // ATYP - 1 for IPv4
-		response[4] = 0 // BND.ADDR
-		response[5] = 0
-		response[6] = 0
-		response[7] = 0
-	}
-
-	// BND.PORT in network byte order
-	response[8] = byte(port >> 8)
-	response[9] = byte(port & 0xff)
-
-	_, err := conn.Write(response)
+// dial connects to the target of req with the dialer, in a span
+func (s *Server) dial(ctx context.Context, req *Request) (net.Conn, error) {
+	ctx, span := startSpan(ctx, "socks5.dial", attribute.String("socks5.target", req.Addr()))
+	start := time.Now()
+	conn, err := s.dialer.DialContext(ctx, req)
+	s.metrics.dialed(req.Upstream, start, err)
+	span.SetAttributes(attribute.String("socks5.upstream", req.Upstream))
+	endSpan(span, err)
+	return conn, err
+}
+
+// errInvalidCredentials is the auth_failed event of a wrong username or password
+var errInvalidCredentials = errors.New("invalid credentials")
+
+// errCertificateRequired is the auth_failed event of a TLS client without a
+// verified certificate on a listener that has no password
+var errCertificateRequired = errors.New("client certificate required")
+
+// authResult records an authentication in the metrics and the event stream
+func (s *Server) authResult(sess *session, method string, err error) {
+	s.metrics.authenticated(sess.listenerName(), method, err == nil)
 	if err != nil {
-		log.Printf("Failed to write response: %v", err)
+		s.event(EventAuthFailed, sess, err)
 		return
 	}
+	s.event(EventAuthenticated, sess, nil)
+}
 
-	// Start proxying data with proper synchronization
-	var wg sync.WaitGroup
-	wg.Add(2)
+// authMethod names the authentication method for metrics
+func authMethod(passwordAuth bool, identity string) string {
+	switch {
+	case passwordAuth:
+		return "password"
+	case identity != "":
+		return "certificate"
+	}
+	return "none"
+}
 
-	// Copy from client to target
-	go func() {
-		defer wg.Done()
-		defer targetConn.Close() // Close target connection when done
-		_, err := io.Copy(targetConn, conn)
-		if err != nil && !IsConnectionClosed(err) {
-			log.Printf("Failed to copy data from client to target: %v", err)
-		}
-	}()
+// serveCommand hands the connection to a CommandHandler
+func (s *Server) serveCommand(h CommandHandler, conn net.Conn, bufConn *bufio.Reader, sess *session, req *Request) {
+	_ = conn.SetDeadline(time.Time{})
+	sess.handshakeDeadline = time.Time{}
+	if bufConn.Buffered() > 0 {
+		conn = &bufferedConn{Conn: conn, r: bufConn}
+	}
+	if err := h.ServeCommand(sess.ctx, conn, req); err != nil && !IsConnectionClosed(err) {
+		sess.log.Warn("Command handler failed", "command", req.Command, "err", err)
+		sess.setReason(CloseError)
+	}
+	sess.setReason(CloseClientClosed)
+}
 
-	// Copy from target to client
+// watchHangup cancels the dial when the client connection fails or is
+// reset while it is in progress. The returned function stops watching; the
+// buffered reader is then free to be used again.
+func watchHangup(conn net.Conn, r *bufio.Reader, cancel context.CancelFunc) func() {
+	done := make(chan struct{})
 	go func() {
-		defer wg.Done()
-		defer conn.Close() // Close client connection when done
-		_, err := io.Copy(conn, targetConn)
-		if err != nil && !IsConnectionClosed(err) {
-			log.Printf("Failed to copy data from target to client: %v", err)
+		defer close(done)
+		// Pipelined data stays buffered, only a read error or reset
+		// matters. EOF is a half-close: the client still waits for the
+		// reply and the target gets the EOF once connected.
+		_, err := r.Peek(1)
+		if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) && !errors.Is(err, io.EOF) {
+			cancel()
 		}
 	}()
+	return func() {
+		_ = conn.SetReadDeadline(time.Now())
+		<-done
+		_ = conn.SetReadDeadline(time.Time{})
+	}
+}
 
-	// Wait for both copy operations to complete
-	wg.Wait()
+// writeReply sends a reply with the bind address of addr, 0.0.0.0:0 when it
+// is not a TCP or UDP address
+func writeReply(conn net.Conn, rep byte, addr net.Addr) error {
+	_, err := (&wire.Reply{Code: rep, Addr: wire.AddrSpecOf(addr)}).WriteTo(conn)
+	return err
 }
 
-func (s *Server) useDownProxy(targetHost string,
-	targetPort string) (net.Conn, error) {
-	//log.Printf("Using downstream proxy: %s", s.downProxyInfo.Addr)
-	switch s.downProxyInfo.ProxyType {
-	case "http", "https", "socks5":
-		return ConnectViaProxy(s.downProxyInfo.Addr, targetHost, targetPort)
+// forward copies data in both directions until the tunnel ends
+func (s *Server) forward(targetConn net.Conn, conn net.Conn, sess *session) {
+	_, span := startSpan(sess.ctx, "socks5.forward")
+	defer func() {
+		span.SetAttributes(
+			attribute.Int64("socks5.upload_bytes", sess.upload.Load()),
+			attribute.Int64("socks5.download_bytes", sess.download.Load()),
+		)
+		span.End()
+	}()
+
+	// Idle and lifetime timeouts
+	done := make(chan struct{})
+	defer close(done)
+	closeAll := func() {
+		conn.Close()
+		targetConn.Close()
 	}
-	err := fmt.Errorf("unsupported downstream proxy type: %s", s.downProxyInfo.ProxyType)
-	return nil, err
-}
+	sess.setCloser(closeAll)
+	go s.watchdog(sess, closeAll, done)
 
-func (this *Server) useSystemProxy(sysProxy *ProxyInfo, targetHost string, targetPort string) (net.Conn, error) {
-	//log.Printf("Using system proxy: %s", sysProxy.Addr)
-	switch sysProxy.ProxyType {
-	case "http", "https", "socks5":
-		return ConnectViaProxy(sysProxy.Addr, targetHost, targetPort)
+	// A direction that reaches EOF passes it on with a half-close and the
+	// other one keeps flowing until it ends too or the linger timeout expires
+	ended := make(chan bool, 2)
+	go func() {
+		ended <- s.endPipe(s.pipe(targetConn, conn, sess, true), targetConn, sess, true)
+	}()
+	go func() {
+		ended <- s.endPipe(s.pipe(conn, targetConn, sess, false), conn, sess, false)
+	}()
+
+	remaining := 2
+	halfClosed := <-ended
+	remaining--
+	if halfClosed {
+		var linger <-chan time.Time
+		if s.timeouts.Linger > 0 {
+			timer := time.NewTimer(s.timeouts.Linger)
+			defer timer.Stop()
+			linger = timer.C
+		}
+		select {
+		case <-ended:
+			remaining--
+		case <-linger:
+			sess.log.Info("Still open after half-close, closing", "linger", s.timeouts.Linger)
+		}
+	}
+	closeAll()
+	for ; remaining > 0; remaining-- {
+		<-ended
 	}
-	err := fmt.Errorf("unsupported system proxy type: %s", sysProxy.ProxyType)
-	return nil, err
 }
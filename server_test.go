@@ -0,0 +1,421 @@
+package socks5
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dcsunny/socks5/wire"
+)
+
+func testLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// logRecords is a slog.Handler that keeps what is logged, each record as
+// its message under "msg" and its attributes, those of the logger included
+type logRecords struct {
+	mu      *sync.Mutex
+	records *[]map[string]string
+	attrs   []slog.Attr
+}
+
+func newLogRecords() *logRecords {
+	return &logRecords{mu: &sync.Mutex{}, records: &[]map[string]string{}}
+}
+
+func (h *logRecords) Enabled(context.Context, slog.Level) bool { return true }
+
+func (h *logRecords) Handle(_ context.Context, r slog.Record) error {
+	rec := map[string]string{"msg": r.Message}
+	for _, a := range h.attrs {
+		rec[a.Key] = a.Value.String()
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		rec[a.Key] = a.Value.String()
+		return true
+	})
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	*h.records = append(*h.records, rec)
+	return nil
+}
+
+func (h *logRecords) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &logRecords{mu: h.mu, records: h.records, attrs: append(h.attrs[:len(h.attrs):len(h.attrs)], attrs...)}
+}
+
+func (h *logRecords) WithGroup(string) slog.Handler { return h }
+
+// find returns the records with the message
+func (h *logRecords) find(msg string) []map[string]string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var found []map[string]string
+	for _, rec := range *h.records {
+		if rec["msg"] == msg {
+			found = append(found, rec)
+		}
+	}
+	return found
+}
+
+// startServer serves cfg on a loopback port and returns the server and its
+// address. The profile defaults to direct connections without authentication.
+func startServer(t testing.TB, cfg ListenerConfig, opts ...Option) (*Server, string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Network, cfg.Addr, cfg.Listener = "tcp", ln.Addr().String(), ln
+	if cfg.Profile == nil {
+		cfg.Profile = &Profile{}
+	}
+	opts = append([]Option{WithLogger(testLogger())}, opts...)
+	s := NewServer(false, "", "", "", "", append(opts, WithListener(cfg))...)
+	if err := s.Start(); err != nil {
+		ln.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = s.Shutdown(ctx)
+	})
+	return s, cfg.Addr
+}
+
+// startEcho runs a TCP server that writes back what it reads
+func startEcho(t testing.TB) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// closeHook returns an option that reports every finished connection
+func closeHook() (Option, <-chan ConnStats) {
+	closed := make(chan ConnStats, 16)
+	return WithHooks(Hooks{OnClose: func(stats ConnStats) { closed <- stats }}), closed
+}
+
+// nextClose waits for the next finished connection
+func nextClose(t *testing.T, closed <-chan ConnStats) ConnStats {
+	t.Helper()
+	select {
+	case stats := <-closed:
+		return stats
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection did not end")
+		return ConnStats{}
+	}
+}
+
+// echoThrough writes msg to conn and checks that it comes back
+func echoThrough(t *testing.T, conn net.Conn, msg string) {
+	t.Helper()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, msg); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != msg {
+		t.Fatalf("echo = %q, want %q", buf, msg)
+	}
+	_ = conn.SetDeadline(time.Time{})
+}
+
+// replyCode returns the code of a *ReplyError, or -1
+func replyCode(err error) int {
+	var re *ReplyError
+	if errors.As(err, &re) {
+		return int(re.Code)
+	}
+	return -1
+}
+
+// rawConnect sends a greeting without authentication, a CONNECT request for
+// target and data, all at once, without waiting for the server's answers
+func rawConnect(t *testing.T, addr, target string, data []byte) (*net.TCPConn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	dst, err := wire.ParseAddrSpec(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg bytes.Buffer
+	_, _ = (&wire.Greeting{Methods: []byte{wire.MethodNoAuth}}).WriteTo(&msg)
+	_, _ = (&wire.Request{Command: wire.CmdConnect, Addr: dst}).WriteTo(&msg)
+	msg.Write(data)
+	if _, err := conn.Write(msg.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn.(*net.TCPConn), bufio.NewReader(conn)
+}
+
+// readReply reads the method selection and the reply to rawConnect
+func readReply(t *testing.T, r io.Reader) byte {
+	t.Helper()
+	var selection wire.MethodSelection
+	if _, err := selection.ReadFrom(r); err != nil {
+		t.Fatal(err)
+	}
+	var reply wire.Reply
+	if _, err := reply.ReadFrom(r); err != nil {
+		t.Fatal(err)
+	}
+	return reply.Code
+}
+
+// slowDialer connects directly after a delay, or gives up when ctx ends
+type slowDialer time.Duration
+
+func (d slowDialer) DialContext(ctx context.Context, req *Request) (net.Conn, error) {
+	select {
+	case <-time.After(time.Duration(d)):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return (&net.Dialer{}).DialContext(ctx, "tcp", req.Addr())
+}
+
+func TestDialHangup(t *testing.T) {
+	echo := startEcho(t)
+	hook, closed := closeHook()
+	_, addr := startServer(t, ListenerConfig{}, hook, WithDialer(slowDialer(200*time.Millisecond)))
+
+	// A client that half-closes during the dial still gets its tunnel, and
+	// the target the EOF
+	conn, r := rawConnect(t, addr, echo, nil)
+	if err := conn.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if code := readReply(t, r); code != wire.RepSucceeded {
+		t.Fatalf("reply %d, want success", code)
+	}
+	if rest, err := io.ReadAll(r); err != nil || len(rest) != 0 {
+		t.Fatalf("read %q, %v; want EOF", rest, err)
+	}
+	if stats := nextClose(t, closed); stats.Reason != CloseClientClosed && stats.Reason != CloseTargetClosed {
+		t.Errorf("reason = %s, want a clean close", stats.Reason)
+	}
+
+	// A reset cancels the dial
+	conn, _ = rawConnect(t, addr, echo, nil)
+	time.Sleep(50 * time.Millisecond)
+	_ = conn.SetLinger(0)
+	conn.Close()
+	start := time.Now()
+	stats := nextClose(t, closed)
+	if d := time.Since(start); stats.Reason != CloseClientClosed || d > 100*time.Millisecond {
+		t.Errorf("reason = %s after %v, want %s before the dial ends", stats.Reason, d, CloseClientClosed)
+	}
+}
+
+func TestInheritedListenerDefaults(t *testing.T) {
+	f := newTLSFixture(t)
+	echo := startEcho(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An unnamed systemd socket, or one passed on by an upgrade, that no
+	// listener config claims
+	s := NewServer(false, "", "", "", "",
+		WithLogger(testLogger()),
+		WithInheritedListeners([]ActivatedListener{{Name: "0", Listener: ln}}),
+		WithDefaultListener(ListenerConfig{
+			TLSCertFile:  f.certFile,
+			TLSKeyFile:   f.keyFile,
+			ClientCAFile: f.caFile,
+			Profile:      &Profile{Username: "user", Password: "secret"},
+		}),
+	)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+
+	conn, err := f.dialer(t, ln.Addr().String(), "alice").Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoThrough(t, conn, "hello")
+	conn.Close()
+
+	// The default profile applies too, and follows Reload
+	if _, err := f.dialer(t, ln.Addr().String(), "").Dial("tcp", echo); err == nil {
+		t.Fatal("connected without credentials")
+	}
+	if err := s.Reload(&Profile{Username: "other", Password: "changed"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	d := f.dialer(t, ln.Addr().String(), "")
+	d.Username, d.Password = "other", "changed"
+	conn, err = d.Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoThrough(t, conn, "hello")
+	conn.Close()
+}
+
+// eventsUntilClosed collects the events of sub up to the next closed one
+func eventsUntilClosed(t *testing.T, sub *Subscription) []EventType {
+	t.Helper()
+	var types []EventType
+	for {
+		select {
+		case ev := <-sub.C:
+			types = append(types, ev.Type)
+			if ev.Type == EventClosed {
+				return types
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no closed event after %v", types)
+		}
+	}
+}
+
+func TestFastOpen(t *testing.T) {
+	echo := startEcho(t)
+	hook, closed := closeHook()
+	s, addr := startServer(t, ListenerConfig{Profile: &Profile{FastOpen: true}}, hook,
+		WithDialer(slowDialer(300*time.Millisecond)))
+	sub := s.Subscribe(0)
+
+	// The reply comes before the dial ends, data sent with the request
+	// waits for it
+	start := time.Now()
+	conn, r := rawConnect(t, addr, echo, []byte("hello"))
+	var selection wire.MethodSelection
+	var reply wire.Reply
+	if _, err := selection.ReadFrom(r); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reply.ReadFrom(r); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); reply.Code != wire.RepSucceeded || d > 200*time.Millisecond {
+		t.Fatalf("reply %d after %v, want success before the dial ends", reply.Code, d)
+	}
+	if reply.Addr.String() != "0.0.0.0:0" {
+		t.Errorf("bound address %v, want none yet", reply.Addr)
+	}
+	buf := make([]byte, len("hello"))
+	if _, err := io.ReadFull(r, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("echo %q, %v; want hello", buf, err)
+	}
+	conn.Close()
+	nextClose(t, closed)
+	eventsUntilClosed(t, sub)
+
+	// A failed dial can only close the connection, it is reported once
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := ln.Addr().String()
+	ln.Close()
+	_, r = rawConnect(t, addr, down, []byte("hello"))
+	if code := readReply(t, r); code != wire.RepSucceeded {
+		t.Fatalf("reply %d, want success", code)
+	}
+	if rest, err := io.ReadAll(r); len(rest) != 0 || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read %q, %v; want the connection closed", rest, err)
+	}
+	if stats := nextClose(t, closed); stats.Reason != CloseDialFailed {
+		t.Errorf("reason = %s, want %s", stats.Reason, CloseDialFailed)
+	}
+	var failures int
+	for _, typ := range eventsUntilClosed(t, sub) {
+		if typ == EventDialFailed {
+			failures++
+		}
+	}
+	if failures != 1 {
+		t.Errorf("%d dial_failed events, want 1", failures)
+	}
+}
+
+func TestConnectionLog(t *testing.T) {
+	echo := startEcho(t)
+	hook, closed := closeHook()
+	logs := newLogRecords()
+	_, addr := startServer(t, ListenerConfig{Profile: &Profile{
+		Username: "user", Password: "secret", DenyDestinations: []string{"blocked.test"},
+	}}, hook, WithLogger(slog.New(logs)))
+
+	conn := tunnel(t, userDialer(addr), echo)
+	echoThrough(t, conn, "hello")
+	conn.Close()
+	ok := nextClose(t, closed)
+	if _, err := userDialer(addr).Dial("tcp", "blocked.test:80"); err == nil {
+		t.Fatal("connected to blocked.test")
+	}
+	rejected := nextClose(t, closed)
+	if _, err := (&Dialer{ProxyAddr: addr, Username: "user", Password: "wrong"}).Dial("tcp", echo); err == nil {
+		t.Fatal("connected with a wrong password")
+	}
+	failed := nextClose(t, closed)
+
+	// The close record carries the connection's ID and fields and why it ended
+	for _, stats := range []ConnStats{ok, rejected, failed} {
+		var found []map[string]string
+		for _, rec := range logs.find("Connection closed") {
+			if rec["conn"] == strconv.FormatUint(stats.ID, 10) {
+				found = append(found, rec)
+			}
+		}
+		if len(found) != 1 {
+			t.Errorf("conn %d: %d close records, want 1", stats.ID, len(found))
+			continue
+		}
+		rec := found[0]
+		if rec["reason"] != string(stats.Reason) || rec["listener"] != stats.Listener || rec["client"] != stats.ClientAddr.String() {
+			t.Errorf("conn %d closed with %s: record %v", stats.ID, stats.Reason, rec)
+		}
+		if stats.Reason != CloseAuthFailed && (rec["user"] != "user" || rec["dest"] != stats.Requested) {
+			t.Errorf("conn %d: record %v, want user and dest %s", stats.ID, rec, stats.Requested)
+		}
+	}
+	if ok.Reason != CloseClientClosed || rejected.Reason != CloseRejected || failed.Reason != CloseAuthFailed {
+		t.Errorf("reasons %s, %s, %s", ok.Reason, rejected.Reason, failed.Reason)
+	}
+	if ok.ID == rejected.ID || rejected.ID == failed.ID {
+		t.Errorf("connection IDs %d, %d, %d are not unique", ok.ID, rejected.ID, failed.ID)
+	}
+}
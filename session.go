@@ -0,0 +1,300 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// CloseReason tells why a connection ended
+type CloseReason string
+
+const (
+	CloseClientClosed     CloseReason = "client_closed"     // 客户端先关闭
+	CloseTargetClosed     CloseReason = "target_closed"     // 目标先关闭
+	CloseHandshakeTimeout CloseReason = "handshake_timeout" // 握手、认证或请求超时
+	CloseDialTimeout      CloseReason = "dial_timeout"      // 连接目标超时
+	CloseDialFailed       CloseReason = "dial_failed"       // 连接目标失败
+	CloseIdleTimeout      CloseReason = "idle_timeout"      // 空闲超时
+	CloseLifetimeExceeded CloseReason = "lifetime_exceeded" // 超过最长存活时间
+	CloseQuotaExceeded    CloseReason = "quota_exceeded"    // 流量配额用尽
+	CloseRejected         CloseReason = "rejected"          // 被 ACL 或连接数限制拒绝
+	CloseAuthFailed       CloseReason = "auth_failed"       // 认证失败
+	CloseProtocolError    CloseReason = "protocol_error"    // 握手数据不合法或不支持
+	CloseError            CloseReason = "error"             // 转发时出错
+	CloseShutdown         CloseReason = "server_shutdown"   // 服务关闭
+	CloseKilled           CloseReason = "killed"            // 通过 CloseSession 或管理接口关闭
+)
+
+// failed tells whether the connection ended because something went wrong,
+// rather than by either side or by policy
+func (r CloseReason) failed() bool {
+	switch r {
+	case CloseHandshakeTimeout, CloseDialTimeout, CloseDialFailed, CloseAuthFailed, CloseProtocolError, CloseError:
+		return true
+	}
+	return false
+}
+
+// handshakeFailure is the close reason of a failed read during the
+// handshake: its deadline passed, or the client sent something invalid
+func handshakeFailure(err error) CloseReason {
+	var ne net.Error
+	if errors.Is(err, os.ErrDeadlineExceeded) || (errors.As(err, &ne) && ne.Timeout()) {
+		return CloseHandshakeTimeout
+	}
+	return CloseProtocolError
+}
+
+// session is the per-connection state shared by limiting, accounting and timeouts
+type session struct {
+	id       uint64 // 连接 ID，日志、钩子和访问日志中用于关联
+	log      *slog.Logger
+	ctx      context.Context // 带有连接的 span，在 Server 停止时取消
+	span     trace.Span
+	listener *listener
+	conn     net.Conn
+	start    time.Time
+	identity string // 认证后的用户身份：客户端证书的 CN/SAN 或用户名
+	key      string // 限速和流量统计的标识：用户身份，未认证时为客户端 IP
+	target   string // 请求的目标地址 host:port，OnRequest 改写后为改写的地址
+	request  string // 客户端请求的原始目标
+	resolved string // 直连时目标的 IP
+	upstream string // 实际使用的上游
+	rep      int    // 发给客户端的回复码，未回复时为 -1
+
+	handshakeDeadline time.Time
+
+	upload     atomic.Int64 // 客户端到目标的字节数
+	download   atomic.Int64 // 目标到客户端的字节数
+	lastActive atomic.Int64 // 最后一次收发数据的时间，UnixNano
+
+	limiter *connLimiter
+	account *accountEntry
+	metrics *metrics
+	traffic *traffic // 按上游统计的字节数，连接目标后才有
+
+	// mu guards reason and closer, and the fields above that Sessions
+	// reads while the connection is being served
+	mu     sync.Mutex
+	reason CloseReason
+	closer func() // 关闭连接，CloseSession 时调用
+
+	killed   chan struct{} // CloseSession 时关闭，结束限速等待
+	killOnce sync.Once
+}
+
+// newSession creates the state of an accepted connection, or of a
+// LocalDialer connection when l and conn are nil. Its span is a child of
+// the one in ctx and ends in onClose.
+func (s *Server) newSession(ctx context.Context, l *listener, conn net.Conn) *session {
+	sess := &session{
+		id:       s.connID.Add(1),
+		listener: l,
+		conn:     conn,
+		start:    time.Now(),
+		rep:      -1,
+		metrics:  s.metrics,
+		killed:   make(chan struct{}),
+	}
+	sess.lastActive.Store(sess.start.UnixNano())
+	sess.log = s.logger.With("conn", sess.id, "listener", sess.listenerName())
+	attrs := []attribute.KeyValue{
+		attribute.Int64("socks5.conn", int64(sess.id)),
+		attribute.String("socks5.listener", sess.listenerName()),
+	}
+	if conn != nil {
+		sess.log = sess.log.With("client", conn.RemoteAddr().String())
+		attrs = append(attrs, attribute.String("client.address", conn.RemoteAddr().String()))
+	}
+	sess.ctx, sess.span = s.tracer.Start(ctx, "socks5.connection",
+		trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(attrs...))
+	if conn != nil {
+		sess.closer = func() { conn.Close() }
+	}
+
+	s.mu.Lock()
+	if s.sessions == nil {
+		s.sessions = make(map[uint64]*session)
+	}
+	s.sessions[sess.id] = sess
+	s.mu.Unlock()
+	return sess
+}
+
+// reply sends a reply to the client and records its code
+func (sess *session) reply(rep byte, addr net.Addr) error {
+	sess.rep = int(rep)
+	return writeReply(sess.conn, rep, addr)
+}
+
+// connected records where the target was reached
+func (sess *session) connected(req *Request, target net.Conn) {
+	sess.traffic = sess.metrics.traffic(req.Upstream)
+	sess.mu.Lock()
+	sess.upstream = req.Upstream
+	if req.Upstream == UpstreamDirect {
+		if ip := addrIP(target.RemoteAddr()); ip != nil {
+			sess.resolved = ip.String()
+		}
+	}
+	sess.mu.Unlock()
+	sess.with("upstream", req.Upstream)
+}
+
+func (sess *session) setIdentity(identity string) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	sess.identity = identity
+}
+
+// setRequest records the target the client asked for
+func (sess *session) setRequest(target string) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	sess.request = target
+	sess.target = target
+}
+
+func (sess *session) setTarget(target string) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	sess.target = target
+}
+
+func (sess *session) setUpstream(upstream string) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	sess.upstream = upstream
+}
+
+// setCloser replaces what kill closes, e.g. both sides once forwarding
+func (sess *session) setCloser(closer func()) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	sess.closer = closer
+}
+
+// kill ends the connection from outside its goroutine
+func (sess *session) kill() {
+	sess.setReason(CloseKilled)
+	sess.killOnce.Do(func() { close(sess.killed) })
+	sess.mu.Lock()
+	closer := sess.closer
+	sess.mu.Unlock()
+	if closer != nil {
+		closer()
+	}
+}
+
+// with adds fields to the records of the connection from now on
+func (sess *session) with(args ...any) {
+	sess.log = sess.log.With(args...)
+}
+
+// open attaches the limiter and the accounting of the authenticated user
+func (sess *session) open(s *Server) {
+	if sess.key == "" {
+		sess.key = sess.identity
+	}
+	if sess.key == "" {
+		if ip := addrIP(sess.clientAddr()); ip != nil {
+			sess.key = ip.String()
+		}
+	}
+	sess.limiter = s.limiter.open(sess.key, sess.killed)
+	sess.account = s.accounting.open(sess.key)
+}
+
+func (sess *session) close() {
+	if sess.limiter != nil {
+		sess.limiter.close()
+	}
+	// A handshake cut short by its deadline
+	if !sess.handshakeDeadline.IsZero() && !time.Now().Before(sess.handshakeDeadline) {
+		sess.setReason(CloseHandshakeTimeout)
+	}
+}
+
+// clientAddr is nil for connections made with LocalDialer
+func (sess *session) clientAddr() net.Addr {
+	if sess.conn == nil {
+		return nil
+	}
+	return sess.conn.RemoteAddr()
+}
+
+func (sess *session) listenerName() string {
+	if sess.listener == nil {
+		return localListener
+	}
+	return sess.listener.String()
+}
+
+// setReason records why the connection ended, the first reason wins
+func (sess *session) setReason(reason CloseReason) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if sess.reason == "" {
+		sess.reason = reason
+	}
+}
+
+func (sess *session) closeReason() CloseReason {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	return sess.reason
+}
+
+func (sess *session) lastActiveTime() time.Time {
+	return time.Unix(0, sess.lastActive.Load())
+}
+
+// count records n bytes moved in one direction and reports whether the
+// user has run out of quota
+func (sess *session) count(n int, upload bool) bool {
+	if upload {
+		sess.upload.Add(int64(n))
+	} else {
+		sess.download.Add(int64(n))
+	}
+	sess.lastActive.Store(time.Now().UnixNano())
+	sess.traffic.add(n, upload)
+	return sess.account.add(n, upload)
+}
+
+// reader meters, limits and accounts reads from src; upload is the client
+// to target direction
+func (sess *session) reader(src io.Reader, upload bool) io.Reader {
+	return &meteredReader{r: sess.limiter.reader(src, upload), sess: sess, upload: upload}
+}
+
+type meteredReader struct {
+	r      io.Reader
+	sess   *session
+	upload bool
+}
+
+func (m *meteredReader) Read(p []byte) (int, error) {
+	n, err := m.r.Read(p)
+	if n > 0 && m.sess.count(n, m.upload) && err == nil {
+		// Let the data through and stop at the next read
+		m.r = quotaExceededReader{}
+	}
+	return n, err
+}
+
+type quotaExceededReader struct{}
+
+func (quotaExceededReader) Read([]byte) (int, error) {
+	return 0, errQuotaExceeded
+}
@@ -0,0 +1,58 @@
+package socks5
+
+import "sync/atomic"
+
+// Stats is a snapshot of the counters shared by all listeners of a Server
+type Stats struct {
+	Accepted     uint64 `json:"accepted"`      // 已接受的连接数
+	Active       int64  `json:"active"`        // 当前活跃连接数
+	Rejected     uint64 `json:"rejected"`      // 被 ACL、钩子或流量配额拒绝的连接数
+	AuthFailures uint64 `json:"auth_failures"` // 认证失败次数
+	DialFailures uint64 `json:"dial_failures"` // 连接目标失败次数
+
+	LimitedPerIP    uint64 `json:"limited_per_ip"`   // 超过单 IP 并发数被拒绝的连接数
+	LimitedRate     uint64 `json:"limited_rate"`     // 超过单 IP 新建连接速率被拒绝的连接数
+	LimitedPerUser  uint64 `json:"limited_per_user"` // 超过单用户并发数被拒绝的请求数
+	LimitedListener uint64 `json:"limited_listener"` // 超过监听器并发数被拒绝的连接数
+	LimitedTotal    uint64 `json:"limited_total"`    // 超过总并发数被拒绝的连接数
+
+	AccessLogDropped uint64 `json:"access_log_dropped"` // 访问日志队列满而丢弃的记录数
+	EventsDropped    uint64 `json:"events_dropped"`     // 事件订阅者缓冲区满而丢弃的事件数
+}
+
+type serverStats struct {
+	accepted     atomic.Uint64
+	active       atomic.Int64
+	rejected     atomic.Uint64
+	authFailures atomic.Uint64
+	dialFailures atomic.Uint64
+
+	limitedPerIP    atomic.Uint64
+	limitedRate     atomic.Uint64
+	limitedPerUser  atomic.Uint64
+	limitedListener atomic.Uint64
+	limitedTotal    atomic.Uint64
+}
+
+// Stats returns the current counters
+func (s *Server) Stats() Stats {
+	stats := Stats{
+		Accepted:     s.stats.accepted.Load(),
+		Active:       s.stats.active.Load(),
+		Rejected:     s.stats.rejected.Load(),
+		AuthFailures: s.stats.authFailures.Load(),
+		DialFailures: s.stats.dialFailures.Load(),
+
+		LimitedPerIP:    s.stats.limitedPerIP.Load(),
+		LimitedRate:     s.stats.limitedRate.Load(),
+		LimitedPerUser:  s.stats.limitedPerUser.Load(),
+		LimitedListener: s.stats.limitedListener.Load(),
+		LimitedTotal:    s.stats.limitedTotal.Load(),
+
+		EventsDropped: s.events.dropped.Load(),
+	}
+	if s.accessLog != nil {
+		stats.AccessLogDropped = s.accessLog.dropped.Load()
+	}
+	return stats
+}
@@ -0,0 +1,112 @@
+package socks5
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd
+const listenFdsStart = 3
+
+// ActivatedListener is a socket inherited through LISTEN_FDS
+type ActivatedListener struct {
+	Name     string // LISTEN_FDNAMES 中的名称，未命名时为 fd 序号
+	Listener net.Listener
+}
+
+// ActivationListeners returns the listening sockets passed by systemd socket
+// activation. It returns nil when LISTEN_FDS is not set or is meant for
+// another process. The environment is cleared so children do not inherit it.
+func ActivationListeners() ([]ActivatedListener, error) {
+	if pid := os.Getenv("LISTEN_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	fds := os.Getenv("LISTEN_FDS")
+	if fds == "" {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS: %q", fds)
+	}
+	var names []string
+	if v := os.Getenv("LISTEN_FDNAMES"); v != "" {
+		names = strings.Split(v, ":")
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	listeners := make([]ActivatedListener, 0, n)
+	for i := 0; i < n; i++ {
+		name := strconv.Itoa(i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(listenFdsStart+i), name)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, al := range listeners {
+				al.Listener.Close()
+			}
+			return nil, fmt.Errorf("inherited socket %s is not a stream listener: %v", name, err)
+		}
+		listeners = append(listeners, ActivatedListener{Name: name, Listener: ln})
+	}
+	return listeners, nil
+}
+
+// SdNotify sends a state such as "READY=1" or "STOPPING=1" to the service
+// manager. It reports false without error when NOTIFY_SOCKET is not set.
+func SdNotify(state string) (bool, error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return false, nil
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// SdWatchdog pings the systemd watchdog at half of WATCHDOG_USEC until ctx is
+// done. It returns immediately when the watchdog is not enabled for us.
+func SdWatchdog(ctx context.Context) {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(usec) * time.Microsecond / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			_, _ = SdNotify("WATCHDOG=1")
+		}
+	}
+}
+
+// WritePidFile writes the current process id to path
+func WritePidFile(path string) error {
+	return writePidFile(path, os.Getpid())
+}
+
+func writePidFile(path string, pid int) error {
+	return os.WriteFile(path, []byte(strconv.Itoa(pid)+"\n"), 0644)
+}
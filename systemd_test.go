@@ -0,0 +1,157 @@
+//go:build !windows
+
+package socks5
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// activationChildEnv makes the test binary print the listeners it inherits
+const activationChildEnv = "SOCKS5_TEST_ACTIVATION_CHILD"
+
+// activationChild prints the name and address of each activated listener,
+// then what is left of LISTEN_FDS
+func activationChild() {
+	listeners, err := ActivationListeners()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "activation child:", err)
+		os.Exit(1)
+	}
+	for _, al := range listeners {
+		fmt.Printf("%s %s\n", al.Name, al.Listener.Addr())
+	}
+	fmt.Printf("LISTEN_FDS=%s\n", os.Getenv("LISTEN_FDS"))
+	os.Exit(0)
+}
+
+// activate runs the test binary with files as fds 3 and up and the
+// activation environment, returning its output
+func activate(t *testing.T, files []*os.File, env ...string) (string, error) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	cmd.Env = append(os.Environ(), append(env, activationChildEnv+"=1")...)
+	cmd.ExtraFiles = files
+	out, err := cmd.CombinedOutput()
+	return string(out), err
+}
+
+func TestActivationListeners(t *testing.T) {
+	var files []*os.File
+	var want []string
+	for _, name := range []string{"socks", "1"} {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		f, err := ln.(*net.TCPListener).File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		files = append(files, f)
+		want = append(want, name+" "+ln.Addr().String())
+	}
+
+	// Unnamed sockets are named by their index
+	out, err := activate(t, files, "LISTEN_FDS=2", "LISTEN_FDNAMES=socks:")
+	if err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	if want := strings.Join(want, "\n") + "\nLISTEN_FDS=\n"; out != want {
+		t.Errorf("child printed %q, want %q", out, want)
+	}
+
+	// A socket that is not listening is an error
+	f, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if out, err := activate(t, []*os.File{f}, "LISTEN_FDS=1"); err == nil || !strings.Contains(out, "not a stream listener") {
+		t.Errorf("child exited with %v: %s; want not a stream listener", err, out)
+	}
+}
+
+func TestActivationListenersEnv(t *testing.T) {
+	tests := []struct {
+		env     map[string]string
+		wantErr bool
+	}{
+		{env: map[string]string{}},
+		{env: map[string]string{"LISTEN_FDS": "2", "LISTEN_PID": strconv.Itoa(os.Getpid() + 1)}},
+		{env: map[string]string{"LISTEN_FDS": "0", "LISTEN_PID": strconv.Itoa(os.Getpid())}},
+		{env: map[string]string{"LISTEN_FDS": "two"}, wantErr: true},
+		{env: map[string]string{"LISTEN_FDS": "-1"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Setenv("LISTEN_FDS", "")
+		t.Setenv("LISTEN_PID", "")
+		for k, v := range tt.env {
+			t.Setenv(k, v)
+		}
+		listeners, err := ActivationListeners()
+		if (err != nil) != tt.wantErr || len(listeners) != 0 {
+			t.Errorf("%v: %d listeners, %v", tt.env, len(listeners), err)
+		}
+	}
+}
+
+func TestSdNotify(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if sent, err := SdNotify("READY=1"); sent || err != nil {
+		t.Errorf("without NOTIFY_SOCKET: %v, %v; want nothing sent", sent, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	read := func() string {
+		t.Helper()
+		buf := make([]byte, 64)
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf[:n])
+	}
+	t.Setenv("NOTIFY_SOCKET", path)
+	if sent, err := SdNotify("READY=1"); !sent || err != nil {
+		t.Fatalf("SdNotify = %v, %v", sent, err)
+	}
+	if msg := read(); msg != "READY=1" {
+		t.Errorf("received %q, want READY=1", msg)
+	}
+
+	// The watchdog pings at half the interval
+	t.Setenv("WATCHDOG_USEC", "20000")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		SdWatchdog(ctx)
+	}()
+	if msg := read(); msg != "WATCHDOG=1" {
+		t.Errorf("received %q, want WATCHDOG=1", msg)
+	}
+	cancel()
+	<-done
+
+	t.Setenv("NOTIFY_SOCKET", filepath.Join(t.TempDir(), "missing.sock"))
+	if sent, err := SdNotify("READY=1"); sent || err == nil {
+		t.Errorf("to a missing socket: %v, %v; want an error", sent, err)
+	}
+}
@@ -0,0 +1,62 @@
+package socks5
+
+import (
+	"time"
+)
+
+// Timeouts bound the phases of a connection; 0 disables a timeout
+type Timeouts struct {
+	Handshake time.Duration // 从接受连接到读完请求（含 TLS 握手和认证）
+	Dial      time.Duration // 连接目标或上游代理
+	Idle      time.Duration // 双向都没有数据的最长时间
+	Lifetime  time.Duration // 连接的最长存活时间
+	Linger    time.Duration // 一个方向结束（半关闭）后等待另一个方向结束的最长时间
+}
+
+// WithTimeouts sets the connection timeouts
+func WithTimeouts(t Timeouts) Option {
+	return func(s *Server) {
+		s.timeouts = t
+	}
+}
+
+// watchdog closes the tunnel when it has been idle or alive for too long.
+// It returns when done is closed.
+func (s *Server) watchdog(sess *session, closeAll func(), done <-chan struct{}) {
+	idle, lifetime := s.timeouts.Idle, s.timeouts.Lifetime
+	if idle <= 0 && lifetime <= 0 {
+		return
+	}
+	var deadline time.Time
+	if lifetime > 0 {
+		deadline = sess.start.Add(lifetime)
+	}
+	for {
+		next := deadline
+		if idle > 0 {
+			idleAt := sess.lastActiveTime().Add(idle)
+			if next.IsZero() || idleAt.Before(next) {
+				next = idleAt
+			}
+		}
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-done:
+			timer.Stop()
+			return
+		case now := <-timer.C:
+			if lifetime > 0 && !now.Before(deadline) {
+				sess.log.Info("Lifetime exceeded, closing", "lifetime", lifetime)
+				sess.setReason(CloseLifetimeExceeded)
+				closeAll()
+				return
+			}
+			if idle > 0 && now.Sub(sess.lastActiveTime()) >= idle {
+				sess.log.Info("Idle timeout, closing", "idle", idle)
+				sess.setReason(CloseIdleTimeout)
+				closeAll()
+				return
+			}
+		}
+	}
+}
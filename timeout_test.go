@@ -0,0 +1,76 @@
+package socks5
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHandshakeTimeout(t *testing.T) {
+	hook, closed := closeHook()
+	_, addr := startServer(t, ListenerConfig{Profile: &Profile{Username: "user", Password: "secret"}}, hook,
+		WithTimeouts(Timeouts{Handshake: 200 * time.Millisecond}))
+
+	tests := []struct {
+		name   string
+		send   []byte
+		reason CloseReason
+	}{
+		{"silent", nil, CloseHandshakeTimeout},
+		{"partial greeting", []byte{0x05, 0x02, 0x00}, CloseHandshakeTimeout},
+		{"partial credentials", []byte{0x05, 0x01, 0x02, 0x01, 0x04, 'u', 's'}, CloseHandshakeTimeout},
+		{"invalid greeting", []byte{0x04, 0x01, 0x00}, CloseProtocolError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if _, err := conn.Write(tt.send); err != nil {
+				t.Fatal(err)
+			}
+			// The server hangs up, after its method selection if any
+			_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if _, err := io.Copy(io.Discard, conn); err != nil {
+				t.Fatalf("connection not closed: %v", err)
+			}
+			if stats := nextClose(t, closed); stats.Reason != tt.reason {
+				t.Errorf("reason = %s, want %s", stats.Reason, tt.reason)
+			}
+		})
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	echo := startEcho(t)
+	for _, name := range []string{"splice", "buffered"} {
+		t.Run(name, func(t *testing.T) {
+			hook, closed := closeHook()
+			opts := append(forwardPaths[name][:len(forwardPaths[name]):len(forwardPaths[name])], hook,
+				WithTimeouts(Timeouts{Idle: 300 * time.Millisecond}))
+			_, addr := startServer(t, ListenerConfig{}, opts...)
+			conn, err := (&Dialer{ProxyAddr: addr}).Dial("tcp", echo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			// A slow transfer keeps the tunnel open
+			for i := 0; i < 10; i++ {
+				echoThrough(t, conn, "x")
+				time.Sleep(100 * time.Millisecond)
+			}
+			// A silent one does not
+			_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if _, err := io.Copy(io.Discard, conn); err != nil {
+				t.Fatalf("connection not closed: %v", err)
+			}
+			if stats := nextClose(t, closed); stats.Reason != CloseIdleTimeout || stats.Upload != 10 {
+				t.Errorf("closed with %s after %d bytes, want %s after 10", stats.Reason, stats.Upload, CloseIdleTimeout)
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package socks5
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// tlsFiles loads the listener certificate and the optional client CA bundle
+// from disk and reloads them whenever the files change.
+type tlsFiles struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+	logger       *slog.Logger
+
+	mu          sync.Mutex
+	cert        *tls.Certificate
+	certMod     time.Time
+	keyMod      time.Time
+	certFailure string // 上次重新加载证书失败的原因，同一失败只警告一次
+	clientCAs   *x509.CertPool
+	caMod       time.Time
+	caFailure   string
+}
+
+func newTLSFiles(certFile, keyFile, clientCAFile string, logger *slog.Logger) (*tlsFiles, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("tls cert and key files are required")
+	}
+	t := &tlsFiles{
+		certFile:     certFile,
+		keyFile:      keyFile,
+		clientCAFile: clientCAFile,
+		logger:       logger,
+	}
+	if _, err := t.certificate(); err != nil {
+		return nil, err
+	}
+	if _, err := t.clientCAPool(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// serverConfig returns a tls.Config that picks up reloaded files on every handshake.
+func (t *tlsFiles) serverConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, err := t.certificate()
+			if err != nil {
+				return nil, err
+			}
+			cfg := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*cert},
+			}
+			pool, err := t.clientCAPool()
+			if err != nil {
+				return nil, err
+			}
+			if pool != nil {
+				cfg.ClientCAs = pool
+				cfg.ClientAuth = tls.VerifyClientCertIfGiven
+			}
+			return cfg, nil
+		},
+	}
+}
+
+func (t *tlsFiles) certificate() (*tls.Certificate, error) {
+	certMod, err := modTime(t.certFile)
+	var keyMod time.Time
+	if err == nil {
+		keyMod, err = modTime(t.keyFile)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err == nil && t.cert != nil && certMod.Equal(t.certMod) && keyMod.Equal(t.keyMod) {
+		return t.cert, nil
+	}
+	var cert tls.Certificate
+	if err == nil {
+		cert, err = tls.LoadX509KeyPair(t.certFile, t.keyFile)
+	}
+	if err != nil {
+		if t.cert != nil {
+			// Keep serving the previous pair while the files are being replaced
+			t.warn(&t.certFailure, fmt.Sprint(certMod, keyMod, err), "Failed to reload TLS key pair, keeping the previous one", "cert", t.certFile, "err", err)
+			return t.cert, nil
+		}
+		return nil, fmt.Errorf("failed to load tls key pair: %v", err)
+	}
+	t.cert, t.certMod, t.keyMod, t.certFailure = &cert, certMod, keyMod, ""
+	return t.cert, nil
+}
+
+func (t *tlsFiles) clientCAPool() (*x509.CertPool, error) {
+	if t.clientCAFile == "" {
+		return nil, nil
+	}
+	caMod, err := modTime(t.clientCAFile)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err == nil && t.clientCAs != nil && caMod.Equal(t.caMod) {
+		return t.clientCAs, nil
+	}
+	var pool *x509.CertPool
+	if err == nil {
+		pool, err = loadCertPool(t.clientCAFile)
+	}
+	if err != nil {
+		if t.clientCAs != nil {
+			// Like the key pair, keep verifying with the previous bundle
+			t.warn(&t.caFailure, fmt.Sprint(caMod, err), "Failed to reload client CA, keeping the previous one", "client_ca", t.clientCAFile, "err", err)
+			return t.clientCAs, nil
+		}
+		return nil, err
+	}
+	t.clientCAs, t.caMod, t.caFailure = pool, caMod, ""
+	return t.clientCAs, nil
+}
+
+func loadCertPool(name string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client ca: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", name)
+	}
+	return pool, nil
+}
+
+// warn logs a failed reload unless it is the same failure as last time,
+// handshakes keep retrying until the files are fixed
+func (t *tlsFiles) warn(last *string, failure string, msg string, args ...any) {
+	if *last == failure {
+		return
+	}
+	*last = failure
+	t.logger.Warn(msg, args...)
+}
+
+func modTime(name string) (time.Time, error) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return fi.ModTime(), nil
+}
+
+// certIdentity returns the identity carried by a verified client certificate:
+// the subject CN, or the first SAN when the CN is empty.
+func certIdentity(state tls.ConnectionState) string {
+	if len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	cert := state.PeerCertificates[0]
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName
+	}
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0]
+	}
+	if len(cert.EmailAddresses) > 0 {
+		return cert.EmailAddresses[0]
+	}
+	if len(cert.URIs) > 0 {
+		return cert.URIs[0].String()
+	}
+	return ""
+}
@@ -0,0 +1,263 @@
+package socks5
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a PEM certificate and key for cn, usable by 127.0.0.1
+func (ca *testCA) issue(t *testing.T, cn string, usage x509.ExtKeyUsage) ([]byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// writeFile writes data and moves the modification time forward, so that
+// a rewrite within the file system's timestamp granularity is noticed
+func writeFile(t *testing.T, name string, data []byte) {
+	t.Helper()
+	var mod time.Time
+	if fi, err := os.Stat(name); err == nil {
+		mod = fi.ModTime()
+	}
+	if err := os.WriteFile(name, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if !mod.IsZero() {
+		mod = mod.Add(time.Second)
+		if err := os.Chtimes(name, mod, mod); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+type tlsFixture struct {
+	ca                        *testCA
+	certFile, keyFile, caFile string
+}
+
+func newTLSFixture(t *testing.T) *tlsFixture {
+	dir := t.TempDir()
+	f := &tlsFixture{
+		ca:       newTestCA(t, "test ca"),
+		certFile: filepath.Join(dir, "server.pem"),
+		keyFile:  filepath.Join(dir, "server.key"),
+		caFile:   filepath.Join(dir, "ca.pem"),
+	}
+	f.setServerCert(t, "server one")
+	writeFile(t, f.caFile, f.ca.pem)
+	return f
+}
+
+func (f *tlsFixture) setServerCert(t *testing.T, cn string) {
+	cert, key := f.ca.issue(t, cn, x509.ExtKeyUsageServerAuth)
+	writeFile(t, f.certFile, cert)
+	writeFile(t, f.keyFile, key)
+}
+
+// dialer returns a SOCKS5 client over TLS, presenting a certificate for
+// clientCN unless it is empty
+func (f *tlsFixture) dialer(t *testing.T, addr, clientCN string) *Dialer {
+	roots := x509.NewCertPool()
+	roots.AddCert(f.ca.cert)
+	cfg := &tls.Config{RootCAs: roots}
+	if clientCN != "" {
+		certPEM, keyPEM := f.ca.issue(t, clientCN, x509.ExtKeyUsageClientAuth)
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return &Dialer{ProxyAddr: addr, Forward: &tls.Dialer{Config: cfg}}
+}
+
+func TestTLSClientCertificate(t *testing.T) {
+	f := newTLSFixture(t)
+	echo := startEcho(t)
+	hook, closed := closeHook()
+	_, addr := startServer(t, ListenerConfig{
+		TLSCertFile:  f.certFile,
+		TLSKeyFile:   f.keyFile,
+		ClientCAFile: f.caFile,
+		Profile:      &Profile{Username: "user", Password: "secret"},
+	}, hook)
+
+	// A verified certificate replaces the password
+	conn, err := f.dialer(t, addr, "alice").Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoThrough(t, conn, "hello")
+	conn.Close()
+	if stats := nextClose(t, closed); stats.Identity != "alice" {
+		t.Errorf("identity = %q, want alice", stats.Identity)
+	}
+
+	// Without a certificate the password is still required
+	if _, err := f.dialer(t, addr, "").Dial("tcp", echo); err == nil {
+		t.Fatal("connected without certificate or password")
+	}
+	if stats := nextClose(t, closed); stats.Identity != "" || stats.Reason != CloseProtocolError {
+		t.Errorf("identity = %q, reason = %s; want none and %s", stats.Identity, stats.Reason, CloseProtocolError)
+	}
+	d := f.dialer(t, addr, "")
+	d.Username, d.Password = "user", "secret"
+	conn, err = d.Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoThrough(t, conn, "hello")
+	conn.Close()
+	if stats := nextClose(t, closed); stats.Identity != "user" {
+		t.Errorf("identity = %q, want user", stats.Identity)
+	}
+}
+
+func TestTLSClientCertificateRequired(t *testing.T) {
+	f := newTLSFixture(t)
+	echo := startEcho(t)
+	hook, closed := closeHook()
+	_, addr := startServer(t, ListenerConfig{
+		TLSCertFile:  f.certFile,
+		TLSKeyFile:   f.keyFile,
+		ClientCAFile: f.caFile,
+	}, hook)
+
+	conn, err := f.dialer(t, addr, "alice").Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoThrough(t, conn, "hello")
+	conn.Close()
+	if stats := nextClose(t, closed); stats.Identity != "alice" {
+		t.Errorf("identity = %q, want alice", stats.Identity)
+	}
+
+	// Without a password to fall back on, no certificate means no access
+	if _, err := f.dialer(t, addr, "").Dial("tcp", echo); err == nil {
+		t.Fatal("connected without a client certificate")
+	}
+	if stats := nextClose(t, closed); stats.Identity != "" || stats.Reason != CloseAuthFailed {
+		t.Errorf("identity = %q, reason = %s; want none and %s", stats.Identity, stats.Reason, CloseAuthFailed)
+	}
+}
+
+func TestTLSReload(t *testing.T) {
+	f := newTLSFixture(t)
+	echo := startEcho(t)
+	_, addr := startServer(t, ListenerConfig{
+		TLSCertFile:  f.certFile,
+		TLSKeyFile:   f.keyFile,
+		ClientCAFile: f.caFile,
+		Profile:      &Profile{Username: "user", Password: "secret"},
+	})
+
+	serverCN := func(clientCN string) string {
+		t.Helper()
+		conn, err := f.dialer(t, addr, clientCN).DialContext(context.Background(), "tcp", echo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		echoThrough(t, conn, "ping")
+		state := conn.(*Conn).NetConn().(*tls.Conn).ConnectionState()
+		return state.PeerCertificates[0].Subject.CommonName
+	}
+	if cn := serverCN("alice"); cn != "server one" {
+		t.Fatalf("server certificate %q, want server one", cn)
+	}
+
+	f.setServerCert(t, "server two")
+	if cn := serverCN("alice"); cn != "server two" {
+		t.Fatalf("server certificate %q after reload, want server two", cn)
+	}
+
+	// Broken files keep the previous certificate and client CA in use
+	writeFile(t, f.certFile, []byte("not a certificate"))
+	writeFile(t, f.caFile, []byte("not a certificate"))
+	if cn := serverCN("alice"); cn != "server two" {
+		t.Fatalf("server certificate %q with broken files, want server two", cn)
+	}
+	if err := os.Remove(f.caFile); err != nil {
+		t.Fatal(err)
+	}
+	if cn := serverCN("alice"); cn != "server two" {
+		t.Fatalf("server certificate %q without client CA file, want server two", cn)
+	}
+
+	// So do files removed while being replaced
+	if err := os.Remove(f.certFile); err != nil {
+		t.Fatal(err)
+	}
+	if cn := serverCN("alice"); cn != "server two" {
+		t.Fatalf("server certificate %q without certificate file, want server two", cn)
+	}
+	f.setServerCert(t, "server three")
+	if cn := serverCN("alice"); cn != "server three" {
+		t.Fatalf("server certificate %q after the files are back, want server three", cn)
+	}
+}
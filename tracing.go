@@ -0,0 +1,63 @@
+package socks5
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the instrumentation scope of the spans
+const tracerName = "github.com/dcsunny/socks5"
+
+// WithTracerProvider creates the spans of connections with tp instead of
+// the global OpenTelemetry provider. Each connection gets a span with child
+// spans for authentication, the system proxy lookup, resolution, the dial
+// and forwarding.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(s *Server) {
+		s.tracer = tp.Tracer(tracerName)
+	}
+}
+
+// defaultTracer follows the global provider, also when it is set later
+func defaultTracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// startSpan starts a child of the span in ctx with the same provider, so
+// that dialers only need the context
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	tracer := trace.SpanFromContext(ctx).TracerProvider().Tracer(tracerName)
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan records err, if any, and ends span
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// endConnSpan ends the span of a connection with its outcome
+func endConnSpan(span trace.Span, stats *ConnStats) {
+	span.SetAttributes(
+		attribute.String("socks5.user", stats.Identity),
+		attribute.String("socks5.request", stats.Requested),
+		attribute.String("socks5.target", stats.Target),
+		attribute.String("socks5.resolved", stats.Resolved),
+		attribute.String("socks5.upstream", stats.Upstream),
+		attribute.Int("socks5.reply", stats.Reply),
+		attribute.String("socks5.close_reason", string(stats.Reason)),
+		attribute.Int64("socks5.upload_bytes", stats.Upload),
+		attribute.Int64("socks5.download_bytes", stats.Download),
+	)
+	if stats.Reason.failed() {
+		span.SetStatus(codes.Error, string(stats.Reason))
+	}
+	span.End()
+}
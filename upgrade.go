@@ -0,0 +1,228 @@
+package socks5
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// upgradeReadyEnv names the descriptor a process started by Upgrade reports
+// readiness on, see NotifyUpgradeReady
+const upgradeReadyEnv = "SOCKS5_UPGRADE_READY_FD"
+
+// upgradeReadyTimeout bounds the wait for the new process to get ready
+const upgradeReadyTimeout = 30 * time.Second
+
+// inheritName is the LISTEN_FDNAMES entry a listener is passed under during
+// an upgrade. Sockets from systemd keep their name, others are keyed by
+// their address so the new process can match them to its listener specs.
+func inheritName(cfg ListenerConfig) string {
+	if cfg.Network == "systemd" {
+		return cfg.Addr
+	}
+	return url.QueryEscape(cfg.Network + "://" + cfg.Addr)
+}
+
+// WithInheritedListeners serves sockets inherited from systemd or from a
+// previous process. A listener whose address matches an inherited socket
+// reuses it instead of binding; the remaining ones are served with the
+// default profile.
+func WithInheritedListeners(listeners []ActivatedListener) Option {
+	return func(s *Server) {
+		if s.inherited == nil {
+			s.inherited = make(map[string]net.Listener)
+		}
+		for _, al := range listeners {
+			s.inherited[al.Name] = al.Listener
+		}
+	}
+}
+
+// WithPidFile names the pidfile of the process. Upgrade writes the pid of
+// the new process to it once that is ready.
+func WithPidFile(path string) Option {
+	return func(s *Server) {
+		s.pidFile = path
+	}
+}
+
+// StartedByUpgrade reports whether the process was started by Upgrade and
+// has not called NotifyUpgradeReady yet. Such a process leaves the pidfile
+// to the one that started it.
+func StartedByUpgrade() bool {
+	return os.Getenv(upgradeReadyEnv) != ""
+}
+
+// Upgrade starts a new copy of the running binary with the same arguments,
+// hands it the listening sockets and, once it calls NotifyUpgradeReady,
+// stops accepting. Connections already established keep being served; call
+// Shutdown to drain them. When the new process exits or does not get ready
+// in time it is killed and this one keeps serving.
+func (s *Server) Upgrade() (int, error) {
+	if runtime.GOOS == "windows" {
+		return 0, errors.New("upgrade is not supported on windows")
+	}
+	if !s.upgrading.TryLock() {
+		return 0, errors.New("an upgrade is already in progress")
+	}
+	defer s.upgrading.Unlock()
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	listeners := s.listeners
+	s.mu.Unlock()
+	if len(listeners) == 0 {
+		return 0, errors.New("server is not running")
+	}
+	var files []*os.File
+	var names []string
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, l := range listeners {
+		fl, ok := l.Listener.(interface{ File() (*os.File, error) })
+		if !ok {
+			return 0, fmt.Errorf("listener %s cannot be passed on", l)
+		}
+		f, err := fl.File()
+		if err != nil {
+			return 0, fmt.Errorf("listener %s cannot be passed on: %v", l, err)
+		}
+		files = append(files, f)
+		names = append(names, inheritName(l.cfg))
+	}
+
+	// The new process writes to the pipe once it serves the listeners
+	ready, readyW, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer ready.Close()
+	defer readyW.Close()
+
+	var env []string
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "LISTEN_") && !strings.HasPrefix(kv, upgradeReadyEnv+"=") {
+			env = append(env, kv)
+		}
+	}
+	env = append(env,
+		"LISTEN_FDS="+strconv.Itoa(len(files)),
+		"LISTEN_FDNAMES="+strings.Join(names, ":"),
+		upgradeReadyEnv+"="+strconv.Itoa(listenFdsStart+len(files)),
+	)
+
+	// The new process starts from the counters saved now and owns the
+	// file from then on; this one hands over the rest when it exits
+	if s.accounting != nil {
+		if err := s.accounting.flush(); err != nil {
+			s.logger.Error("Failed to save traffic accounting", "err", err)
+		}
+		s.accounting.handOver()
+	}
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = env
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, readyW)
+	if err := cmd.Start(); err != nil {
+		if s.accounting != nil {
+			s.accounting.resume()
+		}
+		return 0, fmt.Errorf("failed to start %s: %v", exe, err)
+	}
+	pid := cmd.Process.Pid
+	go func() {
+		// Reap the child should it exit before us
+		_ = cmd.Wait()
+	}()
+	s.logger.Info("Started new process, waiting for it to get ready", "pid", pid, "listeners", len(files))
+
+	// Only the child holds the write end now, so its exit ends the read
+	readyW.Close()
+	if err := waitReady(ready, upgradeReadyTimeout); err != nil {
+		_ = cmd.Process.Kill()
+		if s.accounting != nil {
+			s.accounting.resume()
+		}
+		return 0, fmt.Errorf("new process %d did not get ready, keeping the listeners: %v", pid, err)
+	}
+	s.logger.Info("New process is ready, handing over listeners", "pid", pid)
+	if s.pidFile != "" {
+		if err := writePidFile(s.pidFile, pid); err != nil {
+			s.logger.Error("Failed to write the new process id to the pidfile", "pidfile", s.pidFile, "err", err)
+		}
+	}
+
+	// The socket file now belongs to the new process
+	for _, l := range listeners {
+		if ul, ok := l.Listener.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+	return pid, s.Close()
+}
+
+// waitReady waits for the new process to write to the pipe
+func waitReady(ready *os.File, timeout time.Duration) error {
+	_ = ready.SetReadDeadline(time.Now().Add(timeout))
+	var b [1]byte
+	if _, err := ready.Read(b[:]); err != nil {
+		switch {
+		case errors.Is(err, io.EOF):
+			return errors.New("it exited")
+		case errors.Is(err, os.ErrDeadlineExceeded):
+			return fmt.Errorf("timed out after %v", timeout)
+		}
+		return err
+	}
+	return nil
+}
+
+// NotifyUpgradeReady tells the process that started this one with Upgrade
+// that the listeners are being served, so that it can stop accepting. Call
+// it after Start. It does nothing when the process was not started by
+// Upgrade.
+func NotifyUpgradeReady() error {
+	v := os.Getenv(upgradeReadyEnv)
+	if v == "" {
+		return nil
+	}
+	os.Unsetenv(upgradeReadyEnv)
+	fd, err := strconv.Atoi(v)
+	if err != nil || fd < listenFdsStart {
+		return fmt.Errorf("invalid %s: %q", upgradeReadyEnv, v)
+	}
+	f := os.NewFile(uintptr(fd), "upgrade-ready")
+	defer f.Close()
+	_, err = f.Write([]byte{1})
+	return err
+}
+
+// RemovePidFile removes path if it still holds the current process id, so
+// that a process handing over to its successor does not delete its pidfile.
+func RemovePidFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(string(data)) != strconv.Itoa(os.Getpid()) {
+		return nil
+	}
+	return os.Remove(path)
+}
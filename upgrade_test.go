@@ -0,0 +1,99 @@
+//go:build !windows
+
+package socks5
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// upgradeChildEnv makes the test binary play the process started by Upgrade
+const upgradeChildEnv = "SOCKS5_TEST_UPGRADE_CHILD"
+
+func TestMain(m *testing.M) {
+	switch {
+	case os.Getenv(upgradeChildEnv) != "":
+		upgradeChild()
+	case os.Getenv(activationChildEnv) != "":
+		activationChild()
+	case os.Getenv(privilegeChildEnv) != "":
+		privilegeChild(os.Getenv(privilegeChildEnv))
+	default:
+		os.Exit(m.Run())
+	}
+}
+
+// upgradeChild serves the inherited listeners until it is terminated, or
+// for a minute should the test die first
+func upgradeChild() {
+	fail := func(err error) {
+		fmt.Fprintln(os.Stderr, "upgrade child:", err)
+		os.Exit(1)
+	}
+	if !StartedByUpgrade() {
+		fail(fmt.Errorf("%s is not set", upgradeReadyEnv))
+	}
+	listeners, err := ActivationListeners()
+	if err != nil {
+		fail(err)
+	}
+	s := NewServer(false, "", "", "", "", WithLogger(testLogger()), WithInheritedListeners(listeners))
+	if err := s.Start(); err != nil {
+		fail(err)
+	}
+	if err := NotifyUpgradeReady(); err != nil {
+		fail(err)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM)
+	defer stop()
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Minute):
+	}
+	_ = s.Shutdown(context.Background())
+	os.Exit(0)
+}
+
+func TestUpgrade(t *testing.T) {
+	echo := startEcho(t)
+	pidFile := filepath.Join(t.TempDir(), "socks5.pid")
+	if err := WritePidFile(pidFile); err != nil {
+		t.Fatal(err)
+	}
+	s, addr := startServer(t, ListenerConfig{}, WithPidFile(pidFile))
+	conn := tunnel(t, &Dialer{ProxyAddr: addr}, echo)
+
+	t.Setenv(upgradeChildEnv, "1")
+	pid, err := s.Upgrade()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = syscall.Kill(pid, syscall.SIGTERM) })
+
+	// The new process owns the pidfile, which survives this one exiting
+	data, err := os.ReadFile(pidFile)
+	if err != nil || strings.TrimSpace(string(data)) != strconv.Itoa(pid) {
+		t.Errorf("pidfile = %q, %v; want the new pid %d", data, err, pid)
+	}
+	if err := RemovePidFile(pidFile); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(pidFile); err != nil {
+		t.Errorf("pidfile of the new process removed: %v", err)
+	}
+
+	// Established tunnels stay, new connections go to the new process
+	echoThrough(t, conn, "still here")
+	tunnel(t, &Dialer{ProxyAddr: addr}, echo)
+	if got := s.Stats().Accepted; got != 1 {
+		t.Errorf("%d connections accepted by the old process, want 1", got)
+	}
+}
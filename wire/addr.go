@@ -0,0 +1,164 @@
+package wire
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// AddrSpec is a SOCKS address: an IP address or a domain name, and a port.
+// The zero value encodes as 0.0.0.0:0.
+type AddrSpec struct {
+	IP   net.IP
+	FQDN string
+	Port int
+}
+
+// ParseAddrSpec parses host:port, where host is an IP address or a domain name
+func ParseAddrSpec(hostport string) (AddrSpec, error) {
+	host, portStr, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return AddrSpec{}, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 0xFFFF {
+		return AddrSpec{}, fmt.Errorf("invalid port %q", portStr)
+	}
+	a := AddrSpec{Port: port}
+	if ip := net.ParseIP(host); ip != nil {
+		a.IP = ip
+	} else {
+		a.FQDN = host
+	}
+	return a, a.validate()
+}
+
+// AddrSpecOf converts a TCP or UDP address; other addresses give the zero AddrSpec
+func AddrSpecOf(addr net.Addr) AddrSpec {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return AddrSpec{IP: a.IP, Port: a.Port}
+	case *net.UDPAddr:
+		return AddrSpec{IP: a.IP, Port: a.Port}
+	}
+	return AddrSpec{}
+}
+
+// Type returns the ATYP the address is encoded with
+func (a AddrSpec) Type() byte {
+	switch {
+	case a.FQDN != "":
+		return AtypDomain
+	case a.IP == nil || a.IP.To4() != nil:
+		return AtypIPv4
+	}
+	return AtypIPv6
+}
+
+// Host returns the domain name or the IP address as a string
+func (a AddrSpec) Host() string {
+	if a.FQDN != "" {
+		return a.FQDN
+	}
+	if a.IP == nil {
+		return net.IPv4zero.String()
+	}
+	return a.IP.String()
+}
+
+func (a AddrSpec) String() string {
+	return net.JoinHostPort(a.Host(), strconv.Itoa(a.Port))
+}
+
+func (a AddrSpec) validate() error {
+	if len(a.FQDN) > 255 {
+		return formatError("domain name longer than 255 bytes")
+	}
+	if a.IP != nil && a.IP.To4() == nil && len(a.IP) != net.IPv6len {
+		return formatError("invalid IP address %v", a.IP)
+	}
+	if a.Port < 0 || a.Port > 0xFFFF {
+		return formatError("invalid port %d", a.Port)
+	}
+	return nil
+}
+
+// ReadFrom reads ATYP, the address and the port
+func (a *AddrSpec) ReadFrom(r io.Reader) (int64, error) {
+	cr := &reader{r: r}
+	err := a.read(cr)
+	return cr.n, err
+}
+
+// WriteTo writes ATYP, the address and the port
+func (a AddrSpec) WriteTo(w io.Writer) (int64, error) {
+	b, err := a.appendTo(nil)
+	return write(w, b, err)
+}
+
+func (a *AddrSpec) read(r *reader) error {
+	atyp, err := r.byte()
+	if err != nil {
+		return err
+	}
+	*a = AddrSpec{}
+	switch atyp {
+	case AtypIPv4:
+		ip := make(net.IP, net.IPv4len)
+		if err := r.full(ip); err != nil {
+			return err
+		}
+		a.IP = ip
+	case AtypIPv6:
+		ip := make(net.IP, net.IPv6len)
+		if err := r.full(ip); err != nil {
+			return err
+		}
+		a.IP = ip
+	case AtypDomain:
+		n, err := r.byte()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return formatError("empty domain name")
+		}
+		domain := make([]byte, n)
+		if err := r.full(domain); err != nil {
+			return err
+		}
+		a.FQDN = string(domain)
+	default:
+		return &AddrTypeError{Type: atyp}
+	}
+	var port [2]byte
+	if err := r.full(port[:]); err != nil {
+		return err
+	}
+	a.Port = int(binary.BigEndian.Uint16(port[:]))
+	return nil
+}
+
+func (a AddrSpec) appendTo(b []byte) ([]byte, error) {
+	if err := a.validate(); err != nil {
+		return nil, err
+	}
+	atyp := a.Type()
+	b = append(b, atyp)
+	switch atyp {
+	case AtypDomain:
+		b = append(b, byte(len(a.FQDN)))
+		b = append(b, a.FQDN...)
+	case AtypIPv4:
+		if a.IP == nil {
+			b = append(b, 0, 0, 0, 0)
+		} else {
+			b = append(b, a.IP.To4()...)
+		}
+	default:
+		b = append(b, a.IP.To16()...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(a.Port)), nil
+}
@@ -0,0 +1,194 @@
+package wire
+
+import (
+	"bytes"
+	"io"
+)
+
+// Greeting is the client's first message, listing the methods it supports
+type Greeting struct {
+	Methods []byte
+}
+
+// Offers reports whether the client supports method
+func (g *Greeting) Offers(method byte) bool {
+	return bytes.IndexByte(g.Methods, method) >= 0
+}
+
+func (g *Greeting) ReadFrom(r io.Reader) (int64, error) {
+	cr := &reader{r: r}
+	var hdr [2]byte
+	if err := cr.full(hdr[:]); err != nil {
+		return cr.n, err
+	}
+	if hdr[0] != Version {
+		return cr.n, &VersionError{Version: hdr[0]}
+	}
+	if hdr[1] == 0 {
+		return cr.n, formatError("no authentication methods")
+	}
+	g.Methods = make([]byte, hdr[1])
+	return cr.n, cr.full(g.Methods)
+}
+
+func (g *Greeting) WriteTo(w io.Writer) (int64, error) {
+	if len(g.Methods) == 0 || len(g.Methods) > 255 {
+		return 0, formatError("%d authentication methods", len(g.Methods))
+	}
+	b := append([]byte{Version, byte(len(g.Methods))}, g.Methods...)
+	return write(w, b, nil)
+}
+
+// MethodSelection is the server's answer to a Greeting
+type MethodSelection struct {
+	Method byte
+}
+
+func (m *MethodSelection) ReadFrom(r io.Reader) (int64, error) {
+	cr := &reader{r: r}
+	var b [2]byte
+	if err := cr.full(b[:]); err != nil {
+		return cr.n, err
+	}
+	if b[0] != Version {
+		return cr.n, &VersionError{Version: b[0]}
+	}
+	m.Method = b[1]
+	return cr.n, nil
+}
+
+func (m *MethodSelection) WriteTo(w io.Writer) (int64, error) {
+	return write(w, []byte{Version, m.Method}, nil)
+}
+
+// UserPassRequest carries the credentials of the username/password method
+type UserPassRequest struct {
+	Username string
+	Password string
+}
+
+func (u *UserPassRequest) ReadFrom(r io.Reader) (int64, error) {
+	cr := &reader{r: r}
+	ver, err := cr.byte()
+	if err != nil {
+		return cr.n, err
+	}
+	if ver != UserPassVersion {
+		return cr.n, &VersionError{Version: ver}
+	}
+	if u.Username, err = readString(cr, "username"); err != nil {
+		return cr.n, err
+	}
+	u.Password, err = readString(cr, "password")
+	return cr.n, err
+}
+
+func (u *UserPassRequest) WriteTo(w io.Writer) (int64, error) {
+	for _, f := range []struct{ name, value string }{{"username", u.Username}, {"password", u.Password}} {
+		if len(f.value) == 0 || len(f.value) > 255 {
+			return 0, formatError("%s must be 1 to 255 bytes", f.name)
+		}
+	}
+	b := []byte{UserPassVersion, byte(len(u.Username))}
+	b = append(b, u.Username...)
+	b = append(b, byte(len(u.Password)))
+	b = append(b, u.Password...)
+	return write(w, b, nil)
+}
+
+// readString reads a length-prefixed string of 1 to 255 bytes
+func readString(r *reader, name string) (string, error) {
+	n, err := r.byte()
+	if err != nil {
+		return "", err
+	}
+	if n == 0 {
+		return "", formatError("empty %s", name)
+	}
+	b := make([]byte, n)
+	if err := r.full(b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// UserPassReply is the server's answer to a UserPassRequest
+type UserPassReply struct {
+	Status byte
+}
+
+func (u *UserPassReply) ReadFrom(r io.Reader) (int64, error) {
+	cr := &reader{r: r}
+	var b [2]byte
+	if err := cr.full(b[:]); err != nil {
+		return cr.n, err
+	}
+	if b[0] != UserPassVersion {
+		return cr.n, &VersionError{Version: b[0]}
+	}
+	u.Status = b[1]
+	return cr.n, nil
+}
+
+func (u *UserPassReply) WriteTo(w io.Writer) (int64, error) {
+	return write(w, []byte{UserPassVersion, u.Status}, nil)
+}
+
+// Request asks the server to run a command for an address
+type Request struct {
+	Command byte
+	Addr    AddrSpec
+}
+
+func (req *Request) ReadFrom(r io.Reader) (int64, error) {
+	cr := &reader{r: r}
+	var hdr [3]byte
+	if err := cr.full(hdr[:]); err != nil {
+		return cr.n, err
+	}
+	if hdr[0] != Version {
+		return cr.n, &VersionError{Version: hdr[0]}
+	}
+	switch hdr[1] {
+	case CmdConnect, CmdBind, CmdUDPAssociate:
+	default:
+		return cr.n, &CommandError{Command: hdr[1]}
+	}
+	if hdr[2] != 0 {
+		return cr.n, formatError("reserved byte is %d", hdr[2])
+	}
+	req.Command = hdr[1]
+	return cr.n, req.Addr.read(cr)
+}
+
+func (req *Request) WriteTo(w io.Writer) (int64, error) {
+	b, err := req.Addr.appendTo([]byte{Version, req.Command, 0})
+	return write(w, b, err)
+}
+
+// Reply is the server's answer to a Request; Addr is the bound address
+type Reply struct {
+	Code byte
+	Addr AddrSpec
+}
+
+func (rep *Reply) ReadFrom(r io.Reader) (int64, error) {
+	cr := &reader{r: r}
+	var hdr [3]byte
+	if err := cr.full(hdr[:]); err != nil {
+		return cr.n, err
+	}
+	if hdr[0] != Version {
+		return cr.n, &VersionError{Version: hdr[0]}
+	}
+	if hdr[2] != 0 {
+		return cr.n, formatError("reserved byte is %d", hdr[2])
+	}
+	rep.Code = hdr[1]
+	return cr.n, rep.Addr.read(cr)
+}
+
+func (rep *Reply) WriteTo(w io.Writer) (int64, error) {
+	b, err := rep.Addr.appendTo([]byte{Version, rep.Code, 0})
+	return write(w, b, err)
+}
@@ -0,0 +1,56 @@
+package wire
+
+import (
+	"bytes"
+	"io"
+)
+
+// UDPHeader precedes the payload of datagrams relayed by UDP ASSOCIATE
+type UDPHeader struct {
+	Frag byte
+	Addr AddrSpec
+}
+
+func (h *UDPHeader) ReadFrom(r io.Reader) (int64, error) {
+	cr := &reader{r: r}
+	var hdr [3]byte
+	if err := cr.full(hdr[:]); err != nil {
+		return cr.n, err
+	}
+	if hdr[0] != 0 || hdr[1] != 0 {
+		return cr.n, formatError("reserved bytes are %d %d", hdr[0], hdr[1])
+	}
+	h.Frag = hdr[2]
+	return cr.n, h.Addr.read(cr)
+}
+
+func (h *UDPHeader) WriteTo(w io.Writer) (int64, error) {
+	b, err := h.appendTo(nil)
+	return write(w, b, err)
+}
+
+func (h *UDPHeader) appendTo(b []byte) ([]byte, error) {
+	return h.Addr.appendTo(append(b, 0, 0, h.Frag))
+}
+
+// ParseUDPDatagram splits a relayed datagram into its header and payload
+func ParseUDPDatagram(b []byte) (UDPHeader, []byte, error) {
+	var h UDPHeader
+	n, err := h.ReadFrom(bytes.NewReader(b))
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = formatError("truncated UDP header")
+	}
+	if err != nil {
+		return h, nil, err
+	}
+	return h, b[n:], nil
+}
+
+// Datagram returns the header followed by payload
+func (h *UDPHeader) Datagram(payload []byte) ([]byte, error) {
+	b, err := h.appendTo(nil)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, payload...), nil
+}
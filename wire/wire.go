@@ -0,0 +1,161 @@
+// Package wire encodes and decodes the SOCKS5 wire protocol (RFC 1928) and
+// the username/password sub-negotiation (RFC 1929).
+//
+// Every message type implements io.ReaderFrom and io.WriterTo. ReadFrom
+// never reads past the end of its message, so pipelined data stays in the
+// reader. Malformed messages are reported as *VersionError, *CommandError,
+// *AddrTypeError or *FormatError; I/O errors are returned as they are.
+package wire
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Version is the SOCKS protocol version
+const Version = byte(5)
+
+// Authentication methods
+const (
+	MethodNoAuth       = byte(0x00)
+	MethodGSSAPI       = byte(0x01)
+	MethodUserPass     = byte(0x02)
+	MethodNoAcceptable = byte(0xFF)
+)
+
+// Commands
+const (
+	CmdConnect      = byte(1)
+	CmdBind         = byte(2)
+	CmdUDPAssociate = byte(3)
+)
+
+// Address types
+const (
+	AtypIPv4   = byte(1)
+	AtypDomain = byte(3)
+	AtypIPv6   = byte(4)
+)
+
+// Reply codes
+const (
+	RepSucceeded          = byte(0)
+	RepGeneralFailure     = byte(1)
+	RepRulesetDenied      = byte(2)
+	RepNetworkUnreachable = byte(3)
+	RepHostUnreachable    = byte(4)
+	RepConnectionRefused  = byte(5)
+	RepTTLExpired         = byte(6)
+	RepCommandUnsupported = byte(7)
+	RepAddrUnsupported    = byte(8)
+)
+
+// Username/password sub-negotiation
+const (
+	UserPassVersion   = byte(1)
+	UserPassSucceeded = byte(0)
+	UserPassFailed    = byte(1)
+)
+
+var replyText = [...]string{
+	RepSucceeded:          "succeeded",
+	RepGeneralFailure:     "general SOCKS server failure",
+	RepRulesetDenied:      "connection not allowed by ruleset",
+	RepNetworkUnreachable: "network unreachable",
+	RepHostUnreachable:    "host unreachable",
+	RepConnectionRefused:  "connection refused",
+	RepTTLExpired:         "TTL expired",
+	RepCommandUnsupported: "command not supported",
+	RepAddrUnsupported:    "address type not supported",
+}
+
+// ReplyText describes a reply code
+func ReplyText(rep byte) string {
+	if int(rep) < len(replyText) {
+		return replyText[rep]
+	}
+	return fmt.Sprintf("unknown reply code %d", rep)
+}
+
+// ReplyCode returns the reply code a server answers a request that failed
+// to parse with err
+func ReplyCode(err error) byte {
+	var cmdErr *CommandError
+	var atypErr *AddrTypeError
+	switch {
+	case errors.As(err, &cmdErr):
+		return RepCommandUnsupported
+	case errors.As(err, &atypErr):
+		return RepAddrUnsupported
+	}
+	return RepGeneralFailure
+}
+
+// VersionError reports a message with an unexpected version field
+type VersionError struct {
+	Version byte
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("socks: unsupported version %d", e.Version)
+}
+
+// CommandError reports a request with an unknown command
+type CommandError struct {
+	Command byte
+}
+
+func (e *CommandError) Error() string {
+	return fmt.Sprintf("socks: unsupported command %d", e.Command)
+}
+
+// AddrTypeError reports an address with an unknown type
+type AddrTypeError struct {
+	Type byte
+}
+
+func (e *AddrTypeError) Error() string {
+	return fmt.Sprintf("socks: unsupported address type %d", e.Type)
+}
+
+// FormatError reports a malformed message, such as a non-zero reserved byte
+// or a field with an invalid length
+type FormatError struct {
+	Msg string
+}
+
+func (e *FormatError) Error() string {
+	return "socks: malformed message: " + e.Msg
+}
+
+func formatError(format string, args ...any) error {
+	return &FormatError{Msg: fmt.Sprintf(format, args...)}
+}
+
+// reader counts the bytes read for ReadFrom
+type reader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *reader) full(b []byte) error {
+	n, err := io.ReadFull(r.r, b)
+	r.n += int64(n)
+	return err
+}
+
+func (r *reader) byte() (byte, error) {
+	var b [1]byte
+	err := r.full(b[:])
+	return b[0], err
+}
+
+// write sends a message encoded by appendTo in a single Write
+func write(w io.Writer, b []byte, err error) (int64, error) {
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(b)
+	return int64(n), err
+}
@@ -0,0 +1,189 @@
+package wire
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+// message is implemented by every wire message
+type message interface {
+	io.ReaderFrom
+	io.WriterTo
+}
+
+// checkRoundTrip parses data with m and, when that succeeds, checks that
+// it consumed exactly what it reported and that encoding the result gives a
+// message that parses to the same value
+func checkRoundTrip(t *testing.T, data []byte, m, again message, same func() bool) {
+	t.Helper()
+	r := bytes.NewReader(data)
+	n, err := m.ReadFrom(r)
+	if int(n) != len(data)-r.Len() {
+		t.Fatalf("ReadFrom reported %d bytes, consumed %d", n, len(data)-r.Len())
+	}
+	if err != nil {
+		return
+	}
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo of parsed %+v: %v", m, err)
+	}
+	if _, err := again.ReadFrom(&buf); err != nil {
+		t.Fatalf("parsing the encoding of %+v: %v", m, err)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("%d bytes left after parsing the encoding of %+v", buf.Len(), m)
+	}
+	if !same() {
+		t.Fatalf("round trip changed %+v to %+v", m, again)
+	}
+}
+
+func FuzzGreeting(f *testing.F) {
+	f.Add([]byte{5, 1, 0})
+	f.Add([]byte{5, 2, 0, 2, 'x'})
+	f.Add([]byte{5, 0})
+	f.Add([]byte{4, 1, 0})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var g, again Greeting
+		checkRoundTrip(t, data, &g, &again, func() bool {
+			return bytes.Equal(g.Methods, again.Methods)
+		})
+	})
+}
+
+func FuzzRequest(f *testing.F) {
+	f.Add([]byte{5, 1, 0, 1, 127, 0, 0, 1, 0, 80})
+	f.Add([]byte{5, 2, 0, 3, 11, 'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'c', 'o', 'm', 1, 187})
+	f.Add([]byte{5, 3, 0, 4, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 10, 0, 0, 1, 0, 53})
+	f.Add([]byte{5, 9, 0, 1, 127, 0, 0, 1, 0, 80})
+	f.Add([]byte{5, 1, 0, 3, 0, 0, 80})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var req, again Request
+		checkRoundTrip(t, data, &req, &again, func() bool {
+			return req.Command == again.Command && req.Addr.String() == again.Addr.String()
+		})
+	})
+}
+
+func FuzzUDPHeader(f *testing.F) {
+	f.Add([]byte{0, 0, 0, 1, 8, 8, 8, 8, 0, 53, 'p', 'a', 'y'})
+	f.Add([]byte{0, 0, 1, 3, 4, 'h', 'o', 's', 't', 0x1f, 0x90})
+	f.Add([]byte{0, 1, 0, 1, 8, 8, 8, 8, 0, 53})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var h, again UDPHeader
+		checkRoundTrip(t, data, &h, &again, func() bool {
+			return h.Frag == again.Frag && h.Addr.String() == again.Addr.String()
+		})
+
+		// ParseUDPDatagram agrees with ReadFrom and keeps the payload
+		parsed, payload, err := ParseUDPDatagram(data)
+		if err != nil {
+			return
+		}
+		datagram, err := parsed.Datagram(payload)
+		if err != nil {
+			t.Fatalf("Datagram of parsed %+v: %v", parsed, err)
+		}
+		reparsed, repayload, err := ParseUDPDatagram(datagram)
+		if err != nil || reparsed.Addr.String() != parsed.Addr.String() || !bytes.Equal(repayload, payload) {
+			t.Fatalf("datagram round trip: %+v %q %v, want %+v %q", reparsed, repayload, err, parsed, payload)
+		}
+	})
+}
+
+func FuzzUserPass(f *testing.F) {
+	f.Add([]byte{1, 4, 'u', 's', 'e', 'r', 6, 's', 'e', 'c', 'r', 'e', 't'})
+	f.Add([]byte{1, 0, 1, 'x'})
+	f.Add([]byte{5, 1, 'u', 1, 'p'})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var u, again UserPassRequest
+		checkRoundTrip(t, data, &u, &again, func() bool {
+			return u == again
+		})
+	})
+}
+
+func TestReadErrors(t *testing.T) {
+	var (
+		versionErr *VersionError
+		commandErr *CommandError
+		atypErr    *AddrTypeError
+		formatErr  *FormatError
+	)
+	tests := []struct {
+		name  string
+		msg   message
+		data  []byte
+		want  any // error target for errors.As, or an error for errors.Is
+		reply byte
+	}{
+		{"greeting version", &Greeting{}, []byte{4, 1, 0}, &versionErr, RepGeneralFailure},
+		{"greeting without methods", &Greeting{}, []byte{5, 0}, &formatErr, RepGeneralFailure},
+		{"greeting truncated", &Greeting{}, []byte{5, 2, 0}, io.ErrUnexpectedEOF, RepGeneralFailure},
+		{"greeting empty", &Greeting{}, nil, io.EOF, RepGeneralFailure},
+		{"request version", &Request{}, []byte{4, 1, 0, 1, 127, 0, 0, 1, 0, 80}, &versionErr, RepGeneralFailure},
+		{"request command", &Request{}, []byte{5, 9, 0, 1, 127, 0, 0, 1, 0, 80}, &commandErr, RepCommandUnsupported},
+		{"request reserved", &Request{}, []byte{5, 1, 1, 1, 127, 0, 0, 1, 0, 80}, &formatErr, RepGeneralFailure},
+		{"request address type", &Request{}, []byte{5, 1, 0, 2, 127, 0, 0, 1, 0, 80}, &atypErr, RepAddrUnsupported},
+		{"request empty domain", &Request{}, []byte{5, 1, 0, 3, 0, 0, 80}, &formatErr, RepGeneralFailure},
+		{"request truncated port", &Request{}, []byte{5, 1, 0, 1, 127, 0, 0, 1, 0}, io.ErrUnexpectedEOF, RepGeneralFailure},
+		{"reply version", &Reply{}, []byte{4, 0, 0, 1, 0, 0, 0, 0, 0, 0}, &versionErr, RepGeneralFailure},
+		{"udp reserved", &UDPHeader{}, []byte{0, 1, 0, 1, 8, 8, 8, 8, 0, 53}, &formatErr, RepGeneralFailure},
+		{"udp address type", &UDPHeader{}, []byte{0, 0, 0, 5, 8, 8, 8, 8, 0, 53}, &atypErr, RepAddrUnsupported},
+		{"userpass version", &UserPassRequest{}, []byte{5, 1, 'u', 1, 'p'}, &versionErr, RepGeneralFailure},
+		{"userpass empty username", &UserPassRequest{}, []byte{1, 0, 1, 'p'}, &formatErr, RepGeneralFailure},
+		{"userpass empty password", &UserPassRequest{}, []byte{1, 1, 'u', 0}, &formatErr, RepGeneralFailure},
+		{"userpass truncated", &UserPassRequest{}, []byte{1, 4, 'u'}, io.ErrUnexpectedEOF, RepGeneralFailure},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.msg.ReadFrom(bytes.NewReader(tt.data))
+			if target, ok := tt.want.(error); ok {
+				if !errors.Is(err, target) {
+					t.Errorf("err = %v, want %v", err, target)
+				}
+			} else if !errors.As(err, tt.want) {
+				t.Errorf("err = %T %v, want %T", err, err, tt.want)
+			}
+			if code := ReplyCode(err); code != tt.reply {
+				t.Errorf("ReplyCode = %d, want %d", code, tt.reply)
+			}
+		})
+	}
+
+	// A datagram too short for its header is a format error, not EOF
+	if _, _, err := ParseUDPDatagram([]byte{0, 0, 0, 1, 8, 8}); !errors.As(err, &formatErr) {
+		t.Errorf("ParseUDPDatagram of a truncated header: %v, want a *FormatError", err)
+	}
+}
+
+func TestWriteErrors(t *testing.T) {
+	long := string(bytes.Repeat([]byte("x"), 256))
+	tests := []struct {
+		name string
+		msg  io.WriterTo
+	}{
+		{"greeting without methods", &Greeting{}},
+		{"greeting with 256 methods", &Greeting{Methods: make([]byte, 256)}},
+		{"empty username", &UserPassRequest{Password: "p"}},
+		{"long password", &UserPassRequest{Username: "u", Password: long}},
+		{"long domain", &Request{Command: CmdConnect, Addr: AddrSpec{FQDN: long, Port: 80}}},
+		{"port", &Request{Command: CmdConnect, Addr: AddrSpec{FQDN: "example.com", Port: 1 << 16}}},
+		{"ip", &UDPHeader{Addr: AddrSpec{IP: []byte{1, 2, 3}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			var formatErr *FormatError
+			if _, err := tt.msg.WriteTo(&buf); !errors.As(err, &formatErr) {
+				t.Errorf("err = %v, want a *FormatError", err)
+			}
+			if buf.Len() != 0 {
+				t.Errorf("wrote %d bytes of an invalid message", buf.Len())
+			}
+		})
+	}
+}